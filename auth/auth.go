@@ -2,10 +2,12 @@ package auth
 
 import (
 	"fmt"
+	"github.com/EphyraSoftware/locus/metrics"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/log"
 	ory "github.com/ory/client-go"
 	"net/http"
+	"time"
 )
 
 type App struct {
@@ -15,7 +17,7 @@ type App struct {
 }
 
 func SessionUser(c *fiber.Ctx) interface{} {
-	session := c.Locals("session").(*ory.Session)
+	session, _ := c.Locals("session").(*ory.Session)
 	if session == nil {
 		return nil
 	} else {
@@ -24,7 +26,7 @@ func SessionUser(c *fiber.Ctx) interface{} {
 }
 
 func SessionId(c *fiber.Ctx) string {
-	session := c.Locals("session").(*ory.Session)
+	session, _ := c.Locals("session").(*ory.Session)
 	if session == nil {
 		return ""
 	} else {
@@ -32,51 +34,57 @@ func SessionId(c *fiber.Ctx) string {
 	}
 }
 
+// HasSession checks whether the request has already been authenticated.
+func HasSession(c *fiber.Ctx) bool {
+	session, _ := c.Locals("session").(*ory.Session)
+	return session != nil
+}
+
 func (a *App) Prepare(app *fiber.App) {
 	a.Router.Get("/login", func(c *fiber.Ctx) error {
 		flowId := c.Query("flow")
 		if flowId == "" {
-			log.Info("No flow id")
-			return c.SendStatus(http.StatusBadRequest)
+			log.Info("No flow id, starting a new login flow")
+			return a.restartFlow(c, "login")
 		}
 
 		cookies, err := getCookiesFromRequest(c)
 		if err != nil {
-			log.Errorf("No cookies: %s", err)
-			return c.SendStatus(http.StatusBadRequest)
+			log.Infof("No cookies, starting a new login flow: %s", err)
+			return a.restartFlow(c, "login")
 		}
 
-		req := a.Ory.FrontendAPI.GetLoginFlow(c.Context()).Id(flowId).Cookie(cookies)
-		flow, _, err := a.Ory.FrontendAPI.GetLoginFlowExecute(req)
+		req := a.Ory.FrontendAPI.GetLoginFlow(c.UserContext()).Id(flowId).Cookie(cookies)
+		flow, resp, err := a.Ory.FrontendAPI.GetLoginFlowExecute(req)
 		if err != nil {
-			log.Errorf("Error getting login flow: %s", err)
-			return c.SendStatus(http.StatusInternalServerError)
+			return a.handleFlowError(c, "login", resp, err)
 		}
 
 		return c.Render("public/auth/login", fiber.Map{
 			"Flow":        flow,
+			"Groups":      GroupUiNodes(flow.Ui.Nodes),
 			"RegisterUrl": fmt.Sprintf("%sself-service/registration/browser", a.OryBrowserBase),
+			"RecoveryUrl": fmt.Sprintf("%sself-service/recovery/browser", a.OryBrowserBase),
 		})
 	})
 
 	a.Router.Get("/register", func(c *fiber.Ctx) error {
 		flowId := c.Query("flow")
 		if flowId == "" {
-			log.Info("No flow id")
-			return c.SendStatus(http.StatusBadRequest)
+			log.Info("No flow id, starting a new registration flow")
+			return a.restartFlow(c, "registration")
 		}
 
 		cookies, err := getCookiesFromRequest(c)
 		if err != nil {
-			log.Errorf("No cookies: %s", err)
-			return c.SendStatus(http.StatusBadRequest)
+			log.Infof("No cookies, starting a new registration flow: %s", err)
+			return a.restartFlow(c, "registration")
 		}
 
-		req := a.Ory.FrontendAPI.GetRegistrationFlow(c.Context()).Id(flowId).Cookie(cookies)
-		flow, _, err := a.Ory.FrontendAPI.GetRegistrationFlowExecute(req)
+		req := a.Ory.FrontendAPI.GetRegistrationFlow(c.UserContext()).Id(flowId).Cookie(cookies)
+		flow, resp, err := a.Ory.FrontendAPI.GetRegistrationFlowExecute(req)
 		if err != nil {
-			log.Errorf("Error getting registration flow: %s", err)
-			return c.SendStatus(http.StatusInternalServerError)
+			return a.handleFlowError(c, "registration", resp, err)
 		}
 
 		return c.Render("public/auth/register", flow)
@@ -85,35 +93,89 @@ func (a *App) Prepare(app *fiber.App) {
 	a.Router.Get("/verification", func(c *fiber.Ctx) error {
 		flowId := c.Query("flow")
 		if flowId == "" {
-			log.Info("No flow id")
-			return c.SendStatus(http.StatusBadRequest)
+			log.Info("No flow id, starting a new verification flow")
+			return a.restartFlow(c, "verification")
 		}
 
 		cookies, err := getCookiesFromRequest(c)
 		if err != nil {
-			log.Errorf("No cookies: %s", err)
-			return c.SendStatus(http.StatusBadRequest)
+			log.Infof("No cookies, starting a new verification flow: %s", err)
+			return a.restartFlow(c, "verification")
 		}
 
-		req := a.Ory.FrontendAPI.GetVerificationFlow(c.Context()).Id(flowId).Cookie(cookies)
-		flow, _, err := a.Ory.FrontendAPI.GetVerificationFlowExecute(req)
+		req := a.Ory.FrontendAPI.GetVerificationFlow(c.UserContext()).Id(flowId).Cookie(cookies)
+		flow, resp, err := a.Ory.FrontendAPI.GetVerificationFlowExecute(req)
 		if err != nil {
-			log.Errorf("Error getting verification flow: %s", err)
-			return c.SendStatus(http.StatusInternalServerError)
+			return a.handleFlowError(c, "verification", resp, err)
 		}
 
 		return c.Render("public/auth/verification", flow)
 	})
 
+	a.Router.Get("/recovery", func(c *fiber.Ctx) error {
+		flowId := c.Query("flow")
+		if flowId == "" {
+			log.Info("No flow id, starting a new recovery flow")
+			return a.restartFlow(c, "recovery")
+		}
+
+		cookies, err := getCookiesFromRequest(c)
+		if err != nil {
+			log.Infof("No cookies, starting a new recovery flow: %s", err)
+			return a.restartFlow(c, "recovery")
+		}
+
+		req := a.Ory.FrontendAPI.GetRecoveryFlow(c.UserContext()).Id(flowId).Cookie(cookies)
+		flow, resp, err := a.Ory.FrontendAPI.GetRecoveryFlowExecute(req)
+		if err != nil {
+			return a.handleFlowError(c, "recovery", resp, err)
+		}
+
+		return c.Render("public/auth/recovery", fiber.Map{
+			"Flow":     flow,
+			"Groups":   GroupUiNodes(flow.Ui.Nodes),
+			"LoginUrl": fmt.Sprintf("%sself-service/login/browser", a.OryBrowserBase),
+		})
+	})
+
+	a.Router.Get("/error", func(c *fiber.Ctx) error {
+		errorId := c.Query("id")
+		if errorId == "" {
+			log.Info("No error id")
+			return a.renderError(c, http.StatusBadRequest, "Something went wrong", "An unknown error occurred while signing you in. Please try again.")
+		}
+
+		flowError, resp, err := a.Ory.FrontendAPI.GetFlowError(c.UserContext()).Id(errorId).Execute()
+		if err != nil {
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				log.Infof("Flow error not found: %s", errorId)
+				return a.renderError(c, http.StatusNotFound, "Something went wrong", "The error you are looking for has expired or does not exist.")
+			}
+
+			log.Errorf("Error getting flow error: %s", err)
+			return a.renderError(c, http.StatusBadGateway, "Something went wrong", "We couldn't reach the authentication service. Please try again in a moment.")
+		}
+
+		page := flowErrorPage(flowError.Id, flowError.Error)
+		return c.Status(page.Status).Render("public/auth/error", page)
+	})
+
 	// Mount middleware to the root of the app to protect all routes
 	app.Use(func(c *fiber.Ctx) error {
+		// Already authenticated, for example by a client certificate
+		if HasSession(c) {
+			return c.Next()
+		}
+
 		cookies := c.GetReqHeaders()["Cookie"]
 		if len(cookies) == 0 {
 			return c.Redirect(fmt.Sprintf("%sself-service/login/browser", a.OryBrowserBase), http.StatusSeeOther)
 		}
 
 		// check if we have a session
-		session, _, err := a.Ory.FrontendAPI.ToSession(c.Context()).Cookie(cookies[0]).Execute()
+		start := time.Now()
+		session, resp, err := a.Ory.FrontendAPI.ToSession(c.UserContext()).Cookie(cookies[0]).Execute()
+		metrics.ObserveKratosSession(time.Since(start), resp, err)
 		if (err != nil && session == nil) || (err == nil && !*session.Active) {
 			// this will redirect the user to the managed Ory Login UI
 			return c.Redirect(fmt.Sprintf("%sself-service/login/browser", a.OryBrowserBase), http.StatusSeeOther)
@@ -126,16 +188,43 @@ func (a *App) Prepare(app *fiber.App) {
 	})
 
 	a.Router.Get("/logout", func(c *fiber.Ctx) error {
-		cookie := c.Locals("cookies").(string)
-		req := a.Ory.FrontendAPI.CreateBrowserLogoutFlow(c.Context()).Cookie(cookie)
+		cookie, ok := c.Locals("cookies").(string)
+		if !ok {
+			return a.renderError(c, http.StatusBadRequest, "Could not log out", "You are signed in with a client certificate, which can't be logged out.")
+		}
+		req := a.Ory.FrontendAPI.CreateBrowserLogoutFlow(c.UserContext()).Cookie(cookie)
 		url, _, err := a.Ory.FrontendAPI.CreateBrowserLogoutFlowExecute(req)
 		if err != nil {
 			log.Errorf("Error creating logout flow: %s", err)
-			return c.SendStatus(http.StatusInternalServerError)
+			return a.renderError(c, http.StatusBadGateway, "Could not log out", "We couldn't reach the authentication service to log you out. Please try again in a moment.")
 		}
 
 		return c.Redirect(url.LogoutUrl, http.StatusSeeOther)
 	})
+
+	a.Router.Get("/settings", func(c *fiber.Ctx) error {
+		flowId := c.Query("flow")
+		if flowId == "" {
+			log.Info("No flow id, starting a new settings flow")
+			return a.restartFlow(c, "settings")
+		}
+
+		cookie, ok := c.Locals("cookies").(string)
+		if !ok {
+			return a.renderError(c, http.StatusBadRequest, "Settings unavailable", "You are signed in with a client certificate, which doesn't have account settings.")
+		}
+		req := a.Ory.FrontendAPI.GetSettingsFlow(c.UserContext()).Id(flowId).Cookie(cookie)
+		flow, resp, err := a.Ory.FrontendAPI.GetSettingsFlowExecute(req)
+		if err != nil {
+			return a.handleFlowError(c, "settings", resp, err)
+		}
+
+		return c.Render("public/auth/settings", fiber.Map{
+			"Flow":      flow,
+			"Groups":    GroupUiNodes(flow.Ui.Nodes),
+			"ReturnUrl": "/",
+		})
+	})
 }
 
 func getCookiesFromRequest(c *fiber.Ctx) (string, error) {
@@ -156,5 +245,7 @@ type DashboardData struct {
 
 type LoginData struct {
 	Flow        *ory.LoginFlow
+	Groups      []UiNodeGroup
 	RegisterUrl string
+	RecoveryUrl string
 }
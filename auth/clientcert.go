@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"net/http"
+	"os"
+)
+
+// ClientCertIdentity maps the subject of a verified client certificate to an identity, so that machine clients can use
+// the API without a Kratos session.
+type ClientCertIdentity struct {
+	// Subject is matched against the certificate subject in RFC 2253 form, for example "CN=backup-bot,O=Example"
+	Subject string                 `json:"subject"`
+	Id      string                 `json:"id"`
+	Traits  map[string]interface{} `json:"traits"`
+}
+
+// LoadClientCertIdentities reads a JSON array of ClientCertIdentity from the given path.
+func LoadClientCertIdentities(path string) ([]ClientCertIdentity, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client certificate identities file: %w", err)
+	}
+
+	var identities []ClientCertIdentity
+	if err := json.Unmarshal(content, &identities); err != nil {
+		return nil, fmt.Errorf("failed to parse client certificate identities file: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, identity := range identities {
+		if identity.Subject == "" || identity.Id == "" {
+			return nil, fmt.Errorf("client certificate identity must have a subject and an id")
+		}
+		if seen[identity.Subject] {
+			return nil, fmt.Errorf("duplicate client certificate subject %q", identity.Subject)
+		}
+		seen[identity.Subject] = true
+	}
+
+	return identities, nil
+}
+
+// ClientCertApp authenticates requests that present a verified client certificate. It must be prepared before the
+// Kratos or dev middleware, which then skip requests that already have a session.
+type ClientCertApp struct {
+	Identities []ClientCertIdentity
+	// Required, if set, rejects requests to its routes that aren't authenticated by a client certificate. It is matched
+	// by the router, so it follows the same case and trailing slash rules as the routes themselves.
+	Required fiber.Router
+}
+
+func (a *ClientCertApp) Prepare(app *fiber.App) {
+	app.Use(func(c *fiber.Ctx) error {
+		cert := verifiedClientCert(c)
+		if cert == nil {
+			return c.Next()
+		}
+
+		identity := a.findIdentity(cert.Subject.String())
+		if identity == nil {
+			log.Infof("No identity for client certificate subject: %s", cert.Subject.String())
+			return c.Next()
+		}
+
+		c.Locals("session", newLocalSession(fmt.Sprintf("cert-%s", identity.Id), identity.Id, identity.Traits))
+
+		return c.Next()
+	})
+
+	if a.Required != nil {
+		a.Required.Use(func(c *fiber.Ctx) error {
+			cert := verifiedClientCert(c)
+			if cert == nil {
+				return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "client certificate required"})
+			}
+			if a.findIdentity(cert.Subject.String()) == nil {
+				return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "unknown client certificate"})
+			}
+
+			return c.Next()
+		})
+	}
+}
+
+func (a *ClientCertApp) findIdentity(subject string) *ClientCertIdentity {
+	for i := range a.Identities {
+		if a.Identities[i].Subject == subject {
+			return &a.Identities[i]
+		}
+	}
+
+	return nil
+}
+
+// verifiedClientCert returns the leaf of the first verified client certificate chain, or nil if the request wasn't
+// made over TLS with a certificate that was verified against the client CAs.
+func verifiedClientCert(c *fiber.Ctx) *x509.Certificate {
+	state := c.Context().TLSConnectionState()
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return state.VerifiedChains[0][0]
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"github.com/EphyraSoftware/locus/internal/testcert"
+	"github.com/gofiber/fiber/v2"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+const testCertSubject = "CN=backup-bot,O=Example"
+
+// serveClientCert serves an app that authenticates with client certificates issued by the CA, and reports the session
+// id of each request. Returns the base URL of the server.
+func serveClientCert(t *testing.T, ca *testcert.CA, required bool) string {
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	clientCertApp := ClientCertApp{
+		Identities: []ClientCertIdentity{{
+			Subject: testCertSubject,
+			Id:      "backup-bot",
+			Traits:  map[string]interface{}{"email": "backup-bot@example.com"},
+		}},
+	}
+	if required {
+		clientCertApp.Required = app.Group("/coldmfa/api")
+	}
+	clientCertApp.Prepare(app)
+
+	sessionId := func(c *fiber.Ctx) error {
+		return c.SendString(SessionId(c))
+	}
+	app.Get("/coldmfa", sessionId)
+	app.Get("/coldmfa/api/groups", sessionId)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{ca.Server().Cert},
+		ClientCAs:    ca.Pool(),
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	go func() {
+		_ = app.Listener(tls.NewListener(ln, config))
+	}()
+	t.Cleanup(func() {
+		_ = app.Shutdown()
+	})
+
+	return "https://" + ln.Addr().String()
+}
+
+// get requests a URL, presenting the client certificate if one is given. Returns the status and the body.
+func get(t *testing.T, ca *testcert.CA, clientCert *testcert.Leaf, url string) (int, string) {
+	t.Helper()
+
+	config := &tls.Config{RootCAs: ca.Pool()}
+	if clientCert != nil {
+		config.Certificates = []tls.Certificate{clientCert.Cert}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestClientCertRequiredForEveryCase(t *testing.T) {
+	ca := testcert.NewCA(t, "Test CA")
+	url := serveClientCert(t, ca, true)
+
+	// Routes don't depend on case, so neither can the requirement
+	for _, path := range []string{"/coldmfa/api/groups", "/COLDMFA/api/groups", "/coldmfa/API/groups", "/coldmfa/api/groups/"} {
+		if status, _ := get(t, ca, nil, url+path); status != http.StatusUnauthorized {
+			t.Errorf("expected %s to require a client certificate, got %d", path, status)
+		}
+	}
+
+	cert := ca.Client(pkix.Name{CommonName: "backup-bot", Organization: []string{"Example"}})
+	if status, body := get(t, ca, &cert, url+"/COLDMFA/api/groups"); status != http.StatusOK || body != "backup-bot" {
+		t.Errorf("expected the client certificate to be accepted, got %d %q", status, body)
+	}
+}
+
+func TestClientCertIdentity(t *testing.T) {
+	ca := testcert.NewCA(t, "Test CA")
+	known := ca.Client(pkix.Name{CommonName: "backup-bot", Organization: []string{"Example"}})
+	unknown := ca.Client(pkix.Name{CommonName: "stranger", Organization: []string{"Example"}})
+
+	tests := []struct {
+		name     string
+		required bool
+		cert     *testcert.Leaf
+		path     string
+		status   int
+		session  string
+	}{
+		{name: "no certificate", cert: nil, path: "/coldmfa/api/groups", status: http.StatusOK},
+		{name: "unknown subject", cert: &unknown, path: "/coldmfa/api/groups", status: http.StatusOK},
+		{name: "known subject", cert: &known, path: "/coldmfa/api/groups", status: http.StatusOK, session: "backup-bot"},
+		{name: "no certificate when required", required: true, cert: nil, path: "/coldmfa/api/groups", status: http.StatusUnauthorized},
+		{name: "unknown subject when required", required: true, cert: &unknown, path: "/coldmfa/api/groups", status: http.StatusForbidden},
+		{name: "known subject when required", required: true, cert: &known, path: "/coldmfa/api/groups", status: http.StatusOK, session: "backup-bot"},
+		{name: "no certificate outside the API when required", required: true, cert: nil, path: "/coldmfa", status: http.StatusOK},
+		{name: "known subject outside the API", required: true, cert: &known, path: "/coldmfa", status: http.StatusOK, session: "backup-bot"},
+	}
+
+	urls := map[bool]string{false: serveClientCert(t, ca, false), true: serveClientCert(t, ca, true)}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := get(t, ca, test.cert, urls[test.required]+test.path)
+			if status != test.status {
+				t.Fatalf("expected %d, got %d", test.status, status)
+			}
+			if status == http.StatusOK && body != test.session {
+				t.Fatalf("expected session %q, got %q", test.session, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	ory "github.com/ory/client-go"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// DevUserHeader selects the identity to use for a single request when running in dev mode.
+	DevUserHeader = "X-Dev-User"
+
+	devUserCookie = "locus_dev_user"
+)
+
+// DevUser is an identity that can be used in place of a Kratos session when running in dev mode.
+type DevUser struct {
+	Id     string                 `json:"id"`
+	Traits map[string]interface{} `json:"traits"`
+}
+
+// Email returns the email trait of the user, or an empty string if it isn't set.
+func (u *DevUser) Email() string {
+	return traitsEmail(u.Traits)
+}
+
+// Username returns the username trait of the user, or an empty string if it isn't set.
+func (u *DevUser) Username() string {
+	name, ok := u.Traits["name"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	username, _ := name["username"].(string)
+	return username
+}
+
+// DefaultDevUsers is used when no dev users file is configured.
+var DefaultDevUsers = []DevUser{
+	{
+		Id: "tester",
+		Traits: map[string]interface{}{
+			"email": "tester@local.net",
+			"name": map[string]interface{}{
+				"username": "tester",
+			},
+		},
+	},
+}
+
+// LoadDevUsers reads a JSON array of DevUser from the given path.
+func LoadDevUsers(path string) ([]DevUser, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dev users file: %w", err)
+	}
+
+	var users []DevUser
+	if err := json.Unmarshal(content, &users); err != nil {
+		return nil, fmt.Errorf("failed to parse dev users file: %w", err)
+	}
+
+	if len(users) == 0 {
+		return nil, fmt.Errorf("no users defined in dev users file")
+	}
+
+	seen := make(map[string]bool)
+	for _, user := range users {
+		if user.Id == "" {
+			return nil, fmt.Errorf("dev user is missing an id")
+		}
+		if seen[user.Id] {
+			return nil, fmt.Errorf("duplicate dev user id %q", user.Id)
+		}
+		seen[user.Id] = true
+	}
+
+	return users, nil
+}
+
+// DevApp replaces the Kratos integration when running in dev mode. The identity for a request is taken from the
+// X-Dev-User header, then from the cookie set by the dev login page, and finally defaults to the first user.
+type DevApp struct {
+	Router fiber.Router
+	Users  []DevUser
+}
+
+func (a *DevApp) Prepare(app *fiber.App) {
+	a.Router.Get("/dev/login", func(c *fiber.Ctx) error {
+		current := ""
+		if user := a.findUser(c.Cookies(devUserCookie)); user != nil {
+			current = user.Id
+		}
+
+		return c.Render("public/auth/dev-login", fiber.Map{
+			"Users":   a.Users,
+			"Current": current,
+		})
+	})
+
+	a.Router.Post("/dev/login", func(c *fiber.Ctx) error {
+		user := a.findUser(c.FormValue("user"))
+		if user == nil {
+			log.Infof("Unknown dev user: %s", c.FormValue("user"))
+			return c.SendStatus(http.StatusBadRequest)
+		}
+
+		c.Cookie(&fiber.Cookie{
+			Name:     devUserCookie,
+			Value:    user.Id,
+			Path:     "/",
+			HTTPOnly: true,
+			SameSite: fiber.CookieSameSiteLaxMode,
+		})
+
+		return c.Redirect("/", http.StatusSeeOther)
+	})
+
+	app.Use(func(c *fiber.Ctx) error {
+		// Already authenticated, for example by a client certificate
+		if HasSession(c) {
+			return c.Next()
+		}
+
+		var user *DevUser
+		if selected := c.Get(DevUserHeader); selected != "" {
+			user = a.findUser(selected)
+			if user == nil {
+				log.Infof("Unknown dev user in %s header: %s", DevUserHeader, selected)
+				return c.SendStatus(http.StatusUnauthorized)
+			}
+		} else if selected := c.Cookies(devUserCookie); selected != "" {
+			user = a.findUser(selected)
+		}
+
+		if user == nil {
+			user = &a.Users[0]
+		}
+
+		c.Locals("session", user.session())
+
+		return c.Next()
+	})
+
+	a.Router.Get("/logout", func(c *fiber.Ctx) error {
+		c.ClearCookie(devUserCookie)
+		return c.Redirect("/auth/dev/login", http.StatusSeeOther)
+	})
+}
+
+// findUser looks up a dev user by either its id or its email address.
+func (a *DevApp) findUser(selected string) *DevUser {
+	if selected == "" {
+		return nil
+	}
+
+	for i := range a.Users {
+		if a.Users[i].Id == selected || strings.EqualFold(a.Users[i].Email(), selected) {
+			return &a.Users[i]
+		}
+	}
+
+	return nil
+}
+
+func (u *DevUser) session() *ory.Session {
+	return newLocalSession(fmt.Sprintf("dev-%s", u.Id), u.Id, u.Traits)
+}
+
+// newLocalSession builds an active session for an identity that has been authenticated by Locus itself rather than
+// by Kratos.
+func newLocalSession(sessionId string, identityId string, traits map[string]interface{}) *ory.Session {
+	now := time.Now()
+	active := true
+	state := "active"
+	aal := ory.AUTHENTICATORASSURANCELEVEL_AAL1
+
+	identity := ory.NewIdentity(identityId, "default", "", traits)
+	identity.State = &state
+	identity.CreatedAt = &now
+	if email := traitsEmail(traits); email != "" {
+		identity.VerifiableAddresses = []ory.VerifiableIdentityAddress{
+			{
+				Value:    email,
+				Verified: true,
+				Via:      "email",
+				Status:   "completed",
+			},
+		}
+	}
+
+	session := ory.NewSession(sessionId)
+	session.Active = &active
+	session.AuthenticatedAt = &now
+	session.IssuedAt = &now
+	session.AuthenticatorAssuranceLevel = &aal
+	session.Identity = identity
+
+	return session
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"net/http"
+)
+
+// ErrorPage is the data used to render public/auth/error.html
+type ErrorPage struct {
+	Status  int
+	Title   string
+	Message string
+	Reason  string
+	Id      string
+	HomeUrl string
+}
+
+// browserFlowUrl is where the browser should be sent to start a new self-service flow of the given type.
+func (a *App) browserFlowUrl(flowType string) string {
+	return fmt.Sprintf("%sself-service/%s/browser", a.OryBrowserBase, flowType)
+}
+
+// restartFlow sends the browser to Kratos to start a new flow, used when the flow in the request is missing, expired or
+// can't be used with the cookies we were sent.
+func (a *App) restartFlow(c *fiber.Ctx, flowType string) error {
+	return c.Redirect(a.browserFlowUrl(flowType), http.StatusSeeOther)
+}
+
+// handleFlowError decides what to do when Kratos refuses to return a self-service flow. Expired flows are restarted,
+// missing sessions are sent to login and everything else is shown to the user as an error page.
+func (a *App) handleFlowError(c *fiber.Ctx, flowType string, resp *http.Response, err error) error {
+	if resp != nil {
+		switch resp.StatusCode {
+		case http.StatusGone, http.StatusNotFound:
+			log.Infof("The %s flow has expired or does not exist, starting a new one", flowType)
+			return a.restartFlow(c, flowType)
+		case http.StatusForbidden:
+			if flowType != "settings" {
+				// Usually a CSRF violation, where the flow was started in another browser
+				log.Infof("The %s flow belongs to another browser, starting a new one", flowType)
+				return a.restartFlow(c, flowType)
+			}
+			log.Infof("The %s flow requires a privileged session, asking the user to log in again", flowType)
+			return c.Redirect(fmt.Sprintf("%s?refresh=true", a.browserFlowUrl("login")), http.StatusSeeOther)
+		case http.StatusUnauthorized:
+			log.Infof("The %s flow requires a session, sending the user to log in", flowType)
+			return a.restartFlow(c, "login")
+		}
+	}
+
+	log.Errorf("Error getting %s flow: %s", flowType, err)
+	return a.renderError(c, http.StatusBadGateway, "Something went wrong", "We couldn't reach the authentication service. Please try again in a moment.")
+}
+
+// renderError shows a friendly error page rather than an empty response.
+func (a *App) renderError(c *fiber.Ctx, status int, title string, message string) error {
+	return c.Status(status).Render("public/auth/error", ErrorPage{
+		Status:  status,
+		Title:   title,
+		Message: message,
+		HomeUrl: "/",
+	})
+}
+
+// flowErrorPage converts the error object returned by Kratos into the page shown to the user. Kratos documents the
+// error as a loosely typed object so each field is read defensively.
+func flowErrorPage(id string, detail map[string]interface{}) ErrorPage {
+	page := ErrorPage{
+		Status:  http.StatusInternalServerError,
+		Title:   "Something went wrong",
+		Message: "An error occurred while signing you in. Please try again.",
+		Id:      id,
+		HomeUrl: "/",
+	}
+
+	if code, ok := detail["code"].(float64); ok && code >= 400 && code < 600 {
+		page.Status = int(code)
+	}
+	if status, ok := detail["status"].(string); ok && status != "" {
+		page.Title = status
+	}
+	if message, ok := detail["message"].(string); ok && message != "" {
+		page.Message = message
+	}
+	if reason, ok := detail["reason"].(string); ok {
+		page.Reason = reason
+	}
+
+	return page
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	ory "github.com/ory/client-go"
+	"net/http"
+	"strings"
+)
+
+// KratosHealthCheck checks that Kratos reports itself as ready, using the admin or public API of the given client.
+func KratosHealthCheck(client *ory.APIClient) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		config := client.GetConfig()
+		readyUrl := strings.TrimSuffix(config.Servers[0].URL, "/") + "/health/ready"
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, readyUrl, nil)
+		if err != nil {
+			return err
+		}
+
+		httpClient := config.HTTPClient
+		if httpClient == nil {
+			httpClient = http.DefaultClient
+		}
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("kratos is not ready, status %d", resp.StatusCode)
+		}
+
+		return nil
+	}
+}
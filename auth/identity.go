@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	ory "github.com/ory/client-go"
+	"strings"
+)
+
+// ErrIdentityNotFound is returned by an IdentityResolver when no identity has the requested email address.
+var ErrIdentityNotFound = errors.New("identity not found")
+
+// Identity is the minimal view of a user needed to share resources with them.
+type Identity struct {
+	Id    string
+	Email string
+}
+
+// IdentityResolver finds users by their email address, so that other users can share resources with them without
+// needing to know their identity id.
+type IdentityResolver interface {
+	ResolveEmail(ctx context.Context, email string) (*Identity, error)
+}
+
+// KratosIdentityResolver looks up identities using the Kratos admin API.
+type KratosIdentityResolver struct {
+	OryAdmin *ory.APIClient
+}
+
+func (r *KratosIdentityResolver) ResolveEmail(ctx context.Context, email string) (*Identity, error) {
+	identities, _, err := r.OryAdmin.IdentityAPI.ListIdentities(ctx).CredentialsIdentifier(email).Execute()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list identities: %w", err)
+	}
+
+	for _, identity := range identities {
+		identityEmail := traitsEmail(identity.Traits)
+		if identityEmail != "" && strings.EqualFold(identityEmail, email) {
+			return &Identity{Id: identity.Id, Email: identityEmail}, nil
+		}
+	}
+
+	return nil, ErrIdentityNotFound
+}
+
+// ResolveEmail finds a dev user by email so that sharing can be tested without Kratos.
+func (a *DevApp) ResolveEmail(_ context.Context, email string) (*Identity, error) {
+	for _, user := range a.Users {
+		if user.Email() != "" && strings.EqualFold(user.Email(), email) {
+			return &Identity{Id: user.Id, Email: user.Email()}, nil
+		}
+	}
+
+	return nil, ErrIdentityNotFound
+}
+
+// SessionEmail returns the email trait of the current session, or an empty string if there is no session.
+func SessionEmail(c *fiber.Ctx) string {
+	session, ok := c.Locals("session").(*ory.Session)
+	if !ok || session == nil || session.Identity == nil {
+		return ""
+	}
+
+	return traitsEmail(session.Identity.Traits)
+}
+
+func traitsEmail(traits interface{}) string {
+	asMap, ok := traits.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	email, _ := asMap["email"].(string)
+	return email
+}
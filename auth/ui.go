@@ -0,0 +1,156 @@
+package auth
+
+import (
+	ory "github.com/ory/client-go"
+	"html/template"
+)
+
+// UiNodeGroup is a set of Kratos UI nodes which should be submitted together, such as all the nodes for the password
+// method. Kratos expects each method to be submitted as a separate form.
+type UiNodeGroup struct {
+	Name  string
+	Title string
+	Nodes []UiNodeView
+}
+
+// UiNodeView flattens a Kratos UI node into the fields needed to render it, so that templates don't have to check which
+// of the attribute variants is present.
+type UiNodeView struct {
+	Type     string
+	Group    string
+	Label    string
+	Messages []ory.UiText
+
+	// Fields for "input" nodes
+	Name         string
+	InputType    string
+	Value        interface{}
+	Disabled     bool
+	Required     bool
+	Autocomplete string
+	OnClick      template.JS
+
+	// Fields for "img", "a", "text" and "script" nodes
+	Id             string
+	Src            template.URL
+	Href           string
+	Text           string
+	Width          int64
+	Height         int64
+	ScriptType     string
+	Integrity      string
+	Crossorigin    string
+	Referrerpolicy string
+	Nonce          string
+	Async          bool
+}
+
+var groupTitles = map[string]string{
+	"profile":       "Profile",
+	"password":      "Password",
+	"oidc":          "Social sign in",
+	"link":          "Email link",
+	"code":          "Email code",
+	"totp":          "Authenticator app",
+	"lookup_secret": "Backup recovery codes",
+	"webauthn":      "Security keys",
+	"passkey":       "Passkeys",
+}
+
+// GroupUiNodes splits the nodes of a flow into one group per method, in the order the methods first appear. Nodes in
+// the "default" group, such as the CSRF token, are required by every method so they are included in every group.
+func GroupUiNodes(nodes []ory.UiNode) []UiNodeGroup {
+	var defaults []UiNodeView
+	var groups []UiNodeGroup
+	index := make(map[string]int)
+
+	for _, node := range nodes {
+		view := newUiNodeView(node)
+		if node.Group == "default" {
+			defaults = append(defaults, view)
+			continue
+		}
+
+		i, ok := index[node.Group]
+		if !ok {
+			title, ok := groupTitles[node.Group]
+			if !ok {
+				title = node.Group
+			}
+			groups = append(groups, UiNodeGroup{Name: node.Group, Title: title})
+			i = len(groups) - 1
+			index[node.Group] = i
+		}
+		groups[i].Nodes = append(groups[i].Nodes, view)
+	}
+
+	if len(groups) == 0 && len(defaults) > 0 {
+		return []UiNodeGroup{{Name: "default", Nodes: defaults}}
+	}
+
+	for i := range groups {
+		groups[i].Nodes = append(append([]UiNodeView{}, defaults...), groups[i].Nodes...)
+	}
+
+	return groups
+}
+
+func newUiNodeView(node ory.UiNode) UiNodeView {
+	view := UiNodeView{
+		Type:     node.Type,
+		Group:    node.Group,
+		Messages: node.Messages,
+	}
+	if node.Meta.Label != nil {
+		view.Label = node.Meta.Label.Text
+	}
+
+	attributes := node.Attributes
+	switch {
+	case attributes.UiNodeInputAttributes != nil:
+		input := attributes.UiNodeInputAttributes
+		view.Name = input.Name
+		view.InputType = input.Type
+		view.Value = input.Value
+		view.Disabled = input.Disabled
+		view.Required = input.Required != nil && *input.Required
+		if input.Autocomplete != nil {
+			view.Autocomplete = *input.Autocomplete
+		}
+		if input.Onclick != nil {
+			// Provided by Kratos to start WebAuthn ceremonies, so it is trusted to be rendered as script.
+			view.OnClick = template.JS(*input.Onclick)
+		}
+		if view.Label == "" && input.Label != nil {
+			view.Label = input.Label.Text
+		}
+	case attributes.UiNodeImageAttributes != nil:
+		image := attributes.UiNodeImageAttributes
+		view.Id = image.Id
+		// Kratos renders the TOTP QR code as a data URL which would otherwise be filtered out by the template engine.
+		view.Src = template.URL(image.Src)
+		view.Width = image.Width
+		view.Height = image.Height
+	case attributes.UiNodeAnchorAttributes != nil:
+		anchor := attributes.UiNodeAnchorAttributes
+		view.Id = anchor.Id
+		view.Href = anchor.Href
+		view.Text = anchor.Title.Text
+	case attributes.UiNodeTextAttributes != nil:
+		text := attributes.UiNodeTextAttributes
+		view.Id = text.Id
+		view.Text = text.Text.Text
+	case attributes.UiNodeScriptAttributes != nil:
+		script := attributes.UiNodeScriptAttributes
+		view.Id = script.Id
+		view.Src = template.URL(script.Src)
+		view.ScriptType = script.Type
+		view.Integrity = script.Integrity
+		view.Crossorigin = script.Crossorigin
+		view.Referrerpolicy = script.Referrerpolicy
+		view.Nonce = script.Nonce
+		view.Async = script.Async
+	}
+
+	return view
+}
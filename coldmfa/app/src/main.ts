@@ -6,7 +6,7 @@ import App from './App.vue'
 import axios from 'axios'
 
 const client = axios.create({
-  baseURL: import.meta.env.DEV ? 'http://127.0.0.1:3000/coldmfa' : import.meta.env.BASE_URL,
+  baseURL: import.meta.env.DEV ? 'http://localhost:3000/coldmfa' : import.meta.env.BASE_URL,
   headers: {
     'Content-Type': 'application/json',
     Accept: 'application/json'
@@ -62,7 +62,9 @@ const handlers = [
         codeId: nanoid(),
         name: new URL(r['original']).pathname.substring(1),
         createdAt: Math.round(new Date().valueOf() / 1000),
-        deleted: false
+        deleted: false,
+        favorite: false,
+        tags: [] as string[]
       }
 
       const groupId = params['groupId'] as string
@@ -2,6 +2,15 @@ export interface ApiError {
   error: string
 }
 
+export interface CodeLocation {
+  groupId: string
+  codeId: string
+}
+
+export interface DuplicateCodeError extends ApiError {
+  existing: CodeLocation
+}
+
 export interface UserName {
   username: string
 }
@@ -25,9 +34,17 @@ export interface CodeSummary {
   codeId: string
   name: string
   preferredName?: string
+  issuer?: string
+  account?: string
   createdAt: number
   deleted: boolean
   deletedAt?: number
+  favorite: boolean
+  accountEmail?: string
+  enrolledBy?: string
+  serviceUrl?: string
+  notes?: string
+  tags: string[]
 }
 
 export interface PasscodeResponse {
@@ -0,0 +1,292 @@
+package coldmfa
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/EphyraSoftware/locus/auth"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	AuditPasscodeGenerated = "passcode.generated"
+	AuditQrRevealed        = "code.qr_revealed"
+	AuditCodeCreated       = "code.created"
+	AuditCodeMoved         = "code.moved"
+	AuditCodeDeleted       = "code.deleted"
+	AuditCodeRestored      = "code.restored"
+	AuditBackupCreated     = "backup.created"
+	AuditBackupRestored    = "backup.restored"
+	AuditBackupRestoreFail = "backup.restore_failed"
+	AuditGrantCreated      = "grant.created"
+	AuditGrantRevoked      = "grant.revoked"
+	AuditMemberAdded       = "member.added"
+	AuditMemberRoleChanged = "member.role_changed"
+	AuditMemberRemoved     = "member.removed"
+)
+
+const (
+	// auditGenesisHash is the previous hash of the first event in every chain
+	auditGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 500
+	auditVerifyBatchSize = 1000
+
+	auditEventColumns = "id, owner_id, sequence, event_type, ip, user_agent, group_id, code_id, detail, created_at, prev_hash, hash"
+)
+
+// AuditEvent is a record of an identity accessing or changing something sensitive. Events for an owner form a hash
+// chain, so that removing or modifying an event can be detected by VerifyAuditLog.
+type AuditEvent struct {
+	Id        int64     `json:"id"`
+	OwnerId   string    `json:"ownerId"`
+	Sequence  int64     `json:"sequence"`
+	EventType string    `json:"eventType"`
+	Ip        *string   `json:"ip"`
+	UserAgent *string   `json:"userAgent"`
+	GroupId   *string   `json:"groupId"`
+	CodeId    *string   `json:"codeId"`
+	Detail    *string   `json:"detail"`
+	CreatedAt time.Time `json:"createdAt"`
+	PrevHash  string    `json:"prevHash"`
+	Hash      string    `json:"hash"`
+}
+
+// computeHash hashes every field of the event except the hash itself and the database id. The field order is fixed by
+// the struct so the encoding is stable.
+func (e *AuditEvent) computeHash() (string, error) {
+	content, err := json.Marshal(struct {
+		PrevHash  string  `json:"prevHash"`
+		OwnerId   string  `json:"ownerId"`
+		Sequence  int64   `json:"sequence"`
+		EventType string  `json:"eventType"`
+		Ip        *string `json:"ip"`
+		UserAgent *string `json:"userAgent"`
+		GroupId   *string `json:"groupId"`
+		CodeId    *string `json:"codeId"`
+		Detail    *string `json:"detail"`
+		CreatedAt string  `json:"createdAt"`
+	}{
+		PrevHash:  e.PrevHash,
+		OwnerId:   e.OwnerId,
+		Sequence:  e.Sequence,
+		EventType: e.EventType,
+		Ip:        e.Ip,
+		UserAgent: e.UserAgent,
+		GroupId:   e.GroupId,
+		CodeId:    e.CodeId,
+		Detail:    e.Detail,
+		CreatedAt: e.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// newAuditEvent prepares an event for the current request, which can then be appended to its owner's chain.
+func newAuditEvent(c *fiber.Ctx, eventType string, groupId string, codeId string, detail map[string]interface{}) (*AuditEvent, error) {
+	event := &AuditEvent{
+		OwnerId:   auth.SessionId(c),
+		EventType: eventType,
+		Ip:        nullableString(c.IP()),
+		UserAgent: nullableString(c.Get(fiber.HeaderUserAgent)),
+		GroupId:   nullableString(groupId),
+		CodeId:    nullableString(codeId),
+	}
+
+	if len(detail) > 0 {
+		content, err := json.Marshal(detail)
+		if err != nil {
+			return nil, err
+		}
+		event.Detail = nullableString(string(content))
+	}
+
+	return event, nil
+}
+
+// audit records an event for the current request. Access to secrets must not proceed if this fails, so that every
+// access is accounted for.
+func audit(c *fiber.Ctx, store Store, eventType string, groupId string, codeId string, detail map[string]interface{}) error {
+	event, err := newAuditEvent(c, eventType, groupId, codeId, detail)
+	if err != nil {
+		return err
+	}
+
+	return store.AppendAuditEvent(c.UserContext(), event)
+}
+
+// AuditChainBreak describes a point at which an owner's audit chain is not consistent.
+type AuditChainBreak struct {
+	OwnerId  string
+	Sequence int64
+	Reason   string
+}
+
+func (b AuditChainBreak) String() string {
+	return fmt.Sprintf("owner %s, sequence %d: %s", b.OwnerId, b.Sequence, b.Reason)
+}
+
+// auditChainVerifier checks the events of a single owner's chain, which must be provided in sequence order.
+type auditChainVerifier struct {
+	ownerId      string
+	lastSequence int64
+	lastHash     string
+	breaks       []AuditChainBreak
+}
+
+func newAuditChainVerifier(ownerId string) *auditChainVerifier {
+	return &auditChainVerifier{
+		ownerId:  ownerId,
+		lastHash: auditGenesisHash,
+	}
+}
+
+func (v *auditChainVerifier) add(event *AuditEvent) {
+	fail := func(reason string) {
+		v.breaks = append(v.breaks, AuditChainBreak{OwnerId: v.ownerId, Sequence: event.Sequence, Reason: reason})
+	}
+
+	if event.Sequence != v.lastSequence+1 {
+		fail(fmt.Sprintf("expected sequence %d, events may have been removed", v.lastSequence+1))
+	}
+
+	if event.PrevHash != v.lastHash {
+		fail("previous hash does not match the previous event")
+	}
+
+	hash, err := event.computeHash()
+	if err != nil {
+		fail(fmt.Sprintf("failed to hash event: %s", err.Error()))
+	} else if hash != event.Hash {
+		fail("hash does not match the event content, the event may have been modified")
+	}
+
+	v.lastSequence = event.Sequence
+	v.lastHash = event.Hash
+}
+
+// VerifyAuditLog walks the audit chain of every owner and reports every point where the chain is broken.
+func VerifyAuditLog(context context.Context, store Store) ([]AuditChainBreak, error) {
+	breaks := make([]AuditChainBreak, 0)
+
+	var verifier *auditChainVerifier
+	lastOwnerId := ""
+	lastSequence := int64(0)
+	for {
+		events, err := store.ListAuditEventsAfter(context, lastOwnerId, lastSequence, auditVerifyBatchSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query audit events: %w", err)
+		}
+
+		for i := range events {
+			event := &events[i]
+			if verifier == nil || verifier.ownerId != event.OwnerId {
+				if verifier != nil {
+					breaks = append(breaks, verifier.breaks...)
+				}
+				verifier = newAuditChainVerifier(event.OwnerId)
+			}
+			verifier.add(event)
+
+			lastOwnerId = event.OwnerId
+			lastSequence = event.Sequence
+		}
+
+		if len(events) < auditVerifyBatchSize {
+			break
+		}
+	}
+
+	if verifier != nil {
+		breaks = append(breaks, verifier.breaks...)
+	}
+
+	return breaks, nil
+}
+
+func (a *App) prepareAudit(api fiber.Router, store Store) {
+	api.Get("/audit", func(c *fiber.Ctx) error {
+		sessionId := auth.SessionId(c)
+		if sessionId == "" {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		limit, before, err := auditPage(c)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: err.Error()})
+		}
+
+		events, err := store.ListAuditEvents(c.UserContext(), sessionId, before, limit)
+		if err != nil {
+			log.Errorf("failed to query audit events: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+
+		return c.Status(http.StatusOK).JSON(events)
+	})
+
+	api.Get("/groups/:groupId/audit", func(c *fiber.Ctx) error {
+		sessionId := auth.SessionId(c)
+		if sessionId == "" {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		groupId := c.Params("groupId")
+		if groupId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing groupId"})
+		}
+
+		limit, before, err := auditPage(c)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: err.Error()})
+		}
+
+		member, err := requireRole(c, store, sessionId, groupId, RoleOwner)
+		if member == nil {
+			return err
+		}
+
+		// Includes events from the chains of every member who has accessed the group
+		events, err := store.ListGroupAuditEvents(c.UserContext(), groupId, before, limit)
+		if err != nil {
+			log.Errorf("failed to query audit events: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+
+		return c.Status(http.StatusOK).JSON(events)
+	})
+}
+
+// auditPage reads the page size and the event id to page backwards from, exclusive.
+func auditPage(c *fiber.Ctx) (int, int64, error) {
+	limit := defaultAuditPageSize
+	if raw := c.Query("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 || parsed > maxAuditPageSize {
+			return 0, 0, fmt.Errorf("invalid limit")
+		}
+		limit = parsed
+	}
+
+	before := int64(1<<63 - 1)
+	if raw := c.Query("before"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || parsed < 1 {
+			return 0, 0, fmt.Errorf("invalid before")
+		}
+		before = parsed
+	}
+
+	return limit, before, nil
+}
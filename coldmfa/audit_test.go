@@ -0,0 +1,185 @@
+package coldmfa
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func buildAuditChain(t *testing.T, ownerId string, length int) []*AuditEvent {
+	events := make([]*AuditEvent, 0, length)
+	prevHash := auditGenesisHash
+	for i := 1; i <= length; i++ {
+		event := &AuditEvent{
+			OwnerId:   ownerId,
+			Sequence:  int64(i),
+			EventType: AuditPasscodeGenerated,
+			GroupId:   nullableString("group-a"),
+			CodeId:    nullableString("code-a"),
+			CreatedAt: time.Date(2024, 1, 1, 0, 0, i, 1000, time.UTC),
+			PrevHash:  prevHash,
+		}
+
+		hash, err := event.computeHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		event.Hash = hash
+		prevHash = hash
+
+		events = append(events, event)
+	}
+
+	return events
+}
+
+func verifyAuditChain(events []*AuditEvent) []AuditChainBreak {
+	verifier := newAuditChainVerifier(events[0].OwnerId)
+	for _, event := range events {
+		verifier.add(event)
+	}
+	return verifier.breaks
+}
+
+func TestAuditChainValid(t *testing.T) {
+	events := buildAuditChain(t, "tester", 5)
+
+	breaks := verifyAuditChain(events)
+	if len(breaks) != 0 {
+		t.Fatalf("expected no breaks, got %v", breaks)
+	}
+}
+
+func TestAuditChainModifiedEvent(t *testing.T) {
+	events := buildAuditChain(t, "tester", 5)
+	events[2].CodeId = nullableString("code-b")
+
+	breaks := verifyAuditChain(events)
+	if len(breaks) != 1 || breaks[0].Sequence != 3 {
+		t.Fatalf("expected a break at sequence 3, got %v", breaks)
+	}
+}
+
+func TestAuditChainRemovedEvent(t *testing.T) {
+	events := buildAuditChain(t, "tester", 5)
+	events = append(events[:2], events[3:]...)
+
+	breaks := verifyAuditChain(events)
+	if len(breaks) != 2 || breaks[0].Sequence != 4 || breaks[1].Sequence != 4 {
+		t.Fatalf("expected sequence and hash breaks at sequence 4, got %v", breaks)
+	}
+}
+
+func TestAuditChainRehashedEvent(t *testing.T) {
+	events := buildAuditChain(t, "tester", 5)
+
+	// Rewriting an event and its hash is still detected by the next event in the chain
+	events[1].EventType = AuditQrRevealed
+	hash, err := events[1].computeHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events[1].Hash = hash
+
+	breaks := verifyAuditChain(events)
+	if len(breaks) != 1 || breaks[0].Sequence != 3 {
+		t.Fatalf("expected a break at sequence 3, got %v", breaks)
+	}
+}
+
+func TestAuditRoutes(t *testing.T) {
+	app := newTestApp(t)
+	group := app.createGroup("alice", "Personal")
+	code := app.createCode("alice", group.GroupId, testOriginal)
+	app.expect(http.StatusCreated, "alice", http.MethodPost, "/groups/"+group.GroupId+"/members", InviteMemberRequest{Email: "bob@example.com", Role: RoleViewer}, nil)
+
+	var passcode CodeSummary
+	for _, user := range []string{"alice", "bob", "alice"} {
+		app.expect(http.StatusOK, user, http.MethodGet, "/groups/"+group.GroupId+"/codes/"+code.CodeId, nil, &passcode)
+	}
+
+	var events []AuditEvent
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/audit", nil, &events)
+	if len(events) != 4 || events[0].EventType != AuditPasscodeGenerated || events[0].Sequence != 4 || events[3].EventType != AuditCodeCreated {
+		t.Fatalf("expected alice's events newest first, got %+v", events)
+	}
+
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/audit?limit=1&before="+strconv.FormatInt(events[0].Id, 10), nil, &events)
+	if len(events) != 1 || events[0].Sequence != 3 {
+		t.Fatalf("expected the second page to start at sequence 3, got %+v", events)
+	}
+	app.expect(http.StatusBadRequest, "alice", http.MethodGet, "/audit?limit=-1", nil, nil)
+
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/groups/"+group.GroupId+"/audit", nil, &events)
+	if len(events) != 5 {
+		t.Fatalf("expected the group's events from every member, got %+v", events)
+	}
+	app.expect(http.StatusForbidden, "bob", http.MethodGet, "/groups/"+group.GroupId+"/audit", nil, nil)
+
+	breaks, err := VerifyAuditLog(context.Background(), app.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(breaks) != 0 {
+		t.Fatalf("expected no breaks, got %v", breaks)
+	}
+}
+
+func TestAuditCodeChanges(t *testing.T) {
+	forEachStore(t, testAuditCodeChanges)
+}
+
+func auditEventTypes(events []AuditEvent) []string {
+	eventTypes := make([]string, 0, len(events))
+	for _, event := range events {
+		eventTypes = append(eventTypes, event.EventType)
+	}
+	return eventTypes
+}
+
+func testAuditCodeChanges(t *testing.T, app *testApp) {
+	personal := app.createGroup("alice", "personal")
+	shared := app.createGroup("alice", "shared")
+	app.expect(http.StatusCreated, "alice", http.MethodPost, "/groups/"+shared.GroupId+"/members", InviteMemberRequest{Email: "bob@example.com", Role: RoleViewer}, nil)
+	code := app.createCode("alice", personal.GroupId, testOriginal)
+	other := app.createCode("alice", personal.GroupId, testOtherOriginal)
+
+	// Moving a code into a group with other members is recorded against that group
+	app.expect(http.StatusNoContent, "alice", http.MethodPost, "/groups/"+personal.GroupId+"/codes/"+code.CodeId+"/move", MoveCodeRequest{ToGroupId: shared.GroupId}, nil)
+	var events []AuditEvent
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/groups/"+shared.GroupId+"/audit", nil, &events)
+	if len(events) != 2 || events[0].EventType != AuditCodeMoved || *events[0].CodeId != code.CodeId || *events[0].Detail != `{"fromGroupId":"`+personal.GroupId+`"}` {
+		t.Fatalf("expected the move in the shared group's events, got %+v", events)
+	}
+
+	// A batch that isn't applied records nothing, and a best effort batch only records the operations that were applied
+	failed := []CodeOperation{
+		{Op: CodeOpDelete, GroupId: shared.GroupId, CodeId: code.CodeId},
+		{Op: CodeOpDelete, GroupId: shared.GroupId, CodeId: "missing"},
+	}
+	app.expectBatch("alice", CodeBatchRequest{Operations: failed}, 0, http.StatusFailedDependency, http.StatusNotFound)
+	app.expectBatch("alice", CodeBatchRequest{Operations: failed, BestEffort: true}, 1, http.StatusNoContent, http.StatusNotFound)
+	app.expectBatch("alice", CodeBatchRequest{Operations: []CodeOperation{
+		{Op: CodeOpRestore, GroupId: shared.GroupId, CodeId: code.CodeId},
+		{Op: CodeOpRename, GroupId: shared.GroupId, CodeId: code.CodeId, PreferredName: stringPtr("Renamed")},
+		{Op: CodeOpMove, GroupId: personal.GroupId, CodeId: other.CodeId, ToGroupId: shared.GroupId},
+	}}, 3, http.StatusNoContent, http.StatusNoContent, http.StatusNoContent)
+	app.expect(http.StatusNoContent, "alice", http.MethodDelete, "/groups/"+shared.GroupId+"/codes/"+other.CodeId, nil, nil)
+
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/audit", nil, &events)
+	expected := []string{AuditCodeDeleted, AuditCodeMoved, AuditCodeRestored, AuditCodeDeleted, AuditCodeMoved, AuditCodeCreated, AuditCodeCreated, AuditMemberAdded}
+	if eventTypes := auditEventTypes(events); !slices.Equal(eventTypes, expected) {
+		t.Fatalf("expected %v, got %v", expected, eventTypes)
+	}
+
+	breaks, err := VerifyAuditLog(context.Background(), app.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(breaks) != 0 {
+		t.Fatalf("expected no breaks, got %v", breaks)
+	}
+}
@@ -0,0 +1,184 @@
+package coldmfa
+
+import (
+	"errors"
+	"github.com/EphyraSoftware/locus/auth"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"net/http"
+)
+
+type CodeOp string
+
+const (
+	CodeOpMove    CodeOp = "move"
+	CodeOpRename  CodeOp = "rename"
+	CodeOpDelete  CodeOp = "delete"
+	CodeOpRestore CodeOp = "restore"
+)
+
+// maxCodeOperations limits the size of a batch, which is applied in a single transaction
+const maxCodeOperations = 100
+
+func (a *App) prepareBatch(api fiber.Router, store Store) {
+	api.Post("/codes/batch", func(c *fiber.Ctx) error {
+		sessionId := auth.SessionId(c)
+		if sessionId == "" {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		batchRequest := new(CodeBatchRequest)
+		if err := c.BodyParser(batchRequest); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid request"})
+		}
+
+		if len(batchRequest.Operations) == 0 {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing operations"})
+		}
+		if len(batchRequest.Operations) > maxCodeOperations {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "too many operations"})
+		}
+
+		// Operations are checked before any are applied, so that an invalid or forbidden operation fails without
+		// touching the database, and each group is only checked once
+		results := make([]CodeOperationResult, len(batchRequest.Operations))
+		checked := make(map[string]*operationError)
+		operations := make([]CodeOperation, 0, len(batchRequest.Operations))
+		indexes := make([]int, 0, len(batchRequest.Operations))
+		for i, operation := range batchRequest.Operations {
+			if operationErr := checkCodeOperation(c, store, sessionId, &operation, checked); operationErr != nil {
+				results[i] = operationErr.result()
+				continue
+			}
+			operations = append(operations, operation)
+			indexes = append(indexes, i)
+		}
+
+		failed := len(operations) < len(batchRequest.Operations)
+		if failed && !batchRequest.BestEffort {
+			operations = nil
+		}
+
+		if len(operations) > 0 {
+			events := make([]*AuditEvent, len(operations))
+			for i, operation := range operations {
+				var err error
+				events[i], err = codeOperationEvent(c, operation)
+				if err != nil {
+					log.Errorf("failed to prepare audit event: %s", err.Error())
+					return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+				}
+			}
+
+			operationErrs, err := store.ApplyCodeOperations(c.UserContext(), sessionId, operations, events, batchRequest.BestEffort)
+			if err != nil {
+				log.Errorf("failed to apply code operations: %s", err.Error())
+				return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+			}
+
+			for i, operationErr := range operationErrs {
+				results[indexes[i]] = codeOperationResult(operations[i], operationErr)
+				if operationErr != nil {
+					failed = true
+				}
+			}
+		}
+
+		// Without best effort a failure means that nothing was applied, including the operations that succeeded, and
+		// operations that weren't tried have no result yet
+		notApplied := operationError{status: http.StatusFailedDependency, message: "not applied because another operation failed"}
+		applied := 0
+		for i := range results {
+			switch {
+			case results[i].Status == 0, results[i].Status == http.StatusNoContent && failed && !batchRequest.BestEffort:
+				results[i] = notApplied.result()
+			case results[i].Status == http.StatusNoContent:
+				applied++
+			}
+		}
+
+		return c.Status(http.StatusOK).JSON(CodeBatchResponse{Applied: applied, Results: results})
+	})
+}
+
+type operationError struct {
+	status  int
+	message string
+}
+
+func (e operationError) result() CodeOperationResult {
+	return CodeOperationResult{Status: e.status, Error: &e.message}
+}
+
+// checkCodeOperation validates an operation and checks that the identity can edit the groups that it changes,
+// normalizing the preferred name of a rename. Role checks are cached by group id in checked.
+func checkCodeOperation(c *fiber.Ctx, store Store, memberId string, operation *CodeOperation, checked map[string]*operationError) *operationError {
+	if operation.GroupId == "" {
+		return &operationError{status: http.StatusBadRequest, message: "missing groupId"}
+	}
+	if operation.CodeId == "" {
+		return &operationError{status: http.StatusBadRequest, message: "missing codeId"}
+	}
+
+	groupIds := []string{operation.GroupId}
+	switch operation.Op {
+	case CodeOpMove:
+		if operation.ToGroupId == "" {
+			return &operationError{status: http.StatusBadRequest, message: "missing toGroupId"}
+		}
+		groupIds = append(groupIds, operation.ToGroupId)
+	case CodeOpRename:
+		operation.PreferredName = trimField(operation.PreferredName)
+	case CodeOpDelete, CodeOpRestore:
+	default:
+		return &operationError{status: http.StatusBadRequest, message: "unknown op"}
+	}
+
+	for _, groupId := range groupIds {
+		operationErr, ok := checked[groupId]
+		if !ok {
+			_, status, apiErr := checkRole(c.UserContext(), store, memberId, groupId, RoleEditor)
+			if apiErr != nil {
+				operationErr = &operationError{status: status, message: apiErr.Error}
+			}
+			checked[groupId] = operationErr
+		}
+		if operationErr != nil {
+			return operationErr
+		}
+	}
+
+	return nil
+}
+
+// codeOperationEvent prepares the audit event for an operation, which is the same as for the single code endpoints. A
+// move is recorded against the group that the code was moved into, because that is who can now read it. Renames aren't
+// audited, like other edits to a code.
+func codeOperationEvent(c *fiber.Ctx, operation CodeOperation) (*AuditEvent, error) {
+	switch operation.Op {
+	case CodeOpMove:
+		return newAuditEvent(c, AuditCodeMoved, operation.ToGroupId, operation.CodeId, map[string]interface{}{"fromGroupId": operation.GroupId})
+	case CodeOpDelete:
+		return newAuditEvent(c, AuditCodeDeleted, operation.GroupId, operation.CodeId, nil)
+	case CodeOpRestore:
+		return newAuditEvent(c, AuditCodeRestored, operation.GroupId, operation.CodeId, nil)
+	default:
+		return nil, nil
+	}
+}
+
+// codeOperationResult converts the store's result for an operation to the response of the single code endpoints.
+func codeOperationResult(operation CodeOperation, err error) CodeOperationResult {
+	switch {
+	case err == nil:
+		return CodeOperationResult{Status: http.StatusNoContent}
+	case errors.Is(err, ErrNotFound) && operation.Op == CodeOpMove:
+		return operationError{status: http.StatusNotFound, message: "code or target group not found"}.result()
+	case errors.Is(err, ErrNotFound):
+		return operationError{status: http.StatusNotFound, message: "code not found"}.result()
+	case errors.Is(err, ErrAlreadyExists) && operation.Op == CodeOpRename:
+		return operationError{status: http.StatusConflict, message: "preferred name already in use"}.result()
+	default:
+		return operationError{status: http.StatusConflict, message: "code already exists"}.result()
+	}
+}
@@ -0,0 +1,113 @@
+package coldmfa
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCodeBatch(t *testing.T) {
+	forEachStore(t, testCodeBatch)
+}
+
+// expectBatch applies a batch, checking how many operations were applied and the status of each operation.
+func (a *testApp) expectBatch(user string, request CodeBatchRequest, applied int, statuses ...int) {
+	a.t.Helper()
+
+	var response CodeBatchResponse
+	a.expect(http.StatusOK, user, http.MethodPost, "/codes/batch", request, &response)
+	if len(response.Results) != len(request.Operations) {
+		a.t.Fatalf("expected a result for each of the %d operations, got %+v", len(request.Operations), response.Results)
+	}
+
+	if response.Applied != applied {
+		a.t.Errorf("expected %d operations to be applied, got %d", applied, response.Applied)
+	}
+	for i, status := range statuses {
+		result := response.Results[i]
+		if result.Status != status || (status == http.StatusNoContent) != (result.Error == nil) {
+			a.t.Errorf("expected operation %d to return %d, got %+v", i, status, result)
+		}
+	}
+}
+
+func testCodeBatch(t *testing.T, app *testApp) {
+	personal := app.createGroup("alice", "personal")
+	work := app.createGroup("alice", "work")
+	codeA := app.createCode("alice", personal.GroupId, testOriginal)
+	codeB := app.createCode("alice", personal.GroupId, testOtherOriginal)
+	thirdOriginal := "otpauth://totp/Third:alice@example.com?secret=MFRGGZDFMZTWQ2LK&issuer=Third"
+	codeC := app.createCode("alice", personal.GroupId, thirdOriginal)
+	app.expect(http.StatusCreated, "alice", http.MethodPost, "/groups/"+work.GroupId+"/members", InviteMemberRequest{Email: "carol@example.com", Role: RoleViewer}, nil)
+
+	app.expect(http.StatusBadRequest, "alice", http.MethodPost, "/codes/batch", CodeBatchRequest{}, nil)
+	app.expect(http.StatusBadRequest, "alice", http.MethodPost, "/codes/batch", CodeBatchRequest{Operations: make([]CodeOperation, maxCodeOperations+1)}, nil)
+
+	moves := []CodeOperation{
+		{Op: CodeOpMove, GroupId: personal.GroupId, CodeId: codeA.CodeId, ToGroupId: work.GroupId},
+		{Op: CodeOpMove, GroupId: personal.GroupId, CodeId: codeB.CodeId, ToGroupId: work.GroupId},
+		{Op: CodeOpMove, GroupId: personal.GroupId, CodeId: "missing", ToGroupId: work.GroupId},
+	}
+
+	// Without best effort, one failed operation means that none are applied
+	app.expectBatch("alice", CodeBatchRequest{Operations: moves}, 0, http.StatusFailedDependency, http.StatusFailedDependency, http.StatusNotFound)
+	if codes := app.groupCodes("alice", personal.GroupId); len(codes) != 3 {
+		t.Fatalf("expected the codes not to be moved, got %+v", codes)
+	}
+
+	app.expectBatch("alice", CodeBatchRequest{Operations: moves, BestEffort: true}, 2, http.StatusNoContent, http.StatusNoContent, http.StatusNotFound)
+	if codes := app.groupCodes("alice", work.GroupId); len(codes) != 2 {
+		t.Fatalf("expected two codes to be moved, got %+v", codes)
+	}
+
+	// A rename that fails in the store rolls back the renames before it
+	shared := "Shared"
+	renames := []CodeOperation{
+		{Op: CodeOpRename, GroupId: work.GroupId, CodeId: codeA.CodeId, PreferredName: &shared},
+		{Op: CodeOpRename, GroupId: work.GroupId, CodeId: codeB.CodeId, PreferredName: &shared},
+	}
+	app.expectBatch("alice", CodeBatchRequest{Operations: renames}, 0, http.StatusFailedDependency, http.StatusConflict)
+	if code := app.groupCodes("alice", work.GroupId)[codeA.CodeId]; code.PreferredName != nil {
+		t.Fatalf("expected the rename to be rolled back, got %q", *code.PreferredName)
+	}
+
+	app.expectBatch("alice", CodeBatchRequest{Operations: renames, BestEffort: true}, 1, http.StatusNoContent, http.StatusConflict)
+	if code := app.groupCodes("alice", work.GroupId)[codeA.CodeId]; code.PreferredName == nil || *code.PreferredName != shared {
+		t.Fatalf("expected the code to be renamed, got %+v", code)
+	}
+
+	// Operations are checked before they are applied
+	forbidden := []CodeOperation{
+		{Op: CodeOpDelete, GroupId: work.GroupId, CodeId: codeA.CodeId},
+		{Op: CodeOpMove, GroupId: personal.GroupId, CodeId: codeC.CodeId, ToGroupId: work.GroupId},
+	}
+	app.expectBatch("carol", CodeBatchRequest{Operations: forbidden, BestEffort: true}, 0, http.StatusForbidden, http.StatusNotFound)
+	app.expectBatch("alice", CodeBatchRequest{Operations: []CodeOperation{
+		{Op: "archive", GroupId: work.GroupId, CodeId: codeA.CodeId},
+		{Op: CodeOpMove, GroupId: work.GroupId, CodeId: codeA.CodeId},
+		{Op: CodeOpDelete, GroupId: work.GroupId},
+		{Op: CodeOpDelete, GroupId: work.GroupId, CodeId: codeA.CodeId},
+	}}, 0, http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest, http.StatusFailedDependency)
+
+	app.expectBatch("alice", CodeBatchRequest{Operations: []CodeOperation{
+		{Op: CodeOpDelete, GroupId: work.GroupId, CodeId: codeA.CodeId},
+		{Op: CodeOpDelete, GroupId: personal.GroupId, CodeId: codeC.CodeId},
+	}}, 2, http.StatusNoContent, http.StatusNoContent)
+	if code := app.groupCodes("alice", work.GroupId)[codeA.CodeId]; !code.Deleted {
+		t.Fatalf("expected the code to be deleted, got %+v", code)
+	}
+
+	// A deleted code can't be restored if the same code has been added again
+	app.createCode("alice", work.GroupId, thirdOriginal)
+	restores := []CodeOperation{
+		{Op: CodeOpRestore, GroupId: work.GroupId, CodeId: codeA.CodeId},
+		{Op: CodeOpRestore, GroupId: work.GroupId, CodeId: codeB.CodeId},
+		{Op: CodeOpRestore, GroupId: personal.GroupId, CodeId: codeC.CodeId},
+	}
+	app.expectBatch("alice", CodeBatchRequest{Operations: restores, BestEffort: true}, 1, http.StatusNoContent, http.StatusNotFound, http.StatusConflict)
+	if code := app.groupCodes("alice", work.GroupId)[codeA.CodeId]; code.Deleted || code.DeletedAt != nil {
+		t.Fatalf("expected the code to be restored, got %+v", code)
+	}
+	if code := app.groupCodes("alice", personal.GroupId)[codeC.CodeId]; !code.Deleted {
+		t.Fatalf("expected the duplicate code to stay deleted, got %+v", code)
+	}
+}
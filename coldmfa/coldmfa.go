@@ -5,52 +5,86 @@ import (
 	"database/sql"
 	"embed"
 	"errors"
-	"fmt"
 	"github.com/EphyraSoftware/locus/auth"
+	"github.com/EphyraSoftware/locus/metrics"
+	"github.com/EphyraSoftware/locus/ratelimit"
+	"github.com/EphyraSoftware/locus/tracing"
 	"github.com/goccy/go-json"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/log"
 	"github.com/gofiber/fiber/v2/middleware/filesystem"
-	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/source/iofs"
 	gonanoid "github.com/matoous/go-nanoid/v2"
-	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"image/jpeg"
 	"io"
 	"net/http"
-	"net/url"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 )
 
-//go:embed migrations/*
-var migrations embed.FS
-
 type App struct {
-	Router      fiber.Router
+	Router fiber.Router
+	// Store is optional, if it isn't set then a store is opened using DatabaseUrl and migrated
+	Store       Store
 	DatabaseUrl string
 	Public      embed.FS
+	Identities  auth.IdentityResolver
+	// Metrics is optional, if set then database and backup metrics are registered with it
+	Metrics prometheus.Registerer
+	// SkipMigrations disables migrating the database on startup, for deployments that migrate as a separate step
+	SkipMigrations bool
+	// RateLimits is optional, if set then passcode and backup endpoints are rate limited
+	RateLimits *RateLimits
+
+	// db is only set when the app opened its own store
+	db             *sql.DB
+	rateLimitStore ratelimit.Store
+	// stopBackground cancels background jobs, which are tracked by background so that Close can wait for them
+	stopBackground context.CancelFunc
+	background     sync.WaitGroup
+	// started is closed once the database has been migrated and codes normalized, until then the API is unavailable
+	started chan struct{}
+	// fingerprintHmacKey is read from the store by fingerprintKey when it's first needed
+	fingerprintMu      sync.Mutex
+	fingerprintHmacKey []byte
 }
 
 func (a *App) Prepare() {
-	source, err := iofs.New(migrations, "migrations")
-	if err != nil {
-		log.Fatalf("failed to prepare migration source: %s", err.Error())
-	}
-	m, err := migrate.NewWithSourceInstance("io/fs", source, a.DatabaseUrl)
-	if err != nil {
-		log.Fatalf("failed to configure migration: %s", err.Error())
-	}
-	err = m.Migrate(1)
-	if err != nil && err.Error() != "no change" {
-		log.Fatalf("failed to run migration: %s", err.Error())
+	var backgroundCtx context.Context
+	backgroundCtx, a.stopBackground = context.WithCancel(context.Background())
+	a.started = make(chan struct{})
+
+	if a.Store == nil {
+		store, db, err := OpenStore(a.DatabaseUrl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.db = db
+		a.Store = store
+
+		if a.SkipMigrations {
+			log.Info("Skipping database migrations on startup")
+		}
+		a.background.Add(1)
+		go func() {
+			defer a.background.Done()
+			a.runStartup(backgroundCtx)
+		}()
+	} else {
+		// The store was provided rather than opened by the app, so it isn't migrated by the app either
+		close(a.started)
 	}
+	store := a.Store
+
+	a.prepareRateLimits(backgroundCtx)
 
-	db, err := sql.Open("postgres", a.DatabaseUrl)
-	if err != nil {
-		log.Fatal(err)
+	if a.Metrics != nil {
+		a.Metrics.MustRegister(&backupOverdueCollector{store: store})
+		if a.db != nil {
+			a.Metrics.MustRegister(collectors.NewDBStatsCollector(a.db, "coldmfa"))
+		}
 	}
 
 	a.Router.Use(filesystem.New(filesystem.Config{
@@ -60,10 +94,11 @@ func (a *App) Prepare() {
 	}))
 
 	api := a.Router.Group("/api")
+	api.Use(a.requireStarted)
 
 	api.Get("/user", func(c *fiber.Ctx) error {
 		sessionUser := auth.SessionUser(c)
-		if sessionUser == "" {
+		if sessionUser == nil {
 			return c.SendStatus(http.StatusUnauthorized)
 		}
 
@@ -78,23 +113,12 @@ func (a *App) Prepare() {
 			return c.SendStatus(http.StatusUnauthorized)
 		}
 
-		rows, err := db.Query("SELECT group_id, name FROM code_group where owner_id = $1", sessionId)
+		out, err := store.ListGroups(c.UserContext(), sessionId)
 		if err != nil {
 			log.Errorf("failed to query groups: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
 		}
 
-		out := make([]CodeGroup, 0)
-		for rows.Next() {
-			var group CodeGroup
-			err = rows.Scan(&group.GroupId, &group.Name)
-			if err != nil {
-				log.Errorf("failed to scan group: %s", err.Error())
-				return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
-			}
-			out = append(out, group)
-		}
-
 		return c.Status(200).JSON(out)
 	})
 
@@ -109,27 +133,33 @@ func (a *App) Prepare() {
 			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing id"})
 		}
 
-		codeGroup, err := readCodeGroup(c.Context(), db, sessionId, groupId)
+		member, err := requireRole(c, store, sessionId, groupId, RoleViewer)
+		if member == nil {
+			return err
+		}
+
+		codeGroup, err := store.GetGroup(c.UserContext(), sessionId, groupId)
 		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "group not found"})
+			}
+
 			log.Errorf("failed to read group: %s", err.Error())
-			return c.Status(http.StatusNotFound).JSON(ApiError{Error: "group not found"})
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
 		}
 
-		rows, err := db.QueryContext(c.Context(), "select code_id, name, preferred_name, created_at, deleted, deleted_at from code where code_group_id = (select id from code_group where owner_id = $1 and group_id = $2)", sessionId, groupId)
+		codes, err := store.ListCodes(c.UserContext(), sessionId, groupId)
 		if err != nil {
 			log.Errorf("failed to query codes: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
 		}
 
-		codeGroup.Codes = make([]CodeSummary, 0)
-		for rows.Next() {
-			var code CodeSummary
-			err = rows.Scan(&code.CodeId, &code.Name, &code.PreferredName, &code.CreatedAt, &code.Deleted, &code.DeletedAt)
-			if err != nil {
-				log.Errorf("failed to scan code: %s", err.Error())
-				return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		tags := queryTags(c)
+		codeGroup.Codes = make([]CodeSummary, 0, len(codes))
+		for _, code := range codes {
+			if code.hasTags(tags) {
+				codeGroup.Codes = append(codeGroup.Codes, code)
 			}
-			codeGroup.Codes = append(codeGroup.Codes, code)
 		}
 
 		return c.Status(200).JSON(codeGroup)
@@ -156,13 +186,13 @@ func (a *App) Prepare() {
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
 		}
 
-		_, err = db.Exec("insert into code_group (owner_id, group_id, name) values ($1, $2, $3)", sessionId, groupId, codeGroup.Name)
+		err = store.CreateGroup(c.UserContext(), sessionId, nullableString(auth.SessionEmail(c)), groupId, codeGroup.Name)
 		if err != nil {
-			log.Errorf("failed to insert group: %s", err.Error())
+			log.Errorf("failed to create group: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
 		}
 
-		createdCodeGroup, err := readCodeGroup(c.Context(), db, sessionId, groupId)
+		createdCodeGroup, err := store.GetGroup(c.UserContext(), sessionId, groupId)
 		if err != nil {
 			log.Errorf("failed to read group: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "group not found"})
@@ -187,32 +217,33 @@ func (a *App) Prepare() {
 			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid request"})
 		}
 
-		otpUrl, err := url.Parse(createCode.Original)
+		key, err := ParseOtpKey(createCode.Original)
 		if err != nil {
 			log.Errorf("failed to parse otp url: %s", err.Error())
-			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid request"})
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid or unsupported otp provided"})
 		}
-		parts := strings.Split(otpUrl.Path, "/")
-
-		firstPart := ""
-		for _, part := range parts {
-			if part != "" {
-				firstPart = part
-				break
-			}
+		if key.Type != "totp" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: errHotpUnsupported.Error()})
 		}
-		name := firstPart
 
-		secret := otpUrl.Query().Get("secret")
-		if secret == "" {
-			log.Errorf("missing secret in otp url")
-			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid request"})
+		member, err := requireRole(c, store, sessionId, groupId, RoleEditor)
+		if member == nil {
+			return err
 		}
 
-		_, err = totp.GenerateCode(secret, time.Now())
+		fingerprint, err := a.fingerprint(c.UserContext(), key)
 		if err != nil {
-			log.Errorf("failed to generate code: %s", err.Error())
-			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid or unsupported opt provided"})
+			log.Errorf("failed to fingerprint code: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+		}
+
+		// The same code in any of the user's groups is a duplicate, however its URL was formatted
+		existing, err := store.FindCodeByFingerprint(c.UserContext(), sessionId, fingerprint)
+		if err == nil {
+			return c.Status(http.StatusConflict).JSON(DuplicateCodeError{Error: "code already exists", Existing: *existing})
+		} else if !errors.Is(err, ErrNotFound) {
+			log.Errorf("failed to find duplicate code: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
 		}
 
 		codeId, err := gonanoid.New()
@@ -221,13 +252,24 @@ func (a *App) Prepare() {
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
 		}
 
-		_, err = db.Exec("insert into code (code_group_id, code_id, original, name) values ((select id from code_group where owner_id = $1 and group_id = $2), $3, $4, $5)", sessionId, groupId, codeId, createCode.Original, name)
+		event, err := newAuditEvent(c, AuditCodeCreated, groupId, codeId, nil)
 		if err != nil {
+			log.Errorf("failed to prepare audit event: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+		}
+
+		err = store.CreateCode(c.UserContext(), groupId, codeId, createCode.Original, key, fingerprint, event)
+		if err != nil {
+			// A deleted code in the group can have the same original
+			if errors.Is(err, ErrAlreadyExists) {
+				return c.Status(http.StatusConflict).JSON(ApiError{Error: "code already exists"})
+			}
+
 			log.Errorf("failed to insert code: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
 		}
 
-		createdCode, err := readCodeSummary(db, sessionId, groupId, codeId)
+		createdCode, err := store.GetCode(c.UserContext(), groupId, codeId)
 		if err != nil {
 			log.Errorf("failed to read code: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "code not found"})
@@ -236,7 +278,7 @@ func (a *App) Prepare() {
 		return c.Status(http.StatusCreated).JSON(createdCode)
 	})
 
-	api.Get("/groups/:groupId/codes/:codeId", func(c *fiber.Ctx) error {
+	api.Get("/groups/:groupId/codes/:codeId", a.rateLimit(rateLimitPasscode), func(c *fiber.Ctx) error {
 		sessionId := auth.SessionId(c)
 		if sessionId == "" {
 			return c.SendStatus(http.StatusUnauthorized)
@@ -252,42 +294,67 @@ func (a *App) Prepare() {
 			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing codeId"})
 		}
 
-		row := db.QueryRow("select original from code where code_group_id = (select id from code_group where owner_id = $1 and group_id = $2) and code_id = $3", sessionId, groupId, codeId)
-		if row == nil {
-			return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code not found"})
+		var original string
+		var auditDetail map[string]interface{}
+		via := "member"
+		_, err := store.GetMembership(c.UserContext(), sessionId, groupId)
+		if err == nil {
+			original, err = store.GetCodeOriginal(c.UserContext(), groupId, codeId)
+		} else if errors.Is(err, ErrNotFound) {
+			// Not a member of the group, but the code may have been shared directly with this user
+			original, err = store.GetGrantedOriginal(c.UserContext(), sessionId, groupId, codeId)
+			via = "grant"
+			auditDetail = map[string]interface{}{"via": via}
 		}
 
-		var original string
-		err := row.Scan(&original)
 		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code not found"})
+			}
+
 			log.Errorf("failed to scan code: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
 		}
 
-		otpConfig, err := extractOtpAuthUrl(original)
+		key, err := ParseOtpKey(original)
 		if err != nil {
-			log.Errorf("failed to extract otp config: %s", err.Error())
+			log.Errorf("failed to parse otp url: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
 		}
 
-		opts, err := otpConfig.toOpts()
-		if err != nil {
+		opts, err := key.toOpts()
+		if errors.Is(err, errHotpUnsupported) {
+			// Codes added before hotp was rejected are kept, but they don't have passcodes that can be generated
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: err.Error()})
+		} else if err != nil {
 			log.Errorf("failed to convert otp config: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
 		}
+
+		_, span := tracing.Start(c.UserContext(), "generate passcode")
 		now := time.Now()
-		passcodeNow, err := totp.GenerateCodeCustom(otpConfig.Secret, now, *opts)
+		passcodeNow, err := totp.GenerateCodeCustom(key.Secret, now, *opts)
 		if err != nil {
+			span.End()
 			log.Errorf("failed to generate code: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
 		}
 
 		later := now.Add(time.Duration(opts.Period) * time.Second)
-		passcodeLater, err := totp.GenerateCodeCustom(otpConfig.Secret, later, *opts)
+		passcodeLater, err := totp.GenerateCodeCustom(key.Secret, later, *opts)
 		if err != nil {
+			span.End()
 			log.Errorf("failed to generate code: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
 		}
+		span.End()
+
+		err = audit(c, store, AuditPasscodeGenerated, groupId, codeId, auditDetail)
+		if err != nil {
+			log.Errorf("failed to audit passcode generation: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+		}
+		metrics.PasscodeGenerated(via)
 
 		return c.Status(200).JSON(PasscodeResponse{
 			Passcode:     passcodeNow,
@@ -313,34 +380,53 @@ func (a *App) Prepare() {
 			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing codeId"})
 		}
 
-		codeSummary := new(CodeSummary)
-		if err := c.BodyParser(codeSummary); err != nil {
+		request := new(UpdateCodeRequest)
+		if err := c.BodyParser(request); err != nil {
 			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid request"})
 		}
 
-		var result sql.Result
-		if codeSummary.PreferredName != nil && strings.TrimSpace(*codeSummary.PreferredName) == "" {
-			result, err = db.ExecContext(c.Context(), "update code set preferred_name = NULL where deleted = false and code_group_id = (select id from code_group where owner_id = $1 and group_id = $2) and code_id = $3", sessionId, groupId, codeId)
-		} else {
-			setName := strings.TrimSpace(*codeSummary.PreferredName)
-			result, err = db.ExecContext(c.Context(), "update code set preferred_name = $4 where deleted = false and code_group_id = (select id from code_group where owner_id = $1 and group_id = $2) and code_id = $3", sessionId, groupId, codeId, setName)
+		member, err := requireRole(c, store, sessionId, groupId, RoleEditor)
+		if member == nil {
+			return err
 		}
 
+		current, err := store.GetCode(c.UserContext(), groupId, codeId)
 		if err != nil {
-			log.Errorf("failed to update code: %s", err.Error())
+			if errors.Is(err, ErrNotFound) {
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code not found"})
+			}
+
+			log.Errorf("failed to read code: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
 		}
+		if current.Deleted {
+			return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code not found"})
+		}
 
-		rowsAffected, err := result.RowsAffected()
+		// Fields that aren't in the request are kept, so that renaming a code doesn't clear its metadata and editing the
+		// metadata doesn't clear its preferred name
+		preferredName := current.PreferredName
+		if request.PreferredName != nil {
+			preferredName = trimField(request.PreferredName)
+		}
+		metadata := current.CodeMetadata.update(request)
+		if err := metadata.normalize(); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: err.Error()})
+		}
+
+		err = store.UpdateCode(c.UserContext(), groupId, codeId, preferredName, metadata)
 		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code not found"})
+			}
+			if errors.Is(err, ErrAlreadyExists) {
+				return c.Status(http.StatusConflict).JSON(ApiError{Error: "preferred name already in use"})
+			}
+
 			log.Errorf("failed to update code: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
 		}
 
-		if rowsAffected == 0 {
-			return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code not found"})
-		}
-
 		return c.SendStatus(http.StatusNoContent)
 	})
 
@@ -369,21 +455,33 @@ func (a *App) Prepare() {
 			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing toGroupId"})
 		}
 
-		result, err := db.ExecContext(c.Context(), "update code set code_group_id = (select id from code_group where owner_id = $1 and group_id = $2) where deleted = false and code_group_id = (select id from code_group where owner_id = $1 and group_id = $3) and code_id = $4", sessionId, moveCodeRequest.ToGroupId, currentGroupId, codeId)
+		currentMember, err := requireRole(c, store, sessionId, currentGroupId, RoleEditor)
+		if currentMember == nil {
+			return err
+		}
 
-		if err != nil {
-			log.Errorf("failed to move code: %s", err.Error())
-			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		targetMember, err := requireRole(c, store, sessionId, moveCodeRequest.ToGroupId, RoleEditor)
+		if targetMember == nil {
+			return err
 		}
 
-		rowsAffected, err := result.RowsAffected()
+		event, err := codeOperationEvent(c, CodeOperation{Op: CodeOpMove, GroupId: currentGroupId, CodeId: codeId, ToGroupId: moveCodeRequest.ToGroupId})
 		if err != nil {
-			log.Errorf("failed to update code: %s", err.Error())
-			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+			log.Errorf("failed to prepare audit event: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
 		}
 
-		if rowsAffected == 0 {
-			return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code or target group not found"})
+		err = store.MoveCode(c.UserContext(), currentGroupId, codeId, moveCodeRequest.ToGroupId, event)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code or target group not found"})
+			}
+			if errors.Is(err, ErrAlreadyExists) {
+				return c.Status(http.StatusConflict).JSON(ApiError{Error: "code already exists"})
+			}
+
+			log.Errorf("failed to move code: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
 		}
 
 		return c.SendStatus(http.StatusNoContent)
@@ -405,22 +503,27 @@ func (a *App) Prepare() {
 			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing codeId"})
 		}
 
-		result, err := db.ExecContext(c.Context(), "update code set deleted = true, deleted_at = now() where deleted = false and code_group_id = (select id from code_group where owner_id = $1 and group_id = $2) and code_id = $3", sessionId, groupId, codeId)
+		member, err := requireRole(c, store, sessionId, groupId, RoleEditor)
+		if member == nil {
+			return err
+		}
+
+		event, err := codeOperationEvent(c, CodeOperation{Op: CodeOpDelete, GroupId: groupId, CodeId: codeId})
 		if err != nil {
-			log.Errorf("failed to delete code: %s", err.Error())
-			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+			log.Errorf("failed to prepare audit event: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
 		}
 
-		rowsAffected, err := result.RowsAffected()
+		err = store.DeleteCode(c.UserContext(), groupId, codeId, event)
 		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code not found"})
+			}
+
 			log.Errorf("failed to delete code: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
 		}
 
-		if rowsAffected == 0 {
-			return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code not found"})
-		}
-
 		return c.SendStatus(http.StatusNoContent)
 	})
 
@@ -440,30 +543,46 @@ func (a *App) Prepare() {
 			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing codeId"})
 		}
 
-		row := db.QueryRow("select original from code where code_group_id = (select id from code_group where owner_id = $1 and group_id = $2) and code_id = $3", sessionId, groupId, codeId)
-		if row == nil {
-			return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code not found"})
+		// Revealing the QR code exposes the secret, so it needs more than read access to the group
+		member, err := requireRole(c, store, sessionId, groupId, RoleEditor)
+		if member == nil {
+			return err
 		}
 
-		var original string
-		err := row.Scan(&original)
+		original, err := store.GetCodeOriginal(c.UserContext(), groupId, codeId)
 		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code not found"})
+			}
+
 			log.Errorf("failed to scan code: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
 		}
 
-		key, err := otp.NewKeyFromURL(original)
+		key, err := ParseOtpKey(original)
 		if err != nil {
-			log.Errorf("failed to parse key: %s", err.Error())
+			log.Errorf("failed to parse otp url: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+		}
+
+		otpKey, err := key.Key()
+		if err != nil {
+			log.Errorf("failed to convert key: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
 		}
 
-		image, err := key.Image(250, 250)
+		image, err := otpKey.Image(250, 250)
 		if err != nil {
 			log.Errorf("failed to generate qr: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
 		}
 
+		err = audit(c, store, AuditQrRevealed, groupId, codeId, nil)
+		if err != nil {
+			log.Errorf("failed to audit qr reveal: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+		}
+
 		reader, writer := io.Pipe()
 		go func() {
 			defer func(writer *io.PipeWriter) {
@@ -478,38 +597,30 @@ func (a *App) Prepare() {
 			}
 		}()
 
-		c.GetRespHeaders()["Content-Type"] = []string{"image/jpeg"}
+		c.Set(fiber.HeaderContentType, "image/jpeg")
 		return c.Status(200).SendStream(reader)
 	})
 
-	api.Post("/backups", func(c *fiber.Ctx) error {
+	api.Post("/backups", a.rateLimit(rateLimitBackup), func(c *fiber.Ctx) error {
 		sessionId := auth.SessionId(c)
 		if sessionId == "" {
 			return c.SendStatus(http.StatusUnauthorized)
 		}
 
+		defer observeBackup(c, "create")
+
 		backupRequest := new(BackupRequest)
 		if err := c.BodyParser(backupRequest); err != nil {
 			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid request"})
 		}
 
-		rows, err := db.Query("select code_group.name, code.original, code.name as code_name, code.preferred_name, code.created_at, code.deleted, code.deleted_at from code_group left join code on code.code_group_id = code_group.id where owner_id = $1", sessionId)
+		// Shared groups are included in the backups of all of their owners
+		backupItems, err := store.ListBackupItems(c.UserContext(), sessionId)
 		if err != nil {
 			log.Errorf("failed to query backups: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
 		}
 
-		backupItems := make([]BackupItem, 0)
-		for rows.Next() {
-			var item BackupItem
-			err = rows.Scan(&item.GroupName, &item.Original, &item.CodeName, &item.PreferredName, &item.CreatedAt, &item.Deleted, &item.DeletedAt)
-			if err != nil {
-				log.Errorf("failed to scan backup item: %s", err.Error())
-				return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
-			}
-			backupItems = append(backupItems, item)
-		}
-
 		var backupContent []string
 		for _, item := range backupItems {
 			it, err := json.Marshal(item)
@@ -527,97 +638,111 @@ func (a *App) Prepare() {
 		}
 
 		// As a last step before returning the encrypted backup, record the backup time in the database
-		_, err = db.Exec("insert into last_backup (owner_id, backup_at) values ($1, now()) on conflict on constraint owner_id_unique do update set backup_at = now()", sessionId)
+		err = store.RecordBackup(c.UserContext(), sessionId)
 		if err != nil {
 			log.Errorf("failed to record backup: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
 		}
 
+		err = audit(c, store, AuditBackupCreated, "", "", map[string]interface{}{"items": len(backupItems)})
+		if err != nil {
+			log.Errorf("failed to audit backup: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+		}
+
 		return c.Status(http.StatusOK).Send(encrypted)
 	})
 
-	api.Put("/backups", func(c *fiber.Ctx) error {
+	api.Put("/backups", a.rateLimit(rateLimitBackup), func(c *fiber.Ctx) error {
 		sessionId := auth.SessionId(c)
 		if sessionId == "" {
 			return c.SendStatus(http.StatusUnauthorized)
 		}
 
+		defer observeBackup(c, "restore")
+
 		restoreBackupRequest := new(RestoreBackupRequest)
 		if err := c.BodyParser(restoreBackupRequest); err != nil {
 			log.Info("failed to parse body")
 			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid request"})
 		}
 
+		if ok, err := a.checkDecryptLockout(c); !ok {
+			return err
+		}
+
 		decrypted, err := DecryptMfaCodeBackupItems(restoreBackupRequest.BackupContent, restoreBackupRequest.Password)
 		if err != nil {
 			log.Errorf("failed to decrypt backup: %s", err.Error())
+			a.recordDecryptFailure(c)
+			if err := audit(c, store, AuditBackupRestoreFail, "", "", nil); err != nil {
+				log.Errorf("failed to audit backup restore: %s", err.Error())
+				return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+			}
 			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid backup"})
 		}
 
-		tx, err := db.BeginTx(c.Context(), nil)
-		if err != nil {
-			log.Errorf("failed to start transaction: %s", err.Error())
-			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
-		}
-
-		defer func(tx *sql.Tx) {
-			err := tx.Rollback()
-			if err != nil && !errors.Is(err, sql.ErrTxDone) {
-				log.Errorf("failed to rollback transaction: %s", err.Error())
-			}
-		}(tx)
-
+		restoreItems := make([]RestoreItem, 0, len(decrypted))
 		for _, item := range decrypted {
-			var backupItem BackupItem
-			err := json.Unmarshal([]byte(item), &backupItem)
+			var restoreItem RestoreItem
+			err := json.Unmarshal([]byte(item), &restoreItem.BackupItem)
 			if err != nil {
 				log.Errorf("failed to unmarshal backup item: %s", err.Error())
 				return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
 			}
 
-			groupId, err := gonanoid.New()
-			if err != nil {
-				log.Errorf("failed to generate group id: %s", err.Error())
-				return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+			if restoreItem.Original != nil {
+				restoreItem.Key, err = ParseOtpKey(*restoreItem.Original)
+				if err != nil {
+					// Codes from before otpauth URLs were checked are restored as they were backed up
+					log.Warnf("failed to parse otp url in backup: %s", err.Error())
+				} else if restoreItem.Key.Type != "totp" {
+					return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "backup contains hotp codes, which are not supported"})
+				} else {
+					fingerprint, err := a.fingerprint(c.UserContext(), restoreItem.Key)
+					if err != nil {
+						log.Errorf("failed to fingerprint code: %s", err.Error())
+						return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+					}
+					restoreItem.Fingerprint = &fingerprint
+				}
 			}
 
-			_, err = tx.ExecContext(c.Context(), "insert into code_group (owner_id, group_id, name) values ($1, $2, $3) on conflict on constraint owner_id_name_unique do nothing", sessionId, groupId, backupItem.GroupName)
-			if err != nil {
-				log.Errorf("failed to insert group: %s", err.Error())
-				return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+			if err := restoreItem.CodeMetadata.normalize(); err != nil {
+				// Metadata is checked when it's set, so this is only reached if the backup was edited
+				log.Warnf("dropping invalid code metadata in backup: %s", err.Error())
+				restoreItem.CodeMetadata = CodeMetadata{}
 			}
 
-			row := tx.QueryRowContext(c.Context(), "select id from code_group where owner_id = $1 and name = $2", sessionId, backupItem.GroupName)
+			// The ids are only used if the group or code doesn't already exist
+			restoreItem.GroupId, err = gonanoid.New()
+			if err != nil {
+				log.Errorf("failed to generate group id: %s", err.Error())
+				return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+			}
 
-			var groupDatabaseId int
-			err = row.Scan(&groupDatabaseId)
+			restoreItem.CodeId, err = gonanoid.New()
 			if err != nil {
-				log.Errorf("failed to insert or read group: %s", err.Error())
-				return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+				log.Errorf("failed to generate code id: %s", err.Error())
+				return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
 			}
 
-			if backupItem.CodeName != nil {
-				codeId, err := gonanoid.New()
-				if err != nil {
-					log.Errorf("failed to generate code id: %s", err.Error())
-					return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
-				}
+			restoreItems = append(restoreItems, restoreItem)
+		}
 
-				_, err = tx.ExecContext(c.Context(), "insert into code (code_group_id, code_id, original, name, preferred_name, created_at, deleted, deleted_at) values ($1, $2, $3, $4, $5, $6, $7, $8) on conflict on constraint code_group_id_original_unique do nothing", groupDatabaseId, codeId, backupItem.Original, backupItem.CodeName, backupItem.PreferredName, backupItem.CreatedAt, backupItem.Deleted, backupItem.DeletedAt)
-				if err != nil {
-					log.Errorf("failed to insert code: %s", err.Error())
-					return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
-				}
-			}
+		event, err := newAuditEvent(c, AuditBackupRestored, "", "", map[string]interface{}{"items": len(decrypted)})
+		if err != nil {
+			log.Errorf("failed to prepare audit event: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
 		}
 
-		err = tx.Commit()
+		existing, err := store.RestoreBackup(c.UserContext(), sessionId, nullableString(auth.SessionEmail(c)), restoreItems, event)
 		if err != nil {
-			log.Errorf("failed to commit transaction: %s", err.Error())
+			log.Errorf("failed to restore backup: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
 		}
 
-		return c.SendStatus(http.StatusOK)
+		return c.Status(http.StatusOK).JSON(RestoreBackupResponse{Existing: existing})
 	})
 
 	api.Get("/backups/warning", func(c *fiber.Ctx) error {
@@ -626,180 +751,69 @@ func (a *App) Prepare() {
 			return c.SendStatus(http.StatusUnauthorized)
 		}
 
-		lastBackupRow := db.QueryRow("select last_backup.backup_at from last_backup where last_backup.owner_id = $1", sessionId)
-		countRow := db.QueryRow("select count(code.id) from last_backup left join code_group on code_group.owner_id = last_backup.owner_id left join code on code.code_group_id = code_group.id where last_backup.owner_id = $1 and code.created_at > last_backup.backup_at group by last_backup.owner_id, last_backup.backup_at", sessionId)
-
-		var warning BackupWarning
-		err := lastBackupRow.Scan(&warning.LastBackupAt)
-		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		warning, err := store.GetBackupWarning(c.UserContext(), sessionId)
+		if err != nil {
 			log.Errorf("failed to read warning: %s", err.Error())
 			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
 		}
 
-		err = countRow.Scan(&warning.NumberNotBackedUp)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				warning.NumberNotBackedUp = 0
-			} else {
-				log.Errorf("failed to read warning: %s", err.Error())
-				return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
-			}
-		}
-
 		return c.Status(http.StatusOK).JSON(warning)
 	})
-}
 
-func readCodeGroup(context context.Context, db *sql.DB, ownerId string, groupId string) (*CodeGroup, error) {
-	row := db.QueryRowContext(context, "select group_id, name from code_group where owner_id = $1 and group_id = $2", ownerId, groupId)
-	if row == nil {
-		return nil, fmt.Errorf("group not found")
-	}
-
-	var group CodeGroup
-	err := row.Scan(&group.GroupId, &group.Name)
-	return &group, err
+	a.prepareMembers(api, store)
+	a.prepareGrants(api, store)
+	a.prepareBatch(api, store)
+	a.prepareSearch(api, store)
+	a.prepareOrdering(api, store)
+	a.prepareAudit(api, store)
 }
 
-func readCodeSummary(db *sql.DB, ownerId string, groupId, codeId string) (*CodeSummary, error) {
-	row := db.QueryRow("select code_id, name, preferred_name, created_at, deleted, deleted_at from code where code_group_id = (select id from code_group where owner_id = $1 and group_id = $2) and code_id = $3", ownerId, groupId, codeId)
-	if row == nil {
-		return nil, fmt.Errorf("code not found")
-	}
-
-	var code CodeSummary
-	err := row.Scan(&code.CodeId, &code.Name, &code.PreferredName, &code.CreatedAt, &code.Deleted, &code.DeletedAt)
-	return &code, err
-}
-
-type OtpConfig struct {
-	Type      string
-	Label     string
-	Secret    string
-	Issuer    *string
-	Algorithm *string
-	Digits    *int
-	Counter   *int
-	Period    *uint
+// Close stops background jobs and closes the database. It should be called once the server has stopped handling
+// requests. If the context expires before background jobs have stopped then the database is closed anyway.
+// Started is closed once the app has finished preparing the database and the API is available.
+func (a *App) Started() <-chan struct{} {
+	return a.started
 }
 
-func extractOtpAuthUrl(raw string) (*OtpConfig, error) {
-	otpUrl, err := url.Parse(raw)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse otp url: %s", err.Error())
-	}
-
-	if otpUrl.Scheme != "otpauth" {
-		return nil, fmt.Errorf("invalid otp url scheme")
-	}
-
-	typ := otpUrl.Host
-	if typ != "totp" && typ != "hotp" {
-		return nil, fmt.Errorf("unsupported otp type")
-	}
-
-	path := otpUrl.Path
-	if len(path) > 0 && path[0] == '/' {
-		path = path[1:]
-	}
-	parts := strings.Split(otpUrl.Path, "/")
-
-	if len(parts) < 1 {
-		return nil, fmt.Errorf("invalid otp url path")
-	}
-
-	label := parts[1]
-
-	secret := otpUrl.Query().Get("secret")
-	if secret == "" {
-		return nil, fmt.Errorf("missing secret in otp url")
-	}
-
-	out := OtpConfig{
-		Type:   typ,
-		Label:  label,
-		Secret: secret,
+// requireStarted rejects API requests until the database has been migrated and codes normalized, so that requests
+// aren't served against an old schema or find codes without fingerprints.
+func (a *App) requireStarted(c *fiber.Ctx) error {
+	select {
+	case <-a.started:
+		return c.Next()
+	default:
+		c.Set(fiber.HeaderRetryAfter, "5")
+		return c.Status(http.StatusServiceUnavailable).JSON(ApiError{Error: "starting up"})
 	}
+}
 
-	issuer := otpUrl.Query().Get("issuer")
-	if issuer != "" {
-		out.Issuer = &issuer
+func (a *App) Close(ctx context.Context) error {
+	if a.stopBackground != nil {
+		a.stopBackground()
 	}
 
-	algorithm := otpUrl.Query().Get("algorithm")
-	if algorithm != "" {
-		out.Algorithm = &algorithm
-	}
+	stopped := make(chan struct{})
+	go func() {
+		a.background.Wait()
+		close(stopped)
+	}()
 
-	digits := otpUrl.Query().Get("digits")
-	if digits != "" {
-		num, err := strconv.Atoi(digits)
-		if err != nil {
-			return nil, fmt.Errorf("invalid digits")
-		}
-		out.Digits = &num
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Warn("Timed out waiting for background jobs to stop")
 	}
 
-	counter := otpUrl.Query().Get("counter")
-	if counter != "" {
-		num, err := strconv.Atoi(counter)
-		if err != nil {
-			return nil, fmt.Errorf("invalid counter")
-		}
-		out.Counter = &num
-	} else if typ == "hotp" {
-		return nil, fmt.Errorf("missing counter in hotp url")
+	if a.db == nil {
+		return nil
 	}
-
-	period := otpUrl.Query().Get("period")
-	if typ == "totp" && period != "" {
-		num, err := strconv.Atoi(period)
-		if err != nil || num < 0 {
-			return nil, fmt.Errorf("invalid period")
-		}
-		unsignedNum := uint(num)
-		out.Period = &unsignedNum
-	}
-
-	return &out, nil
+	return a.db.Close()
 }
 
-func (cfg *OtpConfig) toOpts() (*totp.ValidateOpts, error) {
-	opts := totp.ValidateOpts{}
-
-	if cfg.Period != nil {
-		opts.Period = *cfg.Period
-	} else {
-		// Documented default, but might not match what is expected by the totp library if
-		// that code is updated and this isn't...
-		opts.Period = 30
-	}
-
-	if cfg.Digits != nil {
-		switch *cfg.Digits {
-		case 6:
-			opts.Digits = otp.DigitsSix
-		case 8:
-			opts.Digits = otp.DigitsEight
-		default:
-			return nil, fmt.Errorf("invalid digits")
-		}
-	}
-
-	if cfg.Algorithm != nil {
-		switch *cfg.Algorithm {
-		case "SHA1":
-			opts.Algorithm = otp.AlgorithmSHA1
-		case "SHA256":
-			opts.Algorithm = otp.AlgorithmSHA256
-		case "SHA512":
-			opts.Algorithm = otp.AlgorithmSHA512
-		case "MD5":
-			opts.Algorithm = otp.AlgorithmMD5
-		default:
-			return nil, fmt.Errorf("invalid algorithm")
-		}
+func nullableString(value string) *string {
+	if value == "" {
+		return nil
 	}
 
-	return &opts, nil
+	return &value
 }
@@ -0,0 +1,547 @@
+package coldmfa
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/EphyraSoftware/locus/auth"
+	"github.com/EphyraSoftware/locus/ratelimit"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	ory "github.com/ory/client-go"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const (
+	testOriginal      = "otpauth://totp/Example:alice@example.com?secret=JBSWY3DPEHPK3PXP&issuer=Example"
+	testOtherOriginal = "otpauth://totp/Other:alice@example.com?secret=KRSXG5CTMVRXEZLU&issuer=Other"
+)
+
+func stringPtr(value string) *string {
+	return &value
+}
+
+// testUserHeader names the identity to authenticate a test request as.
+const testUserHeader = "X-Test-User"
+
+type testIdentities struct{}
+
+// ResolveEmail resolves any email at example.com to the identity named by its local part.
+func (testIdentities) ResolveEmail(_ context.Context, email string) (*auth.Identity, error) {
+	id, found := strings.CutSuffix(email, "@example.com")
+	if !found {
+		return nil, auth.ErrIdentityNotFound
+	}
+
+	return &auth.Identity{Id: id, Email: email}, nil
+}
+
+type testApp struct {
+	t   *testing.T
+	app *fiber.App
+	// userHeader is the request header that selects the identity to authenticate as
+	userHeader string
+	store      Store
+}
+
+func newTestApp(t *testing.T) *testApp {
+	return newTestAppWithRateLimits(t, nil)
+}
+
+func newTestAppWithRateLimits(t *testing.T, rateLimits *RateLimits) *testApp {
+	return newTestAppWithStore(t, NewMemoryStore(), rateLimits)
+}
+
+func newTestAppWithStore(t *testing.T, store Store, rateLimits *RateLimits) *testApp {
+	app := fiber.New(fiber.Config{
+		// The memory store keeps the strings that it is given, so they mustn't be reused by fiber
+		Immutable:   true,
+		JSONEncoder: json.Marshal,
+		JSONDecoder: json.Unmarshal,
+	})
+	app.Use(func(c *fiber.Ctx) error {
+		if id := c.Get(testUserHeader); id != "" {
+			session := ory.NewSession("session-" + id)
+			session.Identity = ory.NewIdentity(id, "default", "", map[string]interface{}{"email": id + "@example.com"})
+			c.Locals("session", session)
+		}
+		return c.Next()
+	})
+
+	coldMfaApp := &App{
+		Router:     app.Group("/coldmfa"),
+		Store:      store,
+		Identities: testIdentities{},
+		RateLimits: rateLimits,
+	}
+	coldMfaApp.Prepare()
+	t.Cleanup(func() {
+		if err := coldMfaApp.Close(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return &testApp{t: t, app: app, userHeader: testUserHeader, store: store}
+}
+
+// do sends a request as the given user, or unauthenticated if the user is empty, and decodes a JSON response into out
+// if it is set. Returns the response status.
+func (a *testApp) do(user string, method string, path string, body interface{}, out interface{}) int {
+	a.t.Helper()
+
+	resp := a.send(user, method, path, body)
+	defer resp.Body.Close()
+
+	if out != nil && resp.StatusCode < http.StatusBadRequest {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			a.t.Fatalf("failed to decode response to %s %s: %s", method, path, err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func (a *testApp) send(user string, method string, path string, body interface{}) *http.Response {
+	a.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			a.t.Fatal(err)
+		}
+		reader = bytes.NewReader(content)
+	}
+
+	req := httptest.NewRequest(method, "/coldmfa/api"+path, reader)
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if user != "" {
+		req.Header.Set(a.userHeader, user)
+	}
+
+	// Backups are slow to encrypt and decrypt, so don't time out
+	resp, err := a.app.Test(req, -1)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return resp
+}
+
+func (a *testApp) expect(expected int, user string, method string, path string, body interface{}, out interface{}) {
+	a.t.Helper()
+
+	if status := a.do(user, method, path, body, out); status != expected {
+		a.t.Fatalf("expected %s %s as %q to return %d, got %d", method, path, user, expected, status)
+	}
+}
+
+func (a *testApp) createGroup(user string, name string) CodeGroup {
+	a.t.Helper()
+
+	var group CodeGroup
+	a.expect(http.StatusCreated, user, http.MethodPost, "/groups", CodeGroup{Name: name}, &group)
+	return group
+}
+
+func (a *testApp) createCode(user string, groupId string, original string) CodeSummary {
+	a.t.Helper()
+
+	var code CodeSummary
+	a.expect(http.StatusCreated, user, http.MethodPost, fmt.Sprintf("/groups/%s/codes", groupId), CreateCode{Original: original}, &code)
+	return code
+}
+
+func (a *testApp) search(user string, query url.Values) CodeSearchResponse {
+	a.t.Helper()
+
+	var response CodeSearchResponse
+	a.expect(http.StatusOK, user, http.MethodGet, "/codes?"+query.Encode(), nil, &response)
+	return response
+}
+
+// expectIds checks the ids that were found, in order.
+func expectIds(t *testing.T, found []string, ids ...string) {
+	t.Helper()
+
+	if !slices.Equal(found, ids) {
+		t.Fatalf("expected %v, found %v", ids, found)
+	}
+}
+
+// resultIds lists the ids of codes that were found, in order.
+func resultIds(results []CodeSearchResult) []string {
+	ids := make([]string, 0, len(results))
+	for _, result := range results {
+		ids = append(ids, result.CodeId)
+	}
+	return ids
+}
+
+// expectCodes checks the ids of the codes that were found by a search, in order.
+func expectCodes(t *testing.T, response CodeSearchResponse, codeIds ...string) {
+	t.Helper()
+
+	expectIds(t, resultIds(response.Codes), codeIds...)
+}
+
+// groupIds lists the ids of the identity's groups, in order.
+func (a *testApp) groupIds(user string) []string {
+	a.t.Helper()
+
+	var groups []CodeGroup
+	a.expect(http.StatusOK, user, http.MethodGet, "/groups", nil, &groups)
+	ids := make([]string, 0, len(groups))
+	for _, group := range groups {
+		ids = append(ids, group.GroupId)
+	}
+	return ids
+}
+
+// listCodes reads the codes in a group, in the identity's order.
+func (a *testApp) listCodes(user string, groupId string) []CodeSummary {
+	a.t.Helper()
+
+	var group CodeGroup
+	a.expect(http.StatusOK, user, http.MethodGet, "/groups/"+groupId, nil, &group)
+	return group.Codes
+}
+
+// groupCodes reads the codes in a group by id.
+func (a *testApp) groupCodes(user string, groupId string) map[string]CodeSummary {
+	a.t.Helper()
+
+	codes := make(map[string]CodeSummary)
+	for _, code := range a.listCodes(user, groupId) {
+		codes[code.CodeId] = code
+	}
+	return codes
+}
+
+// codeIds lists the ids of codes, in order.
+func codeIds(codes []CodeSummary) []string {
+	ids := make([]string, 0, len(codes))
+	for _, code := range codes {
+		ids = append(ids, code.CodeId)
+	}
+	return ids
+}
+
+func TestUnauthenticated(t *testing.T) {
+	app := newTestApp(t)
+
+	app.expect(http.StatusUnauthorized, "", http.MethodGet, "/user", nil, nil)
+	app.expect(http.StatusUnauthorized, "", http.MethodGet, "/groups", nil, nil)
+	app.expect(http.StatusUnauthorized, "", http.MethodPost, "/groups", CodeGroup{Name: "test"}, nil)
+	app.expect(http.StatusUnauthorized, "", http.MethodGet, "/groups/a/codes/b", nil, nil)
+	app.expect(http.StatusUnauthorized, "", http.MethodPost, "/codes/batch", CodeBatchRequest{}, nil)
+	app.expect(http.StatusUnauthorized, "", http.MethodGet, "/favorites", nil, nil)
+	app.expect(http.StatusUnauthorized, "", http.MethodPut, "/groups/order", ReorderGroupsRequest{}, nil)
+	app.expect(http.StatusUnauthorized, "", http.MethodPost, "/backups", BackupRequest{Password: "password"}, nil)
+	app.expect(http.StatusUnauthorized, "", http.MethodGet, "/backups/warning", nil, nil)
+}
+
+func TestUser(t *testing.T) {
+	app := newTestApp(t)
+
+	var user struct {
+		User map[string]interface{} `json:"user"`
+	}
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/user", nil, &user)
+	if user.User["email"] != "alice@example.com" {
+		t.Fatalf("expected the session traits, got %v", user.User)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	app := newTestApp(t)
+
+	app.expect(http.StatusBadRequest, "alice", http.MethodPost, "/groups", CodeGroup{Name: "ab"}, nil)
+
+	group := app.createGroup("alice", "personal")
+	if group.GroupId == "" || group.Name != "personal" || group.Role != RoleOwner {
+		t.Fatalf("unexpected created group %+v", group)
+	}
+
+	// Group names are unique for each creator
+	app.expect(http.StatusInternalServerError, "alice", http.MethodPost, "/groups", CodeGroup{Name: "personal"}, nil)
+	app.createGroup("bob", "personal")
+
+	var groups []CodeGroup
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/groups", nil, &groups)
+	if len(groups) != 1 || groups[0].GroupId != group.GroupId {
+		t.Fatalf("expected only alice's group, got %+v", groups)
+	}
+
+	var read CodeGroup
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/groups/"+group.GroupId, nil, &read)
+	if read.Name != "personal" || read.Codes == nil || len(read.Codes) != 0 {
+		t.Fatalf("expected an empty group, got %+v", read)
+	}
+
+	app.expect(http.StatusNotFound, "alice", http.MethodGet, "/groups/missing", nil, nil)
+	app.expect(http.StatusNotFound, "bob", http.MethodGet, "/groups/"+group.GroupId, nil, nil)
+}
+
+func TestCodes(t *testing.T) {
+	app := newTestApp(t)
+	group := app.createGroup("alice", "personal")
+	path := "/groups/" + group.GroupId + "/codes"
+
+	app.expect(http.StatusBadRequest, "alice", http.MethodPost, path, CreateCode{Original: "otpauth://totp/Example:alice"}, nil)
+	app.expect(http.StatusBadRequest, "alice", http.MethodPost, path, CreateCode{Original: "otpauth://totp/Example:alice?secret=not-base32"}, nil)
+	app.expect(http.StatusNotFound, "bob", http.MethodPost, path, CreateCode{Original: testOriginal}, nil)
+
+	code := app.createCode("alice", group.GroupId, testOriginal)
+	if code.CodeId == "" || code.Name != "Example" || code.Deleted {
+		t.Fatalf("unexpected created code %+v", code)
+	}
+	if code.Issuer == nil || *code.Issuer != "Example" || code.Account == nil || *code.Account != "alice@example.com" {
+		t.Fatalf("expected the issuer and account to be parsed from %+v", code)
+	}
+
+	// The same code can't be added twice to any of the user's groups, however its URL is formatted
+	duplicateGroup := app.createGroup("alice", "duplicates")
+	duplicates := []struct {
+		groupId  string
+		original string
+	}{
+		{group.GroupId, testOriginal},
+		{group.GroupId, "otpauth://totp/Example%3Aalice%40example.com?secret=jbsw%20y3dp%20ehpk%203pxp&issuer=Example"},
+		{duplicateGroup.GroupId, "otpauth://totp/Other:bob?secret=JBSWY3DPEHPK3PXP&period=30&digits=6"},
+	}
+	for _, duplicate := range duplicates {
+		resp := app.send("alice", http.MethodPost, "/groups/"+duplicate.groupId+"/codes", CreateCode{Original: duplicate.original})
+		var duplicateErr DuplicateCodeError
+		err := json.NewDecoder(resp.Body).Decode(&duplicateErr)
+		_ = resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusConflict {
+			t.Fatalf("expected %s to conflict, got %d", duplicate.original, resp.StatusCode)
+		}
+		if duplicateErr.Existing.GroupId != group.GroupId || duplicateErr.Existing.CodeId != code.CodeId {
+			t.Fatalf("expected %s to be reported as a duplicate of %s, got %+v", duplicate.original, code.CodeId, duplicateErr)
+		}
+	}
+
+	// Codes with the same secret but different passcodes aren't duplicates
+	app.createCode("alice", duplicateGroup.GroupId, "otpauth://totp/Example:alice@example.com?secret=JBSWY3DPEHPK3PXP&period=60")
+	// Nor are another user's codes
+	app.createCode("bob", app.createGroup("bob", "personal").GroupId, testOriginal)
+
+	// The original is stored as it was enrolled, including parameters that the canonical URL leaves out
+	enrolled := "otpauth://totp/Image:alice@example.com?secret=GEZDGNBVGY3TQOJQ&issuer=Image&image=https%3A%2F%2Fexample.com%2Flogo.png"
+	imageCode := app.createCode("alice", duplicateGroup.GroupId, enrolled)
+	original, err := app.store.GetCodeOriginal(context.Background(), duplicateGroup.GroupId, imageCode.CodeId)
+	if err != nil || original != enrolled {
+		t.Fatalf("expected the original to be kept, got %q", original)
+	}
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/groups/"+duplicateGroup.GroupId+"/codes/"+imageCode.CodeId, nil, nil)
+
+	var passcode PasscodeResponse
+	app.expect(http.StatusOK, "alice", http.MethodGet, path+"/"+code.CodeId, nil, &passcode)
+	if len(passcode.Passcode) != 6 || len(passcode.NextPasscode) != 6 || passcode.Period != 30 {
+		t.Fatalf("unexpected passcode %+v", passcode)
+	}
+	app.expect(http.StatusNotFound, "alice", http.MethodGet, path+"/missing", nil, nil)
+	app.expect(http.StatusNotFound, "bob", http.MethodGet, path+"/"+code.CodeId, nil, nil)
+
+	resp := app.send("alice", http.MethodGet, path+"/"+code.CodeId+"/qr", nil)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(fiber.HeaderContentType) != "image/jpeg" {
+		t.Fatalf("expected a QR image, got %d %s", resp.StatusCode, resp.Header.Get(fiber.HeaderContentType))
+	}
+
+	preferredName := "  Work  "
+	app.expect(http.StatusNoContent, "alice", http.MethodPut, path+"/"+code.CodeId, CodeSummary{PreferredName: &preferredName}, nil)
+	var read CodeGroup
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/groups/"+group.GroupId, nil, &read)
+	if len(read.Codes) != 1 || read.Codes[0].PreferredName == nil || *read.Codes[0].PreferredName != "Work" {
+		t.Fatalf("expected the preferred name to be set, got %+v", read.Codes)
+	}
+
+	blank := " "
+	app.expect(http.StatusNoContent, "alice", http.MethodPut, path+"/"+code.CodeId, CodeSummary{PreferredName: &blank}, nil)
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/groups/"+group.GroupId, nil, &read)
+	if read.Codes[0].PreferredName != nil {
+		t.Fatalf("expected the preferred name to be cleared, got %q", *read.Codes[0].PreferredName)
+	}
+	app.expect(http.StatusNotFound, "alice", http.MethodPut, path+"/missing", CodeSummary{PreferredName: &preferredName}, nil)
+
+	other := app.createGroup("alice", "work")
+	app.expect(http.StatusBadRequest, "alice", http.MethodPost, path+"/"+code.CodeId+"/move", MoveCodeRequest{}, nil)
+	app.expect(http.StatusNoContent, "alice", http.MethodPost, path+"/"+code.CodeId+"/move", MoveCodeRequest{ToGroupId: other.GroupId}, nil)
+	app.expect(http.StatusNotFound, "alice", http.MethodGet, path+"/"+code.CodeId, nil, nil)
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/groups/"+other.GroupId+"/codes/"+code.CodeId, nil, nil)
+	app.expect(http.StatusNotFound, "alice", http.MethodPost, path+"/"+code.CodeId+"/move", MoveCodeRequest{ToGroupId: other.GroupId}, nil)
+
+	otherPath := "/groups/" + other.GroupId + "/codes/" + code.CodeId
+	app.expect(http.StatusNoContent, "alice", http.MethodDelete, otherPath, nil, nil)
+	app.expect(http.StatusNotFound, "alice", http.MethodDelete, otherPath, nil, nil)
+	app.expect(http.StatusNotFound, "alice", http.MethodPut, otherPath, CodeSummary{PreferredName: &preferredName}, nil)
+
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/groups/"+other.GroupId, nil, &read)
+	if len(read.Codes) != 1 || !read.Codes[0].Deleted || read.Codes[0].DeletedAt == nil {
+		t.Fatalf("expected the code to be soft deleted, got %+v", read.Codes)
+	}
+}
+
+// TestHotpCodes checks that hotp codes aren't accepted, and that codes added before they were rejected aren't given
+// totp passcodes that the issuer wouldn't accept.
+func TestHotpCodes(t *testing.T) {
+	app := newTestApp(t)
+	group := app.createGroup("alice", "personal")
+	path := "/groups/" + group.GroupId + "/codes"
+
+	hotpOriginal := "otpauth://hotp/Example:alice@example.com?secret=JBSWY3DPEHPK3PXP&issuer=Example&counter=0"
+	app.expect(http.StatusBadRequest, "alice", http.MethodPost, path, CreateCode{Original: hotpOriginal}, nil)
+	if codes := app.listCodes("alice", group.GroupId); len(codes) != 0 {
+		t.Fatalf("expected the hotp code not to be created, got %+v", codes)
+	}
+
+	key := mustParseOtpKey(t, hotpOriginal)
+	err := app.store.CreateCode(context.Background(), group.GroupId, "legacy", hotpOriginal, key, "legacy", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.expect(http.StatusBadRequest, "alice", http.MethodGet, path+"/legacy", nil, nil)
+
+	resp := app.send("alice", http.MethodPost, "/backups", BackupRequest{Password: "password"})
+	backup, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a backup, got %d", resp.StatusCode)
+	}
+
+	app.expect(http.StatusBadRequest, "bob", http.MethodPut, "/backups", RestoreBackupRequest{BackupContent: backup, Password: "password"}, nil)
+	if groups := app.groupIds("bob"); len(groups) != 0 {
+		t.Fatalf("expected nothing to be restored, got %+v", groups)
+	}
+}
+
+func TestBackups(t *testing.T) {
+	app := newTestApp(t)
+	group := app.createGroup("alice", "personal")
+	app.createCode("alice", group.GroupId, testOriginal)
+	app.createGroup("alice", "empty")
+
+	var warning BackupWarning
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/backups/warning", nil, &warning)
+	if warning.LastBackupAt != nil || warning.NumberNotBackedUp != 0 {
+		t.Fatalf("expected no backup, got %+v", warning)
+	}
+
+	resp := app.send("alice", http.MethodPost, "/backups", BackupRequest{Password: "password"})
+	backup, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || len(backup) == 0 {
+		t.Fatalf("expected a backup, got %d", resp.StatusCode)
+	}
+
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/backups/warning", nil, &warning)
+	if warning.LastBackupAt == nil || warning.NumberNotBackedUp != 0 {
+		t.Fatalf("expected a recent backup, got %+v", warning)
+	}
+
+	app.expect(http.StatusBadRequest, "bob", http.MethodPut, "/backups", RestoreBackupRequest{BackupContent: backup, Password: "wrong"}, nil)
+
+	// Restoring twice doesn't create duplicates, and the second restore reports the codes that already exist
+	for i := 0; i < 2; i++ {
+		var restored RestoreBackupResponse
+		app.expect(http.StatusOK, "bob", http.MethodPut, "/backups", RestoreBackupRequest{BackupContent: backup, Password: "password"}, &restored)
+		if len(restored.Existing) != i {
+			t.Fatalf("expected %d existing codes on restore %d, got %+v", i, i+1, restored.Existing)
+		}
+	}
+
+	var groups []CodeGroup
+	app.expect(http.StatusOK, "bob", http.MethodGet, "/groups", nil, &groups)
+	if len(groups) != 2 {
+		t.Fatalf("expected both groups to be restored, got %+v", groups)
+	}
+
+	for _, restored := range groups {
+		var read CodeGroup
+		app.expect(http.StatusOK, "bob", http.MethodGet, "/groups/"+restored.GroupId, nil, &read)
+
+		expected := 0
+		if read.Name == "personal" {
+			expected = 1
+		}
+		if read.Role != RoleOwner || len(read.Codes) != expected {
+			t.Fatalf("expected %d codes in restored group %+v", expected, read)
+		}
+	}
+}
+
+func TestRestoreSharedGroup(t *testing.T) {
+	forEachStore(t, testRestoreSharedGroup)
+}
+
+// testRestoreSharedGroup restores the backup of an owner who didn't create a group, which has to restore into the
+// group that it was taken from rather than one of its own.
+func testRestoreSharedGroup(t *testing.T, app *testApp) {
+	shared := app.createGroup("alice", "shared")
+	work := app.createGroup("alice", "work")
+	code := app.createCode("alice", shared.GroupId, testOriginal)
+	app.expect(http.StatusCreated, "alice", http.MethodPost, "/groups/"+shared.GroupId+"/members", InviteMemberRequest{Email: "bob@example.com", Role: RoleOwner}, nil)
+
+	resp := app.send("bob", http.MethodPost, "/backups", BackupRequest{Password: "password"})
+	backup, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a backup, got %d", resp.StatusCode)
+	}
+
+	var restored RestoreBackupResponse
+	app.expect(http.StatusOK, "bob", http.MethodPut, "/backups", RestoreBackupRequest{BackupContent: backup, Password: "password"}, &restored)
+	if len(restored.Existing) != 1 || restored.Existing[0].GroupId != shared.GroupId {
+		t.Fatalf("expected the code to already exist, got %+v", restored.Existing)
+	}
+	expectIds(t, app.groupIds("bob"), shared.GroupId)
+
+	// A code that has been moved out of the group is restored back into it
+	app.expect(http.StatusNoContent, "alice", http.MethodPost, "/groups/"+shared.GroupId+"/codes/"+code.CodeId+"/move", MoveCodeRequest{ToGroupId: work.GroupId}, nil)
+	app.expect(http.StatusOK, "bob", http.MethodPut, "/backups", RestoreBackupRequest{BackupContent: backup, Password: "password"}, nil)
+	expectIds(t, app.groupIds("bob"), shared.GroupId)
+	if codes := app.listCodes("alice", shared.GroupId); len(codes) != 1 || codes[0].Deleted {
+		t.Fatalf("expected the code to be restored into the shared group, got %+v", codes)
+	}
+}
+
+func TestPasscodeRateLimit(t *testing.T) {
+	app := newTestAppWithRateLimits(t, &RateLimits{
+		Passcode:       ratelimit.PerMinute(1, 2),
+		Backup:         ratelimit.PerMinute(1, 2),
+		DecryptFailure: ratelimit.PerMinute(1, 2),
+	})
+	group := app.createGroup("alice", "personal")
+	code := app.createCode("alice", group.GroupId, testOriginal)
+	path := "/groups/" + group.GroupId + "/codes/" + code.CodeId
+
+	app.expect(http.StatusOK, "alice", http.MethodGet, path, nil, nil)
+	app.expect(http.StatusOK, "alice", http.MethodGet, path, nil, nil)
+
+	resp := app.send("alice", http.MethodGet, path, nil)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get(fiber.HeaderRetryAfter) == "" {
+		t.Fatalf("expected to be rate limited with a retry after, got %d", resp.StatusCode)
+	}
+
+	// Limits are per identity
+	app.expect(http.StatusNotFound, "bob", http.MethodGet, path, nil, nil)
+}
@@ -0,0 +1,67 @@
+package coldmfa
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+// fingerprintKeyName is the instance key that code fingerprints are keyed with. It's generated on first use, so that
+// a fingerprint that leaks, for example in an audit event or log, can't be used to confirm a guessed secret.
+const fingerprintKeyName = "code_fingerprint"
+
+// Fingerprint is a keyed hash of everything that determines the passcodes of a key, so that the same code has the same
+// fingerprint however its URL was formatted. The type is included so that a totp and an hotp key with the same secret
+// are different codes, and the counter because it's where an hotp key's passcodes start.
+func (k *OtpKey) Fingerprint(hmacKey []byte) (string, error) {
+	// The secret is hashed as bytes, because base32 strings that differ in their unused trailing bits decode the same
+	secret, err := decodeSecret(k.Secret)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(secret)
+	mac.Write([]byte("\n" + k.Type + "\n" + k.Algorithm + "\n" + strconv.Itoa(k.Digits) + "\n" +
+		strconv.FormatUint(uint64(k.Period), 10) + "\n" + strconv.FormatUint(k.Counter, 10)))
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// fingerprintKey reads the key for code fingerprints from the store, creating it the first time. It isn't read when
+// the app is prepared because the store may not be migrated yet.
+func (a *App) fingerprintKey(ctx context.Context) ([]byte, error) {
+	a.fingerprintMu.Lock()
+	defer a.fingerprintMu.Unlock()
+
+	if a.fingerprintHmacKey != nil {
+		return a.fingerprintHmacKey, nil
+	}
+
+	generated := make([]byte, 32)
+	_, err := rand.Read(generated)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := a.Store.GetInstanceKey(ctx, fingerprintKeyName, generated)
+	if err != nil {
+		return nil, err
+	}
+	a.fingerprintHmacKey = key
+
+	return key, nil
+}
+
+// fingerprint computes the fingerprint of a key with the app's fingerprint key.
+func (a *App) fingerprint(ctx context.Context, key *OtpKey) (string, error) {
+	hmacKey, err := a.fingerprintKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return key.Fingerprint(hmacKey)
+}
@@ -0,0 +1,56 @@
+package coldmfa
+
+import (
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	hmacKey := []byte("test fingerprint key")
+	fingerprint := func(raw string, hmacKey []byte) string {
+		t.Helper()
+
+		fingerprint, err := mustParseOtpKey(t, raw).Fingerprint(hmacKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fingerprint
+	}
+
+	expected := fingerprint(testOriginal, hmacKey)
+
+	same := []string{
+		"otpauth://totp/Example%3Aalice%40example.com?secret=jbsw%20y3dp%20ehpk%203pxp&issuer=Example",
+		"otpauth://totp/Renamed:bob?secret=JBSWY3DPEHPK3PXP&algorithm=sha1&digits=6&period=30",
+		"otpauth://TOTP/bob?secret=JBSWY3DPEHPK3PXP====",
+	}
+	for _, raw := range same {
+		if actual := fingerprint(raw, hmacKey); actual != expected {
+			t.Errorf("expected %s to have the fingerprint of %s", raw, testOriginal)
+		}
+	}
+
+	different := []string{
+		testOtherOriginal,
+		"otpauth://totp/Example:alice@example.com?secret=JBSWY3DPEHPK3PXP&period=60",
+		"otpauth://totp/Example:alice@example.com?secret=JBSWY3DPEHPK3PXP&digits=8",
+		"otpauth://totp/Example:alice@example.com?secret=JBSWY3DPEHPK3PXP&algorithm=SHA256",
+	}
+	for _, raw := range different {
+		if actual := fingerprint(raw, hmacKey); actual == expected {
+			t.Errorf("expected %s to have a different fingerprint to %s", raw, testOriginal)
+		}
+	}
+
+	// The type and counter determine the passcodes of an hotp key as well
+	hotp := fingerprint("otpauth://hotp/Example:alice@example.com?secret=JBSWY3DPEHPK3PXP&counter=0", hmacKey)
+	if hotp == expected {
+		t.Errorf("expected an hotp key to have a different fingerprint to the totp key with the same secret")
+	}
+	if actual := fingerprint("otpauth://hotp/Example:alice@example.com?secret=JBSWY3DPEHPK3PXP&counter=1", hmacKey); actual == hotp {
+		t.Errorf("expected hotp keys with different counters to have different fingerprints")
+	}
+
+	if actual := fingerprint(testOriginal, []byte("other fingerprint key")); actual == expected {
+		t.Error("expected the fingerprint to depend on the key")
+	}
+}
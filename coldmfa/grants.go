@@ -0,0 +1,209 @@
+package coldmfa
+
+import (
+	"errors"
+	"github.com/EphyraSoftware/locus/auth"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultGrantDuration is used when a grant is created without an expiry
+	defaultGrantDuration = 24 * time.Hour
+	// maxGrantDuration limits how long passcode access can be delegated for without being renewed
+	maxGrantDuration = 90 * 24 * time.Hour
+)
+
+func (a *App) prepareGrants(api fiber.Router, store Store) {
+	api.Get("/grants", func(c *fiber.Ctx) error {
+		sessionId := auth.SessionId(c)
+		if sessionId == "" {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		out, err := store.ListGrantedCodes(c.UserContext(), sessionId)
+		if err != nil {
+			log.Errorf("failed to query grants: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+
+		return c.Status(http.StatusOK).JSON(out)
+	})
+
+	api.Get("/groups/:groupId/codes/:codeId/grants", func(c *fiber.Ctx) error {
+		sessionId := auth.SessionId(c)
+		if sessionId == "" {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		groupId := c.Params("groupId")
+		if groupId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing groupId"})
+		}
+
+		codeId := c.Params("codeId")
+		if codeId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing codeId"})
+		}
+
+		member, err := requireRole(c, store, sessionId, groupId, RoleEditor)
+		if member == nil {
+			return err
+		}
+
+		out, err := store.ListCodeGrants(c.UserContext(), groupId, codeId)
+		if err != nil {
+			log.Errorf("failed to query grants: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+
+		return c.Status(http.StatusOK).JSON(out)
+	})
+
+	api.Post("/groups/:groupId/codes/:codeId/grants", func(c *fiber.Ctx) error {
+		sessionId := auth.SessionId(c)
+		if sessionId == "" {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		groupId := c.Params("groupId")
+		if groupId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing groupId"})
+		}
+
+		codeId := c.Params("codeId")
+		if codeId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing codeId"})
+		}
+
+		grantRequest := new(CreateGrantRequest)
+		if err := c.BodyParser(grantRequest); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid request"})
+		}
+
+		email := strings.TrimSpace(grantRequest.Email)
+		if email == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing email"})
+		}
+
+		now := time.Now()
+		expiresAt := now.Add(defaultGrantDuration)
+		if grantRequest.ExpiresAt != nil {
+			expiresAt = *grantRequest.ExpiresAt
+		}
+		if !expiresAt.After(now) {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "expiry must be in the future"})
+		}
+		if expiresAt.Sub(now) > maxGrantDuration {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "expiry is too far in the future"})
+		}
+
+		member, err := requireRole(c, store, sessionId, groupId, RoleEditor)
+		if member == nil {
+			return err
+		}
+
+		code, err := store.GetCode(c.UserContext(), groupId, codeId)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			log.Errorf("failed to read code: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+		if code == nil || code.Deleted {
+			return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code not found"})
+		}
+
+		identity, err := a.Identities.ResolveEmail(c.UserContext(), email)
+		if err != nil {
+			if errors.Is(err, auth.ErrIdentityNotFound) {
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "user not found"})
+			}
+
+			log.Errorf("failed to resolve identity: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+		}
+
+		if identity.Id == sessionId {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "cannot grant access to yourself"})
+		}
+
+		grantId, err := gonanoid.New()
+		if err != nil {
+			log.Errorf("failed to generate grant id: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+		}
+
+		event, err := newAuditEvent(c, AuditGrantCreated, groupId, codeId, map[string]interface{}{"grantId": grantId, "granteeId": identity.Id, "expiresAt": expiresAt.UTC()})
+		if err != nil {
+			log.Errorf("failed to prepare audit event: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+		}
+
+		grant, err := store.CreateGrant(c.UserContext(), groupId, codeId, CodeGrant{
+			GrantId:      grantId,
+			GranteeId:    identity.Id,
+			GranteeEmail: nullableString(identity.Email),
+			GrantedBy:    sessionId,
+			ExpiresAt:    expiresAt,
+		}, event)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				// The code was deleted since it was checked
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code not found"})
+			}
+
+			log.Errorf("failed to insert grant: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+
+		return c.Status(http.StatusCreated).JSON(grant)
+	})
+
+	api.Delete("/groups/:groupId/codes/:codeId/grants/:grantId", func(c *fiber.Ctx) error {
+		sessionId := auth.SessionId(c)
+		if sessionId == "" {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		groupId := c.Params("groupId")
+		if groupId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing groupId"})
+		}
+
+		codeId := c.Params("codeId")
+		if codeId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing codeId"})
+		}
+
+		grantId := c.Params("grantId")
+		if grantId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing grantId"})
+		}
+
+		member, err := requireRole(c, store, sessionId, groupId, RoleEditor)
+		if member == nil {
+			return err
+		}
+
+		event, err := newAuditEvent(c, AuditGrantRevoked, groupId, codeId, map[string]interface{}{"grantId": grantId})
+		if err != nil {
+			log.Errorf("failed to prepare audit event: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+		}
+
+		err = store.RevokeGrant(c.UserContext(), groupId, codeId, grantId, sessionId, event)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "grant not found"})
+			}
+
+			log.Errorf("failed to revoke grant: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+
+		return c.SendStatus(http.StatusNoContent)
+	})
+}
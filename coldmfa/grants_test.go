@@ -0,0 +1,56 @@
+package coldmfa
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGrants(t *testing.T) {
+	app := newTestApp(t)
+	group := app.createGroup("alice", "Personal")
+	code := app.createCode("alice", group.GroupId, testOriginal)
+	codePath := "/groups/" + group.GroupId + "/codes/" + code.CodeId
+	path := codePath + "/grants"
+
+	app.expect(http.StatusNotFound, "bob", http.MethodGet, codePath, nil, nil)
+
+	var grant CodeGrant
+	app.expect(http.StatusCreated, "alice", http.MethodPost, path, CreateGrantRequest{Email: "bob@example.com"}, &grant)
+	if grant.GranteeId != "bob" || grant.GrantedBy != "alice" || !grant.ExpiresAt.After(time.Now()) {
+		t.Fatalf("unexpected grant %+v", grant)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	app.expect(http.StatusBadRequest, "alice", http.MethodPost, path, CreateGrantRequest{Email: "bob@example.com", ExpiresAt: &past}, nil)
+	app.expect(http.StatusBadRequest, "alice", http.MethodPost, path, CreateGrantRequest{Email: "alice@example.com"}, nil)
+	app.expect(http.StatusNotFound, "alice", http.MethodPost, "/groups/"+group.GroupId+"/codes/missing/grants", CreateGrantRequest{Email: "bob@example.com"}, nil)
+	app.expect(http.StatusNotFound, "bob", http.MethodPost, path, CreateGrantRequest{Email: "carol@example.com"}, nil)
+
+	var grants []CodeGrant
+	app.expect(http.StatusOK, "alice", http.MethodGet, path, nil, &grants)
+	if len(grants) != 1 || grants[0].GrantId != grant.GrantId {
+		t.Fatalf("expected the grant to be listed, got %+v", grants)
+	}
+
+	var granted []GrantedCode
+	app.expect(http.StatusOK, "bob", http.MethodGet, "/grants", nil, &granted)
+	if len(granted) != 1 || granted[0].CodeId != code.CodeId || granted[0].GroupId != group.GroupId {
+		t.Fatalf("expected the code to be shared, got %+v", granted)
+	}
+
+	// A grant only allows generating passcodes
+	var passcode CodeSummary
+	app.expect(http.StatusOK, "bob", http.MethodGet, codePath, nil, &passcode)
+	app.expect(http.StatusNotFound, "bob", http.MethodGet, codePath+"/qr", nil, nil)
+	app.expect(http.StatusNotFound, "bob", http.MethodGet, "/groups/"+group.GroupId, nil, nil)
+
+	app.expect(http.StatusNoContent, "alice", http.MethodDelete, path+"/"+grant.GrantId, nil, nil)
+	app.expect(http.StatusNotFound, "alice", http.MethodDelete, path+"/"+grant.GrantId, nil, nil)
+	app.expect(http.StatusNotFound, "bob", http.MethodGet, codePath, nil, nil)
+
+	app.expect(http.StatusOK, "bob", http.MethodGet, "/grants", nil, &granted)
+	if len(granted) != 0 {
+		t.Fatalf("expected no shared codes after revoking, got %+v", granted)
+	}
+}
@@ -0,0 +1,66 @@
+package coldmfa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/EphyraSoftware/locus/health"
+)
+
+// HealthChecks returns the readiness checks for the database that this app depends on. The checks are only
+// meaningful once the app has been prepared.
+func (a *App) HealthChecks() []health.Check {
+	return []health.Check{
+		{Name: "database", Check: a.checkDatabase},
+		{Name: "migrations", Check: a.checkMigrations},
+		{Name: "startup", Check: a.checkStarted},
+	}
+}
+
+func (a *App) checkStarted(_ context.Context) error {
+	select {
+	case <-a.Started():
+		return nil
+	default:
+		return errors.New("database hasn't been prepared yet")
+	}
+}
+
+func (a *App) checkDatabase(ctx context.Context) error {
+	if a.Store == nil {
+		return errors.New("database not configured")
+	}
+
+	return a.Store.Ping(ctx)
+}
+
+func (a *App) checkMigrations(ctx context.Context) error {
+	if a.Store == nil {
+		return errors.New("database not configured")
+	}
+	if a.db == nil {
+		// The store was provided rather than opened by the app, so it isn't migrated by the app either
+		return nil
+	}
+
+	expected, err := latestMigrationVersion(a.DatabaseUrl)
+	if err != nil {
+		return err
+	}
+
+	var version uint
+	var dirty bool
+	err = a.db.QueryRowContext(ctx, "select version, dirty from schema_migrations limit 1").Scan(&version, &dirty)
+	if err != nil {
+		return fmt.Errorf("failed to read migration version: %w", err)
+	}
+
+	if dirty {
+		return fmt.Errorf("migration %d is dirty", version)
+	}
+	if version != expected {
+		return fmt.Errorf("database is at version %d, expected %d", version, expected)
+	}
+
+	return nil
+}
@@ -0,0 +1,261 @@
+package coldmfa
+
+import (
+	"context"
+	"errors"
+	"github.com/EphyraSoftware/locus/auth"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"net/http"
+	"strings"
+)
+
+type Role string
+
+const (
+	RoleViewer Role = "viewer"
+	RoleEditor Role = "editor"
+	RoleOwner  Role = "owner"
+)
+
+var roleRank = map[Role]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleOwner:  3,
+}
+
+func (r Role) valid() bool {
+	_, ok := roleRank[r]
+	return ok
+}
+
+// can checks whether this role grants at least the permissions of the required role.
+func (r Role) can(required Role) bool {
+	return roleRank[r] >= roleRank[required]
+}
+
+// requireRole checks that the identity is a member of the group with at least the required role. If it isn't then the
+// error response has already been sent and the returned membership is nil.
+func requireRole(c *fiber.Ctx, store Store, memberId string, groupId string, required Role) (*Membership, error) {
+	member, status, apiErr := checkRole(c.UserContext(), store, memberId, groupId, required)
+	if apiErr != nil {
+		return nil, c.Status(status).JSON(apiErr)
+	}
+
+	return member, nil
+}
+
+// checkRole is requireRole for callers that respond themselves, returning the status and error to respond with if the
+// identity doesn't have the role.
+func checkRole(ctx context.Context, store Store, memberId string, groupId string, required Role) (*Membership, int, *ApiError) {
+	member, err := store.GetMembership(ctx, memberId, groupId)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, http.StatusNotFound, &ApiError{Error: "group not found"}
+		}
+
+		log.Errorf("failed to read group membership: %s", err.Error())
+		return nil, http.StatusInternalServerError, &ApiError{Error: "database error"}
+	}
+
+	if !member.Role.can(required) {
+		return nil, http.StatusForbidden, &ApiError{Error: "insufficient permissions"}
+	}
+
+	return member, http.StatusOK, nil
+}
+
+func (a *App) prepareMembers(api fiber.Router, store Store) {
+	api.Get("/groups/:groupId/members", func(c *fiber.Ctx) error {
+		sessionId := auth.SessionId(c)
+		if sessionId == "" {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		groupId := c.Params("groupId")
+		if groupId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing groupId"})
+		}
+
+		member, err := requireRole(c, store, sessionId, groupId, RoleViewer)
+		if member == nil {
+			return err
+		}
+
+		out, err := store.ListMembers(c.UserContext(), groupId)
+		if err != nil {
+			log.Errorf("failed to query members: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+
+		return c.Status(http.StatusOK).JSON(out)
+	})
+
+	api.Post("/groups/:groupId/members", func(c *fiber.Ctx) error {
+		sessionId := auth.SessionId(c)
+		if sessionId == "" {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		groupId := c.Params("groupId")
+		if groupId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing groupId"})
+		}
+
+		inviteRequest := new(InviteMemberRequest)
+		if err := c.BodyParser(inviteRequest); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid request"})
+		}
+
+		email := strings.TrimSpace(inviteRequest.Email)
+		if email == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing email"})
+		}
+
+		if !inviteRequest.Role.valid() {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid role"})
+		}
+
+		member, err := requireRole(c, store, sessionId, groupId, RoleOwner)
+		if member == nil {
+			return err
+		}
+
+		identity, err := a.Identities.ResolveEmail(c.UserContext(), email)
+		if err != nil {
+			if errors.Is(err, auth.ErrIdentityNotFound) {
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "user not found"})
+			}
+
+			log.Errorf("failed to resolve identity: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+		}
+
+		event, err := newAuditEvent(c, AuditMemberAdded, groupId, "", map[string]interface{}{"memberId": identity.Id, "role": inviteRequest.Role})
+		if err != nil {
+			log.Errorf("failed to prepare audit event: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+		}
+
+		err = store.AddMember(c.UserContext(), groupId, GroupMember{MemberId: identity.Id, Email: nullableString(identity.Email), Role: inviteRequest.Role}, event)
+		if err != nil {
+			if errors.Is(err, ErrAlreadyExists) {
+				return c.Status(http.StatusConflict).JSON(ApiError{Error: "user is already a member"})
+			}
+
+			log.Errorf("failed to insert member: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+
+		createdMember, err := store.GetMember(c.UserContext(), groupId, identity.Id)
+		if err != nil {
+			log.Errorf("failed to read member: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+
+		return c.Status(http.StatusCreated).JSON(createdMember)
+	})
+
+	api.Put("/groups/:groupId/members/:memberId", func(c *fiber.Ctx) error {
+		sessionId := auth.SessionId(c)
+		if sessionId == "" {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		groupId := c.Params("groupId")
+		if groupId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing groupId"})
+		}
+
+		memberId := c.Params("memberId")
+		if memberId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing memberId"})
+		}
+
+		updateRequest := new(UpdateMemberRequest)
+		if err := c.BodyParser(updateRequest); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid request"})
+		}
+
+		if !updateRequest.Role.valid() {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid role"})
+		}
+
+		member, err := requireRole(c, store, sessionId, groupId, RoleOwner)
+		if member == nil {
+			return err
+		}
+
+		if memberId == member.CreatorId {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "cannot change the role of the group creator"})
+		}
+
+		event, err := newAuditEvent(c, AuditMemberRoleChanged, groupId, "", map[string]interface{}{"memberId": memberId, "role": updateRequest.Role})
+		if err != nil {
+			log.Errorf("failed to prepare audit event: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+		}
+
+		err = store.UpdateMemberRole(c.UserContext(), groupId, memberId, updateRequest.Role, event)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "member not found"})
+			}
+
+			log.Errorf("failed to update member: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+
+		return c.SendStatus(http.StatusNoContent)
+	})
+
+	api.Delete("/groups/:groupId/members/:memberId", func(c *fiber.Ctx) error {
+		sessionId := auth.SessionId(c)
+		if sessionId == "" {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		groupId := c.Params("groupId")
+		if groupId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing groupId"})
+		}
+
+		memberId := c.Params("memberId")
+		if memberId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing memberId"})
+		}
+
+		// Any member may leave a group, but only owners can remove other members
+		required := RoleOwner
+		if memberId == sessionId {
+			required = RoleViewer
+		}
+
+		member, err := requireRole(c, store, sessionId, groupId, required)
+		if member == nil {
+			return err
+		}
+
+		if memberId == member.CreatorId {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "cannot remove the group creator"})
+		}
+
+		event, err := newAuditEvent(c, AuditMemberRemoved, groupId, "", map[string]interface{}{"memberId": memberId})
+		if err != nil {
+			log.Errorf("failed to prepare audit event: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+		}
+
+		err = store.RemoveMember(c.UserContext(), groupId, memberId, event)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "member not found"})
+			}
+
+			log.Errorf("failed to remove member: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+
+		return c.SendStatus(http.StatusNoContent)
+	})
+}
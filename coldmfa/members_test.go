@@ -0,0 +1,48 @@
+package coldmfa
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMembers(t *testing.T) {
+	app := newTestApp(t)
+	group := app.createGroup("alice", "Personal")
+	code := app.createCode("alice", group.GroupId, testOriginal)
+	path := "/groups/" + group.GroupId + "/members"
+
+	var member GroupMember
+	app.expect(http.StatusCreated, "alice", http.MethodPost, path, InviteMemberRequest{Email: "bob@example.com", Role: RoleViewer}, &member)
+	if member.MemberId != "bob" || member.Role != RoleViewer || member.Creator {
+		t.Fatalf("unexpected member %+v", member)
+	}
+	app.expect(http.StatusConflict, "alice", http.MethodPost, path, InviteMemberRequest{Email: "bob@example.com", Role: RoleEditor}, nil)
+	app.expect(http.StatusNotFound, "alice", http.MethodPost, path, InviteMemberRequest{Email: "bob@elsewhere.com", Role: RoleViewer}, nil)
+	app.expect(http.StatusBadRequest, "alice", http.MethodPost, path, InviteMemberRequest{Email: "carol@example.com", Role: "admin"}, nil)
+
+	var members []GroupMember
+	app.expect(http.StatusOK, "bob", http.MethodGet, path, nil, &members)
+	if len(members) != 2 {
+		t.Fatalf("expected 2 members, got %+v", members)
+	}
+
+	// Viewers can generate passcodes but not change the group or reveal secrets
+	var passcode CodeSummary
+	app.expect(http.StatusOK, "bob", http.MethodGet, "/groups/"+group.GroupId+"/codes/"+code.CodeId, nil, &passcode)
+	app.expect(http.StatusForbidden, "bob", http.MethodPost, "/groups/"+group.GroupId+"/codes", CreateCode{Original: testOtherOriginal}, nil)
+	app.expect(http.StatusForbidden, "bob", http.MethodGet, "/groups/"+group.GroupId+"/codes/"+code.CodeId+"/qr", nil, nil)
+	app.expect(http.StatusForbidden, "bob", http.MethodPost, path, InviteMemberRequest{Email: "carol@example.com", Role: RoleViewer}, nil)
+	app.expect(http.StatusNotFound, "carol", http.MethodGet, path, nil, nil)
+
+	app.expect(http.StatusNoContent, "alice", http.MethodPut, path+"/bob", UpdateMemberRequest{Role: RoleEditor}, nil)
+	app.createCode("bob", group.GroupId, testOtherOriginal)
+
+	app.expect(http.StatusBadRequest, "alice", http.MethodPut, path+"/alice", UpdateMemberRequest{Role: RoleViewer}, nil)
+	app.expect(http.StatusNotFound, "alice", http.MethodPut, path+"/carol", UpdateMemberRequest{Role: RoleViewer}, nil)
+	app.expect(http.StatusBadRequest, "alice", http.MethodDelete, path+"/alice", nil, nil)
+
+	// Members can leave a group without being an owner
+	app.expect(http.StatusNoContent, "bob", http.MethodDelete, path+"/bob", nil, nil)
+	app.expect(http.StatusNotFound, "bob", http.MethodGet, "/groups/"+group.GroupId, nil, nil)
+	app.expect(http.StatusNotFound, "alice", http.MethodDelete, path+"/bob", nil, nil)
+}
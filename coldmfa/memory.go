@@ -0,0 +1,1332 @@
+package coldmfa
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryGroup struct {
+	id        int
+	ownerId   string
+	groupId   string
+	name      string
+	createdAt time.Time
+}
+
+type memoryMember struct {
+	id        int
+	groupId   int
+	memberId  string
+	email     *string
+	role      Role
+	createdAt time.Time
+	sortOrder *int
+}
+
+type memoryCode struct {
+	id            int
+	groupId       int
+	codeId        string
+	original      string
+	name          string
+	preferredName *string
+	issuer        *string
+	account       *string
+	fingerprint   *string
+	createdAt     time.Time
+	deleted       bool
+	deletedAt     *time.Time
+	metadata      CodeMetadata
+}
+
+type memoryPreference struct {
+	memberId  string
+	codeId    int
+	sortOrder *int
+	favorite  bool
+}
+
+type memoryGrant struct {
+	id           int
+	grantId      string
+	codeId       int
+	granteeId    string
+	granteeEmail *string
+	grantedBy    string
+	createdAt    time.Time
+	expiresAt    time.Time
+	revokedAt    *time.Time
+	revokedBy    *string
+}
+
+// MemoryStore is a Store that keeps everything in memory, for tests and for trying out the app without a database. It
+// enforces the same uniqueness constraints as the database schema. It keeps the strings that it is given, so fiber must be
+// configured to be Immutable when using it.
+type MemoryStore struct {
+	mu sync.Mutex
+	// now is the clock used for created and deleted times, which tests can replace
+	now func() time.Time
+
+	nextId      int
+	groups      []*memoryGroup
+	members     []*memoryMember
+	codes       []*memoryCode
+	preferences []*memoryPreference
+	grants      []*memoryGrant
+	lastBackups map[string]time.Time
+	auditEvents []AuditEvent
+	// instanceKeys isn't rolled back by RestoreBackup, because restoring never adds to it
+	instanceKeys map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		now:          func() time.Time { return time.Now().UTC() },
+		lastBackups:  make(map[string]time.Time),
+		instanceKeys: make(map[string][]byte),
+	}
+}
+
+func (s *MemoryStore) id() int {
+	s.nextId++
+	return s.nextId
+}
+
+func (s *MemoryStore) findGroup(groupId string) *memoryGroup {
+	for _, group := range s.groups {
+		if group.groupId == groupId {
+			return group
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) findGroupById(id int) *memoryGroup {
+	for _, group := range s.groups {
+		if group.id == id {
+			return group
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) findMember(groupId int, memberId string) *memoryMember {
+	for _, member := range s.members {
+		if member.groupId == groupId && member.memberId == memberId {
+			return member
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) findCode(groupId string, codeId string) *memoryCode {
+	group := s.findGroup(groupId)
+	if group == nil {
+		return nil
+	}
+
+	for _, code := range s.codes {
+		if code.groupId == group.id && code.codeId == codeId {
+			return code
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) findCodeById(id int) *memoryCode {
+	for _, code := range s.codes {
+		if code.id == id {
+			return code
+		}
+	}
+	return nil
+}
+
+// codeConflicts checks the uniqueness constraints of a code within a group, ignoring the code itself.
+func (s *MemoryStore) codeConflicts(code *memoryCode, groupId int) bool {
+	for _, other := range s.codes {
+		if other.id == code.id || other.groupId != groupId {
+			continue
+		}
+		if other.codeId == code.codeId || other.original == code.original {
+			return true
+		}
+		if code.preferredName != nil && other.preferredName != nil && *other.preferredName == *code.preferredName {
+			return true
+		}
+	}
+	return false
+}
+
+// findPreference finds what the member has chosen for a code, adding an empty preference if add is true and there
+// isn't one yet.
+func (s *MemoryStore) findPreference(memberId string, codeId int, add bool) *memoryPreference {
+	for _, preference := range s.preferences {
+		if preference.memberId == memberId && preference.codeId == codeId {
+			return preference
+		}
+	}
+	if !add {
+		return nil
+	}
+
+	preference := &memoryPreference{memberId: memberId, codeId: codeId}
+	s.preferences = append(s.preferences, preference)
+	return preference
+}
+
+// memberSummary summarizes a code for a member, including whether they have pinned it.
+func (s *MemoryStore) memberSummary(code *memoryCode, memberId string) CodeSummary {
+	summary := code.summary()
+	if preference := s.findPreference(memberId, code.id, false); preference != nil {
+		summary.Favorite = preference.favorite
+	}
+	return summary
+}
+
+// codeSortOrder is the member's position for a code, if they have given it one.
+func (s *MemoryStore) codeSortOrder(memberId string, codeId int) *int {
+	if preference := s.findPreference(memberId, codeId, false); preference != nil {
+		return preference.sortOrder
+	}
+	return nil
+}
+
+// inOrder compares two items by a member's order, putting items that they have ordered first and then the rest oldest
+// first, like the order by of the database stores.
+func inOrder(order *int, id int, otherOrder *int, otherId int) bool {
+	if (order == nil) != (otherOrder == nil) {
+		return order != nil
+	}
+	if order != nil && *order != *otherOrder {
+		return *order < *otherOrder
+	}
+	return id < otherId
+}
+
+func (s *MemoryStore) addGroup(ownerId string, groupId string, name string) (*memoryGroup, error) {
+	for _, group := range s.groups {
+		if group.ownerId == ownerId && (group.groupId == groupId || group.name == name) {
+			return nil, ErrAlreadyExists
+		}
+	}
+
+	group := &memoryGroup{id: s.id(), ownerId: ownerId, groupId: groupId, name: name, createdAt: s.now()}
+	s.groups = append(s.groups, group)
+	return group, nil
+}
+
+func (s *MemoryStore) addMember(groupId int, memberId string, email *string, role Role) error {
+	if s.findMember(groupId, memberId) != nil {
+		return ErrAlreadyExists
+	}
+
+	s.members = append(s.members, &memoryMember{id: s.id(), groupId: groupId, memberId: memberId, email: email, role: role, createdAt: s.now()})
+	return nil
+}
+
+func (s *MemoryStore) Ping(_ context.Context) error {
+	return nil
+}
+
+func (s *MemoryStore) ListGroups(_ context.Context, memberId string) ([]CodeGroup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members := s.memberships(memberId)
+	out := make([]CodeGroup, 0, len(members))
+	for _, member := range members {
+		group := s.findGroupById(member.groupId)
+		out = append(out, CodeGroup{GroupId: group.groupId, Name: group.name, Role: member.role})
+	}
+
+	return out, nil
+}
+
+// memberships finds the memberships of an identity, in its order of the groups.
+func (s *MemoryStore) memberships(memberId string) []*memoryMember {
+	members := make([]*memoryMember, 0)
+	for _, member := range s.members {
+		if member.memberId == memberId {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return inOrder(members[i].sortOrder, members[i].groupId, members[j].sortOrder, members[j].groupId)
+	})
+	return members
+}
+
+func (s *MemoryStore) GetGroup(_ context.Context, memberId string, groupId string) (*CodeGroup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group := s.findGroup(groupId)
+	if group == nil {
+		return nil, ErrNotFound
+	}
+	member := s.findMember(group.id, memberId)
+	if member == nil {
+		return nil, ErrNotFound
+	}
+
+	return &CodeGroup{GroupId: group.groupId, Name: group.name, Role: member.role}, nil
+}
+
+func (s *MemoryStore) CreateGroup(_ context.Context, creatorId string, creatorEmail *string, groupId string, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, err := s.addGroup(creatorId, groupId, name)
+	if err != nil {
+		return err
+	}
+
+	return s.addMember(group.id, creatorId, creatorEmail, RoleOwner)
+}
+
+func (s *MemoryStore) GetMembership(_ context.Context, memberId string, groupId string) (*Membership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group := s.findGroup(groupId)
+	if group == nil {
+		return nil, ErrNotFound
+	}
+	member := s.findMember(group.id, memberId)
+	if member == nil {
+		return nil, ErrNotFound
+	}
+
+	return &Membership{GroupId: group.groupId, CreatorId: group.ownerId, Role: member.role}, nil
+}
+
+func (c *memoryCode) summary() CodeSummary {
+	return CodeSummary{
+		CodeId:        c.codeId,
+		Name:          c.name,
+		PreferredName: c.preferredName,
+		Issuer:        c.issuer,
+		Account:       c.account,
+		CreatedAt:     c.createdAt,
+		Deleted:       c.deleted,
+		DeletedAt:     c.deletedAt,
+		CodeMetadata:  c.copyMetadata(),
+	}
+}
+
+// copyMetadata copies the metadata so that the tags can't be changed through a summary.
+func (c *memoryCode) copyMetadata() CodeMetadata {
+	metadata := c.metadata
+	metadata.Tags = append(make([]string, 0, len(c.metadata.Tags)), c.metadata.Tags...)
+	return metadata
+}
+
+func (s *MemoryStore) ReorderGroups(_ context.Context, memberId string, groupIds []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Every group is found before anything changes, so a missing group leaves the order as it was
+	ordered := make([]*memoryMember, 0, len(groupIds))
+	for _, groupId := range groupIds {
+		group := s.findGroup(groupId)
+		if group == nil {
+			return ErrNotFound
+		}
+		member := s.findMember(group.id, memberId)
+		if member == nil {
+			return ErrNotFound
+		}
+		ordered = append(ordered, member)
+	}
+
+	for _, member := range s.members {
+		if member.memberId == memberId {
+			member.sortOrder = nil
+		}
+	}
+	for i, member := range ordered {
+		position := i
+		member.sortOrder = &position
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) ListCodes(_ context.Context, memberId string, groupId string) ([]CodeSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]CodeSummary, 0)
+	group := s.findGroup(groupId)
+	if group == nil {
+		return out, nil
+	}
+
+	codes := s.groupCodes(group.id)
+	s.sortCodes(memberId, codes)
+	for _, code := range codes {
+		out = append(out, s.memberSummary(code, memberId))
+	}
+
+	return out, nil
+}
+
+func (s *MemoryStore) groupCodes(groupId int) []*memoryCode {
+	codes := make([]*memoryCode, 0)
+	for _, code := range s.codes {
+		if code.groupId == groupId {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
+// sortCodes sorts codes from the same group into the member's order.
+func (s *MemoryStore) sortCodes(memberId string, codes []*memoryCode) {
+	sort.Slice(codes, func(i, j int) bool {
+		return inOrder(s.codeSortOrder(memberId, codes[i].id), codes[i].id, s.codeSortOrder(memberId, codes[j].id), codes[j].id)
+	})
+}
+
+func (s *MemoryStore) GetCode(_ context.Context, groupId string, codeId string) (*CodeSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code := s.findCode(groupId, codeId)
+	if code == nil {
+		return nil, ErrNotFound
+	}
+
+	summary := code.summary()
+	return &summary, nil
+}
+
+func (s *MemoryStore) SearchCodes(_ context.Context, memberId string, search CodeSearch) (*CodeSearchResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	response := &CodeSearchResponse{Codes: make([]CodeSearchResult, 0)}
+	lastId := 0
+	// Codes are appended as they're added, so searching backwards finds the newest first like the database stores
+	for i := len(s.codes) - 1; i >= 0; i-- {
+		code := s.codes[i]
+		group := s.findGroupById(code.groupId)
+		if s.findMember(group.id, memberId) == nil || !code.matches(group, search) {
+			continue
+		}
+
+		if len(response.Codes) == search.Limit {
+			response.NextCursor = codeCursor(int64(lastId))
+			break
+		}
+		response.Codes = append(response.Codes, CodeSearchResult{CodeSummary: s.memberSummary(code, memberId), GroupId: group.groupId, GroupName: group.name})
+		lastId = code.id
+	}
+
+	return response, nil
+}
+
+func (c *memoryCode) matches(group *memoryGroup, search CodeSearch) bool {
+	if search.GroupId != "" && group.groupId != search.GroupId {
+		return false
+	}
+	if search.Deleted != nil && c.deleted != *search.Deleted {
+		return false
+	}
+	if search.CreatedAfter != nil && c.createdAt.Before(*search.CreatedAfter) {
+		return false
+	}
+	if search.CreatedBefore != nil && !c.createdAt.Before(*search.CreatedBefore) {
+		return false
+	}
+	if search.Cursor > 0 && int64(c.id) >= search.Cursor {
+		return false
+	}
+	if !c.metadata.hasTags(search.Tags) {
+		return false
+	}
+
+	text := c.name
+	for _, field := range []*string{c.preferredName, c.issuer, c.account, c.metadata.Notes} {
+		if field != nil {
+			text += " " + *field
+		}
+	}
+	text = strings.ToLower(text)
+	for _, term := range search.Terms {
+		if !strings.Contains(text, strings.ToLower(term)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *MemoryStore) GetCodeOriginal(_ context.Context, groupId string, codeId string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code := s.findCode(groupId, codeId)
+	if code == nil {
+		return "", ErrNotFound
+	}
+
+	return code.original, nil
+}
+
+func (s *MemoryStore) CreateCode(_ context.Context, groupId string, codeId string, original string, key *OtpKey, fingerprint string, event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group := s.findGroup(groupId)
+	if group == nil {
+		return ErrNotFound
+	}
+
+	code := &memoryCode{id: s.id(), groupId: group.id, codeId: codeId, original: original, name: key.Name(), createdAt: s.now()}
+	code.issuer, code.account = keyColumns(key)
+	code.fingerprint = &fingerprint
+	if s.codeConflicts(code, group.id) {
+		return ErrAlreadyExists
+	}
+	if err := s.appendAuditEvent(event); err != nil {
+		return err
+	}
+	s.codes = append(s.codes, code)
+
+	return nil
+}
+
+// findCodeByFingerprint finds the first code with the fingerprint in the groups that the identity is a member of.
+func (s *MemoryStore) findCodeByFingerprint(memberId string, fingerprint string, includeDeleted bool) *CodeLocation {
+	for _, code := range s.codes {
+		if code.fingerprint == nil || *code.fingerprint != fingerprint || (code.deleted && !includeDeleted) {
+			continue
+		}
+		if s.findMember(code.groupId, memberId) == nil {
+			continue
+		}
+
+		return &CodeLocation{GroupId: s.findGroupById(code.groupId).groupId, CodeId: code.codeId}
+	}
+	return nil
+}
+
+func (s *MemoryStore) FindCodeByFingerprint(_ context.Context, memberId string, fingerprint string) (*CodeLocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	location := s.findCodeByFingerprint(memberId, fingerprint, false)
+	if location == nil {
+		return nil, ErrNotFound
+	}
+
+	return location, nil
+}
+
+func (s *MemoryStore) ListUnparsedCodes(_ context.Context) ([]CodeOriginal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]CodeOriginal, 0)
+	for _, code := range s.codes {
+		if code.account == nil || code.fingerprint == nil {
+			group := s.findGroupById(code.groupId)
+			out = append(out, CodeOriginal{GroupId: group.groupId, CodeId: code.codeId, Original: code.original})
+		}
+	}
+
+	return out, nil
+}
+
+func (s *MemoryStore) SetCodeKey(_ context.Context, groupId string, codeId string, key *OtpKey, fingerprint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code := s.findCode(groupId, codeId)
+	if code == nil {
+		return ErrNotFound
+	}
+
+	code.issuer, code.account = keyColumns(key)
+	code.fingerprint = &fingerprint
+
+	return nil
+}
+
+func (s *MemoryStore) setCodePreferredName(groupId string, codeId string, name *string) error {
+	code := s.findCode(groupId, codeId)
+	if code == nil || code.deleted {
+		return ErrNotFound
+	}
+
+	updated := *code
+	updated.preferredName = name
+	if s.codeConflicts(&updated, code.groupId) {
+		return ErrAlreadyExists
+	}
+	code.preferredName = name
+
+	return nil
+}
+
+func (s *MemoryStore) UpdateCode(_ context.Context, groupId string, codeId string, preferredName *string, metadata CodeMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.setCodePreferredName(groupId, codeId, preferredName); err != nil {
+		return err
+	}
+	s.findCode(groupId, codeId).metadata = metadata
+
+	return nil
+}
+
+func (s *MemoryStore) MoveCode(_ context.Context, groupId string, codeId string, toGroupId string, event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.moveCode(groupId, codeId, toGroupId, event)
+}
+
+func (s *MemoryStore) moveCode(groupId string, codeId string, toGroupId string, event *AuditEvent) error {
+	code := s.findCode(groupId, codeId)
+	if code == nil || code.deleted {
+		return ErrNotFound
+	}
+	toGroup := s.findGroup(toGroupId)
+	if toGroup == nil {
+		return ErrNotFound
+	}
+
+	if s.codeConflicts(code, toGroup.id) {
+		return ErrAlreadyExists
+	}
+	if err := s.appendAuditEvent(event); err != nil {
+		return err
+	}
+	code.groupId = toGroup.id
+
+	return nil
+}
+
+func (s *MemoryStore) ReorderCodes(_ context.Context, memberId string, groupId string, codeIds []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ordered := make([]*memoryCode, 0, len(codeIds))
+	for _, codeId := range codeIds {
+		code := s.findCode(groupId, codeId)
+		if code == nil {
+			return ErrNotFound
+		}
+		ordered = append(ordered, code)
+	}
+
+	if group := s.findGroup(groupId); group != nil {
+		for _, code := range s.groupCodes(group.id) {
+			if preference := s.findPreference(memberId, code.id, false); preference != nil {
+				preference.sortOrder = nil
+			}
+		}
+	}
+	for i, code := range ordered {
+		position := i
+		s.findPreference(memberId, code.id, true).sortOrder = &position
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) SetCodeFavorite(_ context.Context, memberId string, groupId string, codeId string, favorite bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code := s.findCode(groupId, codeId)
+	if code == nil {
+		return ErrNotFound
+	}
+	s.findPreference(memberId, code.id, true).favorite = favorite
+
+	return nil
+}
+
+func (s *MemoryStore) ListFavoriteCodes(_ context.Context, memberId string) ([]CodeSearchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]CodeSearchResult, 0)
+	for _, member := range s.memberships(memberId) {
+		group := s.findGroupById(member.groupId)
+		codes := s.groupCodes(group.id)
+		s.sortCodes(memberId, codes)
+		for _, code := range codes {
+			summary := s.memberSummary(code, memberId)
+			if summary.Favorite && !code.deleted {
+				out = append(out, CodeSearchResult{CodeSummary: summary, GroupId: group.groupId, GroupName: group.name})
+			}
+		}
+	}
+
+	return out, nil
+}
+
+func (s *MemoryStore) DeleteCode(_ context.Context, groupId string, codeId string, event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.deleteCode(groupId, codeId, event)
+}
+
+func (s *MemoryStore) deleteCode(groupId string, codeId string, event *AuditEvent) error {
+	code := s.findCode(groupId, codeId)
+	if code == nil || code.deleted {
+		return ErrNotFound
+	}
+	if err := s.appendAuditEvent(event); err != nil {
+		return err
+	}
+
+	now := s.now()
+	code.deleted = true
+	code.deletedAt = &now
+
+	return nil
+}
+
+// restoreCode restores a deleted code, unless a code with the same fingerprint that isn't deleted is in one of the
+// identity's groups.
+func (s *MemoryStore) restoreCode(memberId string, groupId string, codeId string, event *AuditEvent) error {
+	code := s.findCode(groupId, codeId)
+	if code == nil || !code.deleted {
+		return ErrNotFound
+	}
+
+	if code.fingerprint != nil && s.findCodeByFingerprint(memberId, *code.fingerprint, false) != nil {
+		return ErrAlreadyExists
+	}
+	if err := s.appendAuditEvent(event); err != nil {
+		return err
+	}
+
+	code.deleted = false
+	code.deletedAt = nil
+
+	return nil
+}
+
+func (s *MemoryStore) ApplyCodeOperations(_ context.Context, memberId string, operations []CodeOperation, events []*AuditEvent, bestEffort bool) ([]error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Operations only change existing codes, and each one checks before it changes anything, so a failed operation
+	// doesn't need rolling back but a failed batch is rolled back by restoring copies of the codes and dropping the
+	// events that were appended
+	saved := make([]memoryCode, len(s.codes))
+	for i, code := range s.codes {
+		saved[i] = *code
+	}
+	auditEvents := len(s.auditEvents)
+	rollback := func() {
+		for i, code := range s.codes {
+			*code = saved[i]
+		}
+		s.auditEvents = s.auditEvents[:auditEvents]
+	}
+
+	results := make([]error, len(operations))
+	for i, operation := range operations {
+		var err error
+		switch operation.Op {
+		case CodeOpMove:
+			err = s.moveCode(operation.GroupId, operation.CodeId, operation.ToGroupId, events[i])
+		case CodeOpRename:
+			err = s.setCodePreferredName(operation.GroupId, operation.CodeId, operation.PreferredName)
+			if err == nil {
+				err = s.appendAuditEvent(events[i])
+			}
+		case CodeOpDelete:
+			err = s.deleteCode(operation.GroupId, operation.CodeId, events[i])
+		case CodeOpRestore:
+			err = s.restoreCode(memberId, operation.GroupId, operation.CodeId, events[i])
+		default:
+			err = errors.New("unknown code operation")
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrAlreadyExists) {
+			rollback()
+			return nil, err
+		}
+		results[i] = err
+
+		if err != nil && !bestEffort {
+			rollback()
+			return results, nil
+		}
+	}
+
+	return results, nil
+}
+
+func (s *MemoryStore) groupMember(group *memoryGroup, member *memoryMember) GroupMember {
+	return GroupMember{
+		MemberId:  member.memberId,
+		Email:     member.email,
+		Role:      member.role,
+		Creator:   member.memberId == group.ownerId,
+		CreatedAt: member.createdAt,
+	}
+}
+
+func (s *MemoryStore) ListMembers(_ context.Context, groupId string) ([]GroupMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]GroupMember, 0)
+	group := s.findGroup(groupId)
+	if group == nil {
+		return out, nil
+	}
+
+	// Members are appended in the order they are added, which matches ordering by created time and then id
+	for _, member := range s.members {
+		if member.groupId == group.id {
+			out = append(out, s.groupMember(group, member))
+		}
+	}
+
+	return out, nil
+}
+
+func (s *MemoryStore) GetMember(_ context.Context, groupId string, memberId string) (*GroupMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group := s.findGroup(groupId)
+	if group == nil {
+		return nil, ErrNotFound
+	}
+	member := s.findMember(group.id, memberId)
+	if member == nil {
+		return nil, ErrNotFound
+	}
+
+	groupMember := s.groupMember(group, member)
+	return &groupMember, nil
+}
+
+func (s *MemoryStore) AddMember(_ context.Context, groupId string, member GroupMember, event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group := s.findGroup(groupId)
+	if group == nil {
+		return ErrNotFound
+	}
+	if s.findMember(group.id, member.MemberId) != nil {
+		return ErrAlreadyExists
+	}
+	if err := s.appendAuditEvent(event); err != nil {
+		return err
+	}
+
+	return s.addMember(group.id, member.MemberId, member.Email, member.Role)
+}
+
+func (s *MemoryStore) UpdateMemberRole(_ context.Context, groupId string, memberId string, role Role, event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group := s.findGroup(groupId)
+	if group == nil {
+		return ErrNotFound
+	}
+	member := s.findMember(group.id, memberId)
+	if member == nil {
+		return ErrNotFound
+	}
+	if err := s.appendAuditEvent(event); err != nil {
+		return err
+	}
+	member.role = role
+
+	return nil
+}
+
+func (s *MemoryStore) RemoveMember(_ context.Context, groupId string, memberId string, event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group := s.findGroup(groupId)
+	if group == nil {
+		return ErrNotFound
+	}
+
+	for i, member := range s.members {
+		if member.groupId == group.id && member.memberId == memberId {
+			if err := s.appendAuditEvent(event); err != nil {
+				return err
+			}
+			s.members = append(s.members[:i], s.members[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (g *memoryGrant) active(now time.Time) bool {
+	return g.revokedAt == nil && g.expiresAt.After(now)
+}
+
+func (s *MemoryStore) GetGrantedOriginal(_ context.Context, granteeId string, groupId string, codeId string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code := s.findCode(groupId, codeId)
+	if code == nil || code.deleted {
+		return "", ErrNotFound
+	}
+
+	for _, grant := range s.grants {
+		if grant.codeId == code.id && grant.granteeId == granteeId && grant.active(s.now()) {
+			return code.original, nil
+		}
+	}
+
+	return "", ErrNotFound
+}
+
+func (s *MemoryStore) ListGrantedCodes(_ context.Context, granteeId string) ([]GrantedCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]GrantedCode, 0)
+	for _, grant := range s.grants {
+		if grant.granteeId != granteeId || !grant.active(s.now()) {
+			continue
+		}
+		code := s.findCodeById(grant.codeId)
+		if code.deleted {
+			continue
+		}
+
+		out = append(out, GrantedCode{
+			GrantId:       grant.grantId,
+			GroupId:       s.findGroupById(code.groupId).groupId,
+			CodeId:        code.codeId,
+			Name:          code.name,
+			PreferredName: code.preferredName,
+			GrantedBy:     grant.grantedBy,
+			ExpiresAt:     grant.expiresAt,
+		})
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].ExpiresAt.Before(out[j].ExpiresAt)
+	})
+
+	return out, nil
+}
+
+func (g *memoryGrant) codeGrant() CodeGrant {
+	return CodeGrant{
+		GrantId:      g.grantId,
+		GranteeId:    g.granteeId,
+		GranteeEmail: g.granteeEmail,
+		GrantedBy:    g.grantedBy,
+		CreatedAt:    g.createdAt,
+		ExpiresAt:    g.expiresAt,
+	}
+}
+
+func (s *MemoryStore) ListCodeGrants(_ context.Context, groupId string, codeId string) ([]CodeGrant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]CodeGrant, 0)
+	code := s.findCode(groupId, codeId)
+	if code == nil {
+		return out, nil
+	}
+
+	// Grants are appended in the order they are created
+	for _, grant := range s.grants {
+		if grant.codeId == code.id && grant.active(s.now()) {
+			out = append(out, grant.codeGrant())
+		}
+	}
+
+	return out, nil
+}
+
+func (s *MemoryStore) CreateGrant(_ context.Context, groupId string, codeId string, grant CodeGrant, event *AuditEvent) (*CodeGrant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code := s.findCode(groupId, codeId)
+	if code == nil || code.deleted {
+		return nil, ErrNotFound
+	}
+
+	for _, existing := range s.grants {
+		if existing.grantId == grant.GrantId {
+			return nil, ErrAlreadyExists
+		}
+	}
+	if err := s.appendAuditEvent(event); err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	for _, existing := range s.grants {
+		if existing.codeId == code.id && existing.granteeId == grant.GranteeId && existing.revokedAt == nil {
+			existing.revokedAt = &now
+			existing.revokedBy = &grant.GrantedBy
+		}
+	}
+
+	created := &memoryGrant{
+		id:           s.id(),
+		grantId:      grant.GrantId,
+		codeId:       code.id,
+		granteeId:    grant.GranteeId,
+		granteeEmail: grant.GranteeEmail,
+		grantedBy:    grant.GrantedBy,
+		createdAt:    now,
+		expiresAt:    grant.ExpiresAt.UTC(),
+	}
+	s.grants = append(s.grants, created)
+
+	out := created.codeGrant()
+	return &out, nil
+}
+
+func (s *MemoryStore) RevokeGrant(_ context.Context, groupId string, codeId string, grantId string, revokedBy string, event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code := s.findCode(groupId, codeId)
+	if code == nil {
+		return ErrNotFound
+	}
+
+	for _, grant := range s.grants {
+		if grant.grantId == grantId && grant.codeId == code.id && grant.revokedAt == nil {
+			if err := s.appendAuditEvent(event); err != nil {
+				return err
+			}
+			now := s.now()
+			grant.revokedAt = &now
+			grant.revokedBy = &revokedBy
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (s *MemoryStore) ListBackupItems(_ context.Context, ownerId string) ([]BackupItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items := make([]BackupItem, 0)
+	for _, member := range s.members {
+		if member.memberId != ownerId || member.role != RoleOwner {
+			continue
+		}
+		group := s.findGroupById(member.groupId)
+
+		hasCodes := false
+		for _, code := range s.codes {
+			if code.groupId != group.id {
+				continue
+			}
+			hasCodes = true
+
+			original := code.original
+			name := code.name
+			createdAt := code.createdAt
+			deleted := code.deleted
+			items = append(items, BackupItem{
+				GroupName:     group.name,
+				Original:      &original,
+				CodeName:      &name,
+				PreferredName: code.preferredName,
+				CreatedAt:     &createdAt,
+				Deleted:       &deleted,
+				DeletedAt:     code.deletedAt,
+				CodeMetadata:  code.copyMetadata(),
+			})
+		}
+
+		if !hasCodes {
+			items = append(items, BackupItem{GroupName: group.name})
+		}
+	}
+
+	return items, nil
+}
+
+func (s *MemoryStore) RestoreBackup(_ context.Context, ownerId string, ownerEmail *string, items []RestoreItem, event *AuditEvent) ([]CodeLocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Restoring only appends, so if any item fails then truncating back to the original lengths rolls back, like the
+	// transaction in the database
+	groups, members, codes, nextId := len(s.groups), len(s.members), len(s.codes), s.nextId
+	rollback := func() {
+		s.groups, s.members, s.codes, s.nextId = s.groups[:groups], s.members[:members], s.codes[:codes], nextId
+	}
+	existing := make([]CodeLocation, 0)
+	for _, item := range items {
+		location, err := s.restoreItem(ownerId, ownerEmail, item)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		if location != nil {
+			existing = append(existing, *location)
+		}
+	}
+
+	if err := s.appendAuditEvent(event); err != nil {
+		rollback()
+		return nil, err
+	}
+
+	return existing, nil
+}
+
+// restoreItem restores a backup item, returning the location of the existing code if its code was already present.
+func (s *MemoryStore) restoreItem(ownerId string, ownerEmail *string, item RestoreItem) (*CodeLocation, error) {
+	// Codes are restored into a group with the same name that the identity owns, which is any group in its backups
+	var group *memoryGroup
+	for _, existing := range s.groups {
+		if member := s.findMember(existing.id, ownerId); member != nil && member.role == RoleOwner && existing.name == item.GroupName {
+			group = existing
+			break
+		}
+	}
+	if group == nil {
+		var err error
+		group, err = s.addGroup(ownerId, item.GroupId, item.GroupName)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.addMember(group.id, ownerId, ownerEmail, RoleOwner); err != nil {
+			return nil, err
+		}
+	}
+
+	if item.CodeName == nil {
+		return nil, nil
+	}
+	if item.Original == nil {
+		return nil, errors.New("backup item has a code without an original")
+	}
+
+	if item.Fingerprint != nil {
+		if location := s.findCodeByFingerprint(ownerId, *item.Fingerprint, true); location != nil {
+			return location, nil
+		}
+	}
+	for _, existing := range s.codes {
+		if existing.groupId == group.id && existing.original == *item.Original {
+			return nil, nil
+		}
+	}
+
+	code := &memoryCode{
+		id:            s.id(),
+		groupId:       group.id,
+		codeId:        item.CodeId,
+		original:      *item.Original,
+		name:          *item.CodeName,
+		preferredName: item.PreferredName,
+		createdAt:     s.now(),
+		deletedAt:     item.DeletedAt,
+		metadata:      item.CodeMetadata,
+	}
+	code.issuer, code.account = keyColumns(item.Key)
+	code.fingerprint = item.Fingerprint
+	if item.CreatedAt != nil {
+		code.createdAt = *item.CreatedAt
+	}
+	if item.Deleted != nil {
+		code.deleted = *item.Deleted
+	}
+
+	if s.codeConflicts(code, group.id) {
+		return nil, ErrAlreadyExists
+	}
+	s.codes = append(s.codes, code)
+
+	return nil, nil
+}
+
+func (s *MemoryStore) GetInstanceKey(_ context.Context, name string, generated []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.instanceKeys[name]; ok {
+		return key, nil
+	}
+	s.instanceKeys[name] = generated
+
+	return generated, nil
+}
+
+func (s *MemoryStore) RecordBackup(_ context.Context, ownerId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastBackups[ownerId] = s.now()
+	return nil
+}
+
+// codesSince counts the codes, including deleted codes unless onlyActive is set, in groups that the identity owns which
+// were created after the given time.
+func (s *MemoryStore) codesSince(ownerId string, since *time.Time, onlyActive bool) int {
+	count := 0
+	for _, member := range s.members {
+		if member.memberId != ownerId || member.role != RoleOwner {
+			continue
+		}
+		for _, code := range s.codes {
+			if code.groupId != member.groupId || (onlyActive && code.deleted) {
+				continue
+			}
+			if since == nil || code.createdAt.After(*since) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func (s *MemoryStore) GetBackupWarning(_ context.Context, ownerId string) (*BackupWarning, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var warning BackupWarning
+	if backupAt, ok := s.lastBackups[ownerId]; ok {
+		warning.LastBackupAt = &backupAt
+		warning.NumberNotBackedUp = s.codesSince(ownerId, &backupAt, false)
+	}
+
+	return &warning, nil
+}
+
+func (s *MemoryStore) CountBackupOverdue(_ context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	owners := make(map[string]bool)
+	for _, member := range s.members {
+		if member.role == RoleOwner {
+			owners[member.memberId] = true
+		}
+	}
+
+	overdue := 0
+	for ownerId := range owners {
+		var since *time.Time
+		if backupAt, ok := s.lastBackups[ownerId]; ok {
+			since = &backupAt
+		}
+		if s.codesSince(ownerId, since, true) > 0 {
+			overdue++
+		}
+	}
+
+	return overdue, nil
+}
+
+func (s *MemoryStore) AppendAuditEvent(_ context.Context, event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.appendAuditEvent(event)
+}
+
+// appendAuditEvent appends the event, if there is one. Callers append it once nothing can stop their change, or roll
+// the change back if the append fails, so that the change and its event are made together. The lock must be held.
+func (s *MemoryStore) appendAuditEvent(event *AuditEvent) error {
+	if event == nil {
+		return nil
+	}
+
+	lastSequence := int64(0)
+	lastHash := auditGenesisHash
+	for _, existing := range s.auditEvents {
+		if existing.OwnerId == event.OwnerId && existing.Sequence > lastSequence {
+			lastSequence = existing.Sequence
+			lastHash = existing.Hash
+		}
+	}
+
+	if err := chainAuditEvent(event, lastSequence, lastHash, s.now()); err != nil {
+		return err
+	}
+	event.Id = int64(s.id())
+	s.auditEvents = append(s.auditEvents, *event)
+
+	return nil
+}
+
+// listAuditEvents lists matching events with an id less than before, newest first.
+func (s *MemoryStore) listAuditEvents(match func(event *AuditEvent) bool, before int64, limit int) []AuditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]AuditEvent, 0)
+	for i := len(s.auditEvents) - 1; i >= 0 && len(out) < limit; i-- {
+		event := &s.auditEvents[i]
+		if event.Id < before && match(event) {
+			out = append(out, *event)
+		}
+	}
+
+	return out
+}
+
+func (s *MemoryStore) ListAuditEvents(_ context.Context, ownerId string, before int64, limit int) ([]AuditEvent, error) {
+	return s.listAuditEvents(func(event *AuditEvent) bool {
+		return event.OwnerId == ownerId
+	}, before, limit), nil
+}
+
+func (s *MemoryStore) ListGroupAuditEvents(_ context.Context, groupId string, before int64, limit int) ([]AuditEvent, error) {
+	return s.listAuditEvents(func(event *AuditEvent) bool {
+		return event.GroupId != nil && *event.GroupId == groupId
+	}, before, limit), nil
+}
+
+func (s *MemoryStore) ListAuditEventsAfter(_ context.Context, ownerId string, sequence int64, limit int) ([]AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]AuditEvent, 0)
+	for _, event := range s.auditEvents {
+		if event.OwnerId > ownerId || (event.OwnerId == ownerId && event.Sequence > sequence) {
+			out = append(out, event)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].OwnerId != out[j].OwnerId {
+			return out[i].OwnerId < out[j].OwnerId
+		}
+		return out[i].Sequence < out[j].Sequence
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+
+	return out, nil
+}
@@ -0,0 +1,131 @@
+package coldmfa
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxTags             = 20
+	maxEnrolledByLength = 200
+	maxNotesLength      = 4000
+)
+
+// tagPattern keeps tags short and free of spaces, because tags are stored separated by spaces
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,31}$`)
+
+// update applies the metadata fields that are present in the request.
+func (m CodeMetadata) update(request *UpdateCodeRequest) CodeMetadata {
+	if request.AccountEmail != nil {
+		m.AccountEmail = request.AccountEmail
+	}
+	if request.EnrolledBy != nil {
+		m.EnrolledBy = request.EnrolledBy
+	}
+	if request.ServiceUrl != nil {
+		m.ServiceUrl = request.ServiceUrl
+	}
+	if request.Notes != nil {
+		m.Notes = request.Notes
+	}
+	if request.Tags != nil {
+		m.Tags = *request.Tags
+	}
+	return m
+}
+
+// normalize trims the metadata, clearing blank fields, and lower cases and sorts the tags. The error describes the
+// first field that isn't valid.
+func (m *CodeMetadata) normalize() error {
+	m.AccountEmail = trimField(m.AccountEmail)
+	m.EnrolledBy = trimField(m.EnrolledBy)
+	m.ServiceUrl = trimField(m.ServiceUrl)
+	m.Notes = trimField(m.Notes)
+
+	if m.AccountEmail != nil {
+		address, err := mail.ParseAddress(*m.AccountEmail)
+		if err != nil || address.Address != *m.AccountEmail {
+			return errors.New("invalid accountEmail")
+		}
+	}
+	if m.EnrolledBy != nil && utf8.RuneCountInString(*m.EnrolledBy) > maxEnrolledByLength {
+		return errors.New("enrolledBy is too long")
+	}
+	if m.ServiceUrl != nil {
+		serviceUrl, err := url.Parse(*m.ServiceUrl)
+		if err != nil || (serviceUrl.Scheme != "http" && serviceUrl.Scheme != "https") || serviceUrl.Host == "" {
+			return errors.New("invalid serviceUrl")
+		}
+	}
+	if m.Notes != nil && utf8.RuneCountInString(*m.Notes) > maxNotesLength {
+		return errors.New("notes are too long")
+	}
+
+	tags := make([]string, 0, len(m.Tags))
+	seen := make(map[string]bool)
+	for _, tag := range m.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !tagPattern.MatchString(tag) {
+			return errors.New("invalid tag")
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxTags {
+		return errors.New("too many tags")
+	}
+	slices.Sort(tags)
+	m.Tags = tags
+
+	return nil
+}
+
+// hasTags checks that the metadata has every one of the tags.
+func (m *CodeMetadata) hasTags(tags []string) bool {
+	for _, tag := range tags {
+		if !slices.Contains(m.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// queryTags reads the tags that codes are filtered by from the query, which are given as repeated tag parameters.
+func queryTags(c *fiber.Ctx) []string {
+	tags := make([]string, 0)
+	for _, tag := range c.Context().QueryArgs().PeekMulti("tag") {
+		if tag := strings.ToLower(strings.TrimSpace(string(tag))); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// trimField trims a field, clearing it if it's blank.
+func trimField(field *string) *string {
+	if field == nil {
+		return nil
+	}
+	return nullableString(strings.TrimSpace(*field))
+}
+
+// joinTags converts normalized tags to the column that stores them, which is null if there are none.
+func joinTags(tags []string) *string {
+	return nullableString(strings.Join(tags, " "))
+}
+
+// splitTags reads tags from the column that stores them.
+func splitTags(tags *string) []string {
+	if tags == nil {
+		return make([]string, 0)
+	}
+	return strings.Fields(*tags)
+}
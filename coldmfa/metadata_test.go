@@ -0,0 +1,122 @@
+package coldmfa
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCodeMetadata(t *testing.T) {
+	forEachStore(t, testCodeMetadata)
+}
+
+func testCodeMetadata(t *testing.T, app *testApp) {
+	group := app.createGroup("alice", "personal")
+	code := app.createCode("alice", group.GroupId, testOriginal)
+	other := app.createCode("alice", group.GroupId, testOtherOriginal)
+	path := "/groups/" + group.GroupId + "/codes/" + code.CodeId
+
+	if created := app.groupCodes("alice", group.GroupId)[code.CodeId]; created.Tags == nil || len(created.Tags) != 0 {
+		t.Fatalf("expected a new code to have no tags, got %+v", created)
+	}
+
+	for _, invalid := range []UpdateCodeRequest{
+		{AccountEmail: stringPtr("Alice <alice@example.com>")},
+		{AccountEmail: stringPtr("alice")},
+		{ServiceUrl: stringPtr("ftp://example.com")},
+		{ServiceUrl: stringPtr("example.com")},
+		{EnrolledBy: stringPtr(strings.Repeat("a", maxEnrolledByLength+1))},
+		{Notes: stringPtr(strings.Repeat("a", maxNotesLength+1))},
+		{Tags: &[]string{"two words"}},
+		{Tags: &[]string{""}},
+	} {
+		app.expect(http.StatusBadRequest, "alice", http.MethodPut, path, invalid, nil)
+	}
+
+	tags := []string{"Work", " admin ", "work"}
+	app.expect(http.StatusNoContent, "alice", http.MethodPut, path, UpdateCodeRequest{
+		PreferredName: stringPtr("Main"),
+		AccountEmail:  stringPtr(" alice@example.com "),
+		EnrolledBy:    stringPtr("IT desk"),
+		ServiceUrl:    stringPtr("https://example.com/login"),
+		Notes:         stringPtr("Recovery codes are in the safe"),
+		Tags:          &tags,
+	}, nil)
+
+	updated := app.groupCodes("alice", group.GroupId)[code.CodeId]
+	if updated.AccountEmail == nil || *updated.AccountEmail != "alice@example.com" || updated.EnrolledBy == nil ||
+		updated.ServiceUrl == nil || updated.Notes == nil || !slices.Equal(updated.Tags, []string{"admin", "work"}) {
+		t.Fatalf("expected the metadata to be normalized and saved, got %+v", updated)
+	}
+
+	// Renaming a code keeps the metadata that isn't in the request
+	app.expect(http.StatusNoContent, "alice", http.MethodPut, path, UpdateCodeRequest{PreferredName: stringPtr("Renamed")}, nil)
+	renamed := app.groupCodes("alice", group.GroupId)[code.CodeId]
+	if renamed.PreferredName == nil || *renamed.PreferredName != "Renamed" || renamed.Notes == nil || len(renamed.Tags) != 2 {
+		t.Fatalf("expected the metadata to be kept, got %+v", renamed)
+	}
+
+	// Editing the metadata keeps the preferred name
+	app.expect(http.StatusNoContent, "alice", http.MethodPut, path, UpdateCodeRequest{Tags: &tags}, nil)
+	retagged := app.groupCodes("alice", group.GroupId)[code.CodeId]
+	if retagged.PreferredName == nil || *retagged.PreferredName != "Renamed" || len(retagged.Tags) != 2 {
+		t.Fatalf("expected the preferred name to be kept, got %+v", retagged)
+	}
+
+	var tagged CodeGroup
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/groups/"+group.GroupId+"?tag=WORK", nil, &tagged)
+	if len(tagged.Codes) != 1 || tagged.Codes[0].CodeId != code.CodeId {
+		t.Fatalf("expected only the tagged code, got %+v", tagged.Codes)
+	}
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/groups/"+group.GroupId+"?tag=work&tag=missing", nil, &tagged)
+	if len(tagged.Codes) != 0 {
+		t.Fatalf("expected codes to need every tag, got %+v", tagged.Codes)
+	}
+
+	expectCodes(t, app.search("alice", url.Values{"q": {"SAFE"}}), code.CodeId)
+	expectCodes(t, app.search("alice", url.Values{"tag": {"admin"}}), code.CodeId)
+	expectCodes(t, app.search("alice", url.Values{"tag": {"admin", "work"}, "q": {"renamed"}}), code.CodeId)
+	expectCodes(t, app.search("alice", url.Values{"tag": {"wor"}}))
+	expectCodes(t, app.search("alice", url.Values{"tag": {"%"}}))
+
+	// The metadata is kept by a backup
+	resp := app.send("alice", http.MethodPost, "/backups", BackupRequest{Password: "password"})
+	backup, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a backup, got %d", resp.StatusCode)
+	}
+
+	app.expect(http.StatusOK, "bob", http.MethodPut, "/backups", RestoreBackupRequest{BackupContent: backup, Password: "password"}, nil)
+	var groups []CodeGroup
+	app.expect(http.StatusOK, "bob", http.MethodGet, "/groups", nil, &groups)
+	if len(groups) != 1 {
+		t.Fatalf("expected the group to be restored, got %+v", groups)
+	}
+	var restored *CodeSummary
+	for _, code := range app.groupCodes("bob", groups[0].GroupId) {
+		if code.Notes != nil {
+			restored = &code
+		}
+	}
+	if restored == nil || *restored.Notes != *updated.Notes || *restored.ServiceUrl != *updated.ServiceUrl || !slices.Equal(restored.Tags, updated.Tags) {
+		t.Fatalf("expected the metadata to be restored, got %+v", restored)
+	}
+
+	// Blank fields clear the metadata
+	app.expect(http.StatusNoContent, "alice", http.MethodPut, path, UpdateCodeRequest{Notes: stringPtr(" "), Tags: &[]string{}}, nil)
+	cleared := app.groupCodes("alice", group.GroupId)[code.CodeId]
+	if cleared.Notes != nil || len(cleared.Tags) != 0 || cleared.AccountEmail == nil {
+		t.Fatalf("expected the notes and tags to be cleared, got %+v", cleared)
+	}
+
+	app.expect(http.StatusNoContent, "alice", http.MethodDelete, "/groups/"+group.GroupId+"/codes/"+other.CodeId, nil, nil)
+	app.expect(http.StatusNotFound, "alice", http.MethodPut, "/groups/"+group.GroupId+"/codes/"+other.CodeId, UpdateCodeRequest{Notes: stringPtr("deleted")}, nil)
+	app.expect(http.StatusNotFound, "alice", http.MethodPut, "/groups/"+group.GroupId+"/codes/missing", UpdateCodeRequest{}, nil)
+}
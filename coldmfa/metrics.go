@@ -0,0 +1,49 @@
+package coldmfa
+
+import (
+	"context"
+	"github.com/EphyraSoftware/locus/metrics"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"time"
+)
+
+const backupOverdueQueryTimeout = 5 * time.Second
+
+var backupOverdueDesc = prometheus.NewDesc(
+	"locus_coldmfa_users_backup_overdue",
+	"Number of users who own codes that have been added since their last backup, or who have never taken a backup.",
+	nil, nil,
+)
+
+// backupOverdueCollector counts the users that would currently see a backup warning. The count is taken from the
+// database on each scrape so that it is correct across multiple instances.
+type backupOverdueCollector struct {
+	store Store
+}
+
+func (b *backupOverdueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backupOverdueDesc
+}
+
+func (b *backupOverdueCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), backupOverdueQueryTimeout)
+	defer cancel()
+
+	overdue, err := b.store.CountBackupOverdue(ctx)
+	if err != nil {
+		log.Errorf("failed to count users overdue for backup: %s", err.Error())
+		ch <- prometheus.NewInvalidMetric(backupOverdueDesc, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(backupOverdueDesc, prometheus.GaugeValue, float64(overdue))
+}
+
+// observeBackup records the result of a backup operation from the response status, so that every failure path of the
+// handler is counted without having to be instrumented individually.
+func observeBackup(c *fiber.Ctx, operation string) {
+	metrics.BackupOperation(operation, c.Response().StatusCode() < http.StatusBadRequest)
+}
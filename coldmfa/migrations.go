@@ -0,0 +1,237 @@
+package coldmfa
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"io/fs"
+	"net/url"
+	"time"
+)
+
+//go:embed migrations/*
+var migrations embed.FS
+
+// sqliteMigrations are used instead of migrations for SQLite databases, which have their own schema.
+//
+//go:embed sqlite_migrations/*
+var sqliteMigrations embed.FS
+
+// maxMigrationRetryDelay caps the backoff between attempts to migrate the database while it is unavailable
+const maxMigrationRetryDelay = 30 * time.Second
+
+// Migrator manages the database schema using the migrations embedded in the binary.
+//
+// Every operation holds a Postgres advisory lock for its duration, which is taken by the golang-migrate Postgres
+// driver. That means that replicas starting at the same time wait for each other rather than racing to apply the same
+// migration. SQLite databases are only used by a single node, so they don't need that.
+type Migrator struct {
+	m           *migrate.Migrate
+	driver      database.Driver
+	databaseUrl string
+}
+
+type MigrationStatus struct {
+	// Version is the current version of the database, or 0 if no migrations have been applied
+	Version uint
+	// Dirty is set if a migration failed part way through and must be fixed by hand before forcing the version
+	Dirty bool
+	// Latest is the highest version embedded in this binary
+	Latest uint
+}
+
+func NewMigrator(databaseUrl string) (*Migrator, error) {
+	source, err := migrationSource(databaseUrl)
+	if err != nil {
+		return nil, err
+	}
+	parsedUrl, err := url.Parse(databaseUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database url: %w", err)
+	}
+	// The driver is opened here rather than by migrate so that Locked can take the same lock as the migrations
+	driver, err := database.Open(databaseUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure migration: %w", err)
+	}
+	m, err := migrate.NewWithInstance("io/fs", source, parsedUrl.Scheme, driver)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to configure migration: %w", err), driver.Close())
+	}
+
+	return &Migrator{m: m, driver: driver, databaseUrl: databaseUrl}, nil
+}
+
+func (m *Migrator) Close() error {
+	sourceErr, databaseErr := m.m.Close()
+	return errors.Join(sourceErr, databaseErr)
+}
+
+// Up applies all migrations that haven't been applied yet.
+func (m *Migrator) Up() error {
+	return ignoreNoChange(m.m.Up())
+}
+
+// Locked runs fn while holding the lock that migrations are applied with, so that replicas take turns running it and
+// none of them runs it while another is migrating.
+func (m *Migrator) Locked(fn func() error) error {
+	if err := m.driver.Lock(); err != nil {
+		return fmt.Errorf("failed to lock database: %w", err)
+	}
+
+	err := fn()
+	if unlockErr := m.driver.Unlock(); unlockErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to unlock database: %w", unlockErr))
+	}
+
+	return err
+}
+
+// Down rolls back the given number of migrations.
+func (m *Migrator) Down(steps int) error {
+	if steps < 1 {
+		return fmt.Errorf("number of migrations to roll back must be at least 1, got %d", steps)
+	}
+
+	return ignoreNoChange(m.m.Steps(-steps))
+}
+
+// Goto migrates up or down to the given version.
+func (m *Migrator) Goto(version uint) error {
+	return ignoreNoChange(m.m.Migrate(version))
+}
+
+// Force sets the version without running any migrations, and clears the dirty flag. This is only for recovering from
+// a failed migration once the database has been fixed by hand. A version of -1 means no migrations have been applied.
+func (m *Migrator) Force(version int) error {
+	return m.m.Force(version)
+}
+
+func (m *Migrator) Status() (*MigrationStatus, error) {
+	latest, err := latestMigrationVersion(m.databaseUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	version, dirty, err := m.m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return &MigrationStatus{Latest: latest}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migration version: %w", err)
+	}
+
+	return &MigrationStatus{Version: version, Dirty: dirty, Latest: latest}, nil
+}
+
+func ignoreNoChange(err error) error {
+	if errors.Is(err, migrate.ErrNoChange) {
+		return nil
+	}
+	return err
+}
+
+// runStartup migrates the database to the latest version and normalizes codes, retrying until it succeeds or the
+// context is cancelled, so that the app can start before the database is available. The API and readiness report the
+// app as unavailable until this has completed.
+func (a *App) runStartup(ctx context.Context) {
+	delay := time.Second
+	for {
+		err := a.migrateAndNormalize(ctx)
+		if err == nil {
+			close(a.started)
+			return
+		}
+		if ctx.Err() != nil {
+			log.Info("Stopped retrying database migrations")
+			return
+		}
+
+		log.Errorf("failed to prepare database, retrying in %s: %s", delay, err.Error())
+		select {
+		case <-ctx.Done():
+			log.Info("Stopped retrying database migrations")
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxMigrationRetryDelay)
+	}
+}
+
+func (a *App) migrateAndNormalize(ctx context.Context) error {
+	migrator, err := NewMigrator(a.DatabaseUrl)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := migrator.Close(); err != nil {
+			log.Errorf("failed to close migrator: %s", err.Error())
+		}
+	}()
+
+	if !a.SkipMigrations {
+		err = migrator.Up()
+		if err != nil {
+			return fmt.Errorf("failed to run migration: %w", err)
+		}
+		log.Info("Database migrations complete")
+	}
+
+	// Codes added by earlier versions are parsed once the columns for them exist. The first replica to take the lock
+	// normalizes them, so the others find nothing left to do.
+	err = migrator.Locked(func() error {
+		return a.normalizeCodes(ctx)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to normalize codes: %w", err)
+	}
+
+	return nil
+}
+
+// migrationSource reads the embedded migrations for the kind of database in the URL.
+func migrationSource(databaseUrl string) (source.Driver, error) {
+	var driver source.Driver
+	var err error
+	if isSQLiteUrl(databaseUrl) {
+		driver, err = iofs.New(sqliteMigrations, "sqlite_migrations")
+	} else {
+		driver, err = iofs.New(migrations, "migrations")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare migration source: %w", err)
+	}
+
+	return driver, nil
+}
+
+// latestMigrationVersion finds the highest migration version embedded in the binary for the kind of database in the
+// URL.
+func latestMigrationVersion(databaseUrl string) (uint, error) {
+	source, err := migrationSource(databaseUrl)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	version, err := source.First()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read migrations: %w", err)
+	}
+	for {
+		next, err := source.Next(version)
+		if errors.Is(err, fs.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read migrations: %w", err)
+		}
+		version = next
+	}
+}
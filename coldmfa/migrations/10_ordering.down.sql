@@ -0,0 +1,4 @@
+drop table code_preference;
+
+alter table code_group_member
+    drop column sort_order;
@@ -0,0 +1,4 @@
+alter table code_grant
+    alter column created_at type timestamp using created_at::timestamp,
+    alter column expires_at type timestamp using expires_at at time zone 'UTC',
+    alter column revoked_at type timestamp using revoked_at::timestamp;
@@ -0,0 +1,6 @@
+-- Grant expiry is compared with now(), so it must be an absolute time rather than one in the session time zone. Expiry
+-- times were written in UTC, while the created and revoked times were written by now() in the session time zone.
+alter table code_grant
+    alter column created_at type timestamptz using created_at::timestamptz,
+    alter column expires_at type timestamptz using expires_at at time zone 'UTC',
+    alter column revoked_at type timestamptz using revoked_at::timestamptz;
@@ -0,0 +1,4 @@
+-- Fingerprints now include the type and counter of a key, so they are cleared to be computed again on startup, like
+-- the fingerprints of codes that haven't been parsed yet
+update code
+set fingerprint = null;
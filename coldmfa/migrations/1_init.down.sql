@@ -0,0 +1,3 @@
+drop table last_backup;
+drop table code;
+drop table code_group;
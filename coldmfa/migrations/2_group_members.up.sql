@@ -0,0 +1,23 @@
+create table code_group_member
+(
+    id            serial primary key,
+    code_group_id integer   not null references code_group (id) on delete cascade,
+    member_id     text      not null,   -- The Kratos identity id of the member
+
+    email         text,                 -- The email of the member when they were added, for display only
+    role          text      not null,
+
+    created_at    timestamp not null default now(),
+
+    constraint code_group_id_member_id_unique
+        unique (code_group_id, member_id),
+    constraint role_valid
+        check (role in ('owner', 'editor', 'viewer'))
+);
+
+create index code_group_member_member_id_idx on code_group_member (member_id);
+
+-- Every existing group is owned by the identity that created it
+insert into code_group_member (code_group_id, member_id, role)
+select id, owner_id, 'owner'
+from code_group;
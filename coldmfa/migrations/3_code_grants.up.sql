@@ -0,0 +1,22 @@
+create table code_grant
+(
+    id            serial primary key,
+    grant_id      text      not null,
+    code_id       integer   not null references code (id) on delete cascade,
+
+    grantee_id    text      not null,   -- The Kratos identity id that may generate passcodes for the code
+    grantee_email text,                 -- The email of the grantee when the grant was made, for display only
+    granted_by    text      not null,
+
+    created_at    timestamp not null default now(),
+    expires_at    timestamp not null,
+
+    revoked_at    timestamp,
+    revoked_by    text,
+
+    constraint grant_id_unique
+        unique (grant_id)
+);
+
+create index code_grant_grantee_id_idx on code_grant (grantee_id);
+create index code_grant_code_id_idx on code_grant (code_id);
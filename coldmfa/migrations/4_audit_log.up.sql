@@ -0,0 +1,42 @@
+create table audit_event
+(
+    id         bigserial primary key,
+    owner_id   text      not null,   -- The identity whose history this event is part of, which is the actor
+    sequence   bigint    not null,   -- The position of the event in the owner's chain, starting from 1
+
+    event_type text      not null,
+    ip         text,
+    user_agent text,
+    group_id   text,
+    code_id    text,
+    detail     text,                 -- Extra information about the event as JSON, hashed exactly as stored
+
+    created_at timestamp not null,
+
+    prev_hash  text      not null,   -- The hash of the previous event in the owner's chain
+    hash       text      not null,   -- The hash of this event, including prev_hash
+
+    constraint owner_id_sequence_unique
+        unique (owner_id, sequence)
+);
+
+create index audit_event_group_id_idx on audit_event (group_id);
+
+create function audit_event_append_only() returns trigger as
+$$
+begin
+    raise exception 'audit_event is append-only';
+end;
+$$ language plpgsql;
+
+create trigger audit_event_no_modify
+    before update or delete
+    on audit_event
+    for each row
+execute function audit_event_append_only();
+
+create trigger audit_event_no_truncate
+    before truncate
+    on audit_event
+    for each statement
+execute function audit_event_append_only();
@@ -0,0 +1,9 @@
+-- Token buckets for rate limits that are shared between replicas
+create table rate_limit_bucket
+(
+    key        text             primary key,
+    tokens     double precision not null,
+    updated_at timestamptz      not null
+);
+
+create index rate_limit_bucket_updated_at_idx on rate_limit_bucket (updated_at);
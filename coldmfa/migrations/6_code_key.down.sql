@@ -0,0 +1,3 @@
+alter table code
+    drop column issuer,
+    drop column account;
@@ -0,0 +1,6 @@
+drop table instance_key;
+
+drop index code_fingerprint_idx;
+
+alter table code
+    drop column fingerprint;
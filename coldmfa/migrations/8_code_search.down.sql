@@ -0,0 +1,2 @@
+-- The extension is left installed, because it may have been installed before this migration
+drop index code_search_idx;
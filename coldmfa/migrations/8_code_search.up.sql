@@ -0,0 +1,6 @@
+-- A trigram index makes searching for codes that contain some text fast. The indexed expression must match
+-- codeSearchText in the store for the index to be used.
+create extension if not exists pg_trgm;
+
+create index code_search_idx on code using gin ((coalesce(name, '') || ' ' || coalesce(preferred_name, '') || ' ' ||
+                                                  coalesce(issuer, '') || ' ' || coalesce(account, '')) gin_trgm_ops);
@@ -0,0 +1,11 @@
+drop index code_search_idx;
+
+create index code_search_idx on code using gin ((coalesce(name, '') || ' ' || coalesce(preferred_name, '') || ' ' ||
+                                                  coalesce(issuer, '') || ' ' || coalesce(account, '')) gin_trgm_ops);
+
+alter table code
+    drop column account_email,
+    drop column enrolled_by,
+    drop column service_url,
+    drop column notes,
+    drop column tags;
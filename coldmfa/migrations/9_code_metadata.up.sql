@@ -0,0 +1,15 @@
+-- What users record about a code. Tags are lower case, sorted and separated by spaces, so that the same queries work
+-- in SQLite.
+alter table code
+    add column account_email text,
+    add column enrolled_by   text,
+    add column service_url   text,
+    add column notes         text,
+    add column tags          text;
+
+-- Searches also match notes
+drop index code_search_idx;
+
+create index code_search_idx on code using gin ((coalesce(name, '') || ' ' || coalesce(preferred_name, '') || ' ' ||
+                                                  coalesce(issuer, '') || ' ' || coalesce(account, '') || ' ' ||
+                                                  coalesce(notes, '')) gin_trgm_ops);
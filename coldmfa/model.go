@@ -9,6 +9,7 @@ type ApiError struct {
 type CodeGroup struct {
 	GroupId string        `json:"groupId"`
 	Name    string        `json:"name"`
+	Role    Role          `json:"role,omitempty"`
 	Codes   []CodeSummary `json:"codes"`
 }
 
@@ -20,9 +21,61 @@ type CodeSummary struct {
 	CodeId        string     `json:"codeId"`
 	Name          string     `json:"name"`
 	PreferredName *string    `json:"preferredName"`
+	Issuer        *string    `json:"issuer"`
+	Account       *string    `json:"account"`
 	CreatedAt     time.Time  `json:"createdAt"`
 	Deleted       bool       `json:"deleted"`
 	DeletedAt     *time.Time `json:"deletedAt"`
+	// Favorite is whether the identity that listed the code has pinned it
+	Favorite bool `json:"favorite"`
+	CodeMetadata
+}
+
+// CodeMetadata is what users record about a code, as opposed to what is parsed from its original. Tags are lower case
+// and sorted.
+type CodeMetadata struct {
+	AccountEmail *string  `json:"accountEmail"`
+	EnrolledBy   *string  `json:"enrolledBy"`
+	ServiceUrl   *string  `json:"serviceUrl"`
+	Notes        *string  `json:"notes"`
+	Tags         []string `json:"tags"`
+}
+
+// UpdateCodeRequest edits a code. Each field is only changed when it's present, where a blank value clears it, so that
+// clients which only rename codes don't clear the metadata and the other way around.
+type UpdateCodeRequest struct {
+	PreferredName *string   `json:"preferredName"`
+	AccountEmail  *string   `json:"accountEmail"`
+	EnrolledBy    *string   `json:"enrolledBy"`
+	ServiceUrl    *string   `json:"serviceUrl"`
+	Notes         *string   `json:"notes"`
+	Tags          *[]string `json:"tags"`
+}
+
+// CodeLocation addresses a code in a group.
+type CodeLocation struct {
+	GroupId string `json:"groupId"`
+	CodeId  string `json:"codeId"`
+}
+
+// DuplicateCodeError is returned instead of an ApiError when a code is added that is already in one of the user's
+// groups.
+type DuplicateCodeError struct {
+	Error    string       `json:"error"`
+	Existing CodeLocation `json:"existing"`
+}
+
+// CodeSearchResult is a code found by searching across groups, with the group that it's in.
+type CodeSearchResult struct {
+	CodeSummary
+	GroupId   string `json:"groupId"`
+	GroupName string `json:"groupName"`
+}
+
+type CodeSearchResponse struct {
+	Codes []CodeSearchResult `json:"codes"`
+	// NextCursor reads the next page when it's passed as the cursor, and is null on the last page
+	NextCursor *string `json:"nextCursor"`
 }
 
 type PasscodeResponse struct {
@@ -41,6 +94,11 @@ type RestoreBackupRequest struct {
 	Password      string `json:"password"`
 }
 
+type RestoreBackupResponse struct {
+	// Existing are the codes that were already present, so their backup items weren't restored
+	Existing []CodeLocation `json:"existing"`
+}
+
 type CodeBackup struct {
 	BackupVersion string       `json:"backupVersion"`
 	BackupItems   []BackupItem `json:"backup"`
@@ -54,6 +112,7 @@ type BackupItem struct {
 	CreatedAt     *time.Time `json:"createdAt"`
 	Deleted       *bool      `json:"deleted"`
 	DeletedAt     *time.Time `json:"deletedAt"`
+	CodeMetadata
 }
 
 type BackupWarning struct {
@@ -64,3 +123,85 @@ type BackupWarning struct {
 type MoveCodeRequest struct {
 	ToGroupId string `json:"toGroupId"`
 }
+
+// ReorderGroupsRequest lists groups in the order that an identity wants them. Groups that aren't listed come after,
+// oldest first.
+type ReorderGroupsRequest struct {
+	GroupIds []string `json:"groupIds"`
+}
+
+// ReorderCodesRequest lists the codes in a group in the order that an identity wants them. Codes that aren't listed
+// come after, oldest first.
+type ReorderCodesRequest struct {
+	CodeIds []string `json:"codeIds"`
+}
+
+// CodeOperation is one change to a code in a batch. ToGroupId is only used by a move, and PreferredName by a rename,
+// where a missing or blank name clears it.
+type CodeOperation struct {
+	Op            CodeOp  `json:"op"`
+	GroupId       string  `json:"groupId"`
+	CodeId        string  `json:"codeId"`
+	ToGroupId     string  `json:"toGroupId,omitempty"`
+	PreferredName *string `json:"preferredName,omitempty"`
+}
+
+type CodeBatchRequest struct {
+	Operations []CodeOperation `json:"operations"`
+	// BestEffort applies every operation that can be applied, rather than none of them if any operation fails
+	BestEffort bool `json:"bestEffort"`
+}
+
+// CodeOperationResult is the outcome of the operation at the same index in the batch, with the status that the single
+// code endpoint would have responded with.
+type CodeOperationResult struct {
+	Status int     `json:"status"`
+	Error  *string `json:"error"`
+}
+
+type CodeBatchResponse struct {
+	// Applied is the number of operations that were applied
+	Applied int                   `json:"applied"`
+	Results []CodeOperationResult `json:"results"`
+}
+
+type GroupMember struct {
+	MemberId  string    `json:"memberId"`
+	Email     *string   `json:"email"`
+	Role      Role      `json:"role"`
+	Creator   bool      `json:"creator"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type InviteMemberRequest struct {
+	Email string `json:"email"`
+	Role  Role   `json:"role"`
+}
+
+type UpdateMemberRequest struct {
+	Role Role `json:"role"`
+}
+
+type CreateGrantRequest struct {
+	Email     string     `json:"email"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type CodeGrant struct {
+	GrantId      string    `json:"grantId"`
+	GranteeId    string    `json:"granteeId"`
+	GranteeEmail *string   `json:"granteeEmail"`
+	GrantedBy    string    `json:"grantedBy"`
+	CreatedAt    time.Time `json:"createdAt"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+type GrantedCode struct {
+	GrantId       string    `json:"grantId"`
+	GroupId       string    `json:"groupId"`
+	CodeId        string    `json:"codeId"`
+	Name          string    `json:"name"`
+	PreferredName *string   `json:"preferredName"`
+	GrantedBy     string    `json:"grantedBy"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+}
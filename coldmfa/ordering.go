@@ -0,0 +1,166 @@
+package coldmfa
+
+import (
+	"errors"
+	"github.com/EphyraSoftware/locus/auth"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"net/http"
+)
+
+// maxOrderedIds limits how many statements a reorder runs in its transaction
+const maxOrderedIds = 1000
+
+func (a *App) prepareOrdering(api fiber.Router, store Store) {
+	api.Put("/groups/order", func(c *fiber.Ctx) error {
+		sessionId := auth.SessionId(c)
+		if sessionId == "" {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		reorderRequest := new(ReorderGroupsRequest)
+		if err := c.BodyParser(reorderRequest); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid request"})
+		}
+
+		if err := checkOrder(reorderRequest.GroupIds, "groupIds"); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: err.Error()})
+		}
+
+		err := store.ReorderGroups(c.UserContext(), sessionId, reorderRequest.GroupIds)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "group not found"})
+			}
+
+			log.Errorf("failed to reorder groups: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+
+		return c.SendStatus(http.StatusNoContent)
+	})
+
+	// Codes are ordered here rather than under /codes, where the order would be taken for a code id
+	api.Put("/groups/:groupId/order", func(c *fiber.Ctx) error {
+		sessionId := auth.SessionId(c)
+		if sessionId == "" {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		groupId := c.Params("groupId")
+		if groupId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing groupId"})
+		}
+
+		reorderRequest := new(ReorderCodesRequest)
+		if err := c.BodyParser(reorderRequest); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "invalid request"})
+		}
+
+		if err := checkOrder(reorderRequest.CodeIds, "codeIds"); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: err.Error()})
+		}
+
+		// The order is only seen by the member, so viewers can choose it too
+		member, err := requireRole(c, store, sessionId, groupId, RoleViewer)
+		if member == nil {
+			return err
+		}
+
+		err = store.ReorderCodes(c.UserContext(), sessionId, groupId, reorderRequest.CodeIds)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code not found"})
+			}
+
+			log.Errorf("failed to reorder codes: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+
+		return c.SendStatus(http.StatusNoContent)
+	})
+
+	api.Put("/groups/:groupId/codes/:codeId/favorite", setFavorite(store, true))
+	api.Delete("/groups/:groupId/codes/:codeId/favorite", setFavorite(store, false))
+
+	api.Get("/favorites", func(c *fiber.Ctx) error {
+		sessionId := auth.SessionId(c)
+		if sessionId == "" {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		out, err := store.ListFavoriteCodes(c.UserContext(), sessionId)
+		if err != nil {
+			log.Errorf("failed to query favorite codes: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+
+		return c.Status(http.StatusOK).JSON(out)
+	})
+}
+
+// setFavorite handles pinning a code, or unpinning it if favorite is false. Deleted codes can be unpinned, but not
+// pinned.
+func setFavorite(store Store, favorite bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		sessionId := auth.SessionId(c)
+		if sessionId == "" {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		groupId := c.Params("groupId")
+		if groupId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing groupId"})
+		}
+
+		codeId := c.Params("codeId")
+		if codeId == "" {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: "missing codeId"})
+		}
+
+		member, err := requireRole(c, store, sessionId, groupId, RoleViewer)
+		if member == nil {
+			return err
+		}
+
+		if favorite {
+			code, err := store.GetCode(c.UserContext(), groupId, codeId)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				log.Errorf("failed to read code: %s", err.Error())
+				return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+			}
+			if code == nil || code.Deleted {
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code not found"})
+			}
+		}
+
+		err = store.SetCodeFavorite(c.UserContext(), sessionId, groupId, codeId, favorite)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return c.Status(http.StatusNotFound).JSON(ApiError{Error: "code not found"})
+			}
+
+			log.Errorf("failed to set favorite: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+
+		return c.SendStatus(http.StatusNoContent)
+	}
+}
+
+// checkOrder checks the ids of a reorder request, which can't repeat an id.
+func checkOrder(ids []string, name string) error {
+	if len(ids) > maxOrderedIds {
+		return errors.New("too many " + name)
+	}
+
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if id == "" || seen[id] {
+			return errors.New("invalid " + name)
+		}
+		seen[id] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package coldmfa
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestOrdering(t *testing.T) {
+	forEachStore(t, testOrdering)
+}
+
+func (a *testApp) favorites(user string) []CodeSearchResult {
+	a.t.Helper()
+
+	var favorites []CodeSearchResult
+	a.expect(http.StatusOK, user, http.MethodGet, "/favorites", nil, &favorites)
+	return favorites
+}
+
+func testOrdering(t *testing.T, app *testApp) {
+	personal := app.createGroup("alice", "personal")
+	work := app.createGroup("alice", "work")
+	shared := app.createGroup("alice", "shared")
+	codeA := app.createCode("alice", personal.GroupId, testOriginal)
+	codeB := app.createCode("alice", personal.GroupId, testOtherOriginal)
+	codeC := app.createCode("alice", personal.GroupId, "otpauth://totp/Third:alice@example.com?secret=MFRGGZDFMZTWQ2LK&issuer=Third")
+	codeD := app.createCode("alice", work.GroupId, "otpauth://totp/AWS:root@example.com?secret=GEZDGNBVGY3TQOJQ&issuer=AWS")
+	app.expect(http.StatusCreated, "alice", http.MethodPost, "/groups/"+work.GroupId+"/members", InviteMemberRequest{Email: "carol@example.com", Role: RoleViewer}, nil)
+
+	// Without an order, groups and codes are oldest first
+	expectIds(t, app.groupIds("alice"), personal.GroupId, work.GroupId, shared.GroupId)
+	expectIds(t, codeIds(app.listCodes("alice", personal.GroupId)), codeA.CodeId, codeB.CodeId, codeC.CodeId)
+
+	app.expect(http.StatusBadRequest, "alice", http.MethodPut, "/groups/order", ReorderGroupsRequest{GroupIds: []string{work.GroupId, work.GroupId}}, nil)
+	app.expect(http.StatusBadRequest, "alice", http.MethodPut, "/groups/order", ReorderGroupsRequest{GroupIds: make([]string, maxOrderedIds+1)}, nil)
+	app.expect(http.StatusBadRequest, "alice", http.MethodPut, "/groups/"+personal.GroupId+"/order", ReorderCodesRequest{CodeIds: []string{""}}, nil)
+
+	// Groups that aren't listed come after the listed groups, and each identity has its own order
+	app.expect(http.StatusNoContent, "alice", http.MethodPut, "/groups/order", ReorderGroupsRequest{GroupIds: []string{shared.GroupId, personal.GroupId}}, nil)
+	expectIds(t, app.groupIds("alice"), shared.GroupId, personal.GroupId, work.GroupId)
+	expectIds(t, app.groupIds("carol"), work.GroupId)
+
+	// A group that can't be ordered leaves the order as it was
+	app.expect(http.StatusNotFound, "alice", http.MethodPut, "/groups/order", ReorderGroupsRequest{GroupIds: []string{work.GroupId, "missing"}}, nil)
+	expectIds(t, app.groupIds("alice"), shared.GroupId, personal.GroupId, work.GroupId)
+
+	app.expect(http.StatusNoContent, "alice", http.MethodPut, "/groups/"+personal.GroupId+"/order", ReorderCodesRequest{CodeIds: []string{codeC.CodeId}}, nil)
+	expectIds(t, codeIds(app.listCodes("alice", personal.GroupId)), codeC.CodeId, codeA.CodeId, codeB.CodeId)
+
+	// A new order replaces the old one, rather than adding to it
+	app.expect(http.StatusNoContent, "alice", http.MethodPut, "/groups/"+personal.GroupId+"/order", ReorderCodesRequest{CodeIds: []string{codeB.CodeId, codeA.CodeId}}, nil)
+	expectIds(t, codeIds(app.listCodes("alice", personal.GroupId)), codeB.CodeId, codeA.CodeId, codeC.CodeId)
+
+	app.expect(http.StatusNotFound, "alice", http.MethodPut, "/groups/"+personal.GroupId+"/order", ReorderCodesRequest{CodeIds: []string{codeA.CodeId, codeD.CodeId}}, nil)
+	expectIds(t, codeIds(app.listCodes("alice", personal.GroupId)), codeB.CodeId, codeA.CodeId, codeC.CodeId)
+
+	// Favorites are listed in the order of the groups and then of the codes
+	expectIds(t, resultIds(app.favorites("alice")))
+	for _, code := range []CodeSummary{codeA, codeB} {
+		app.expect(http.StatusNoContent, "alice", http.MethodPut, "/groups/"+personal.GroupId+"/codes/"+code.CodeId+"/favorite", nil, nil)
+	}
+	app.expect(http.StatusNoContent, "alice", http.MethodPut, "/groups/"+work.GroupId+"/codes/"+codeD.CodeId+"/favorite", nil, nil)
+	app.expect(http.StatusNotFound, "alice", http.MethodPut, "/groups/"+work.GroupId+"/codes/"+codeA.CodeId+"/favorite", nil, nil)
+	favorites := app.favorites("alice")
+	expectIds(t, resultIds(favorites), codeB.CodeId, codeA.CodeId, codeD.CodeId)
+	if favorites[2].GroupId != work.GroupId || favorites[2].GroupName != "work" || !favorites[2].Favorite {
+		t.Fatalf("expected the favorite with its group, got %+v", favorites[2])
+	}
+
+	if codes := app.groupCodes("alice", personal.GroupId); !codes[codeA.CodeId].Favorite || codes[codeC.CodeId].Favorite {
+		t.Fatalf("expected only the pinned codes to be favorites, got %+v", codes)
+	}
+	if found := app.search("alice", url.Values{"groupId": {work.GroupId}}); !found.Codes[0].Favorite {
+		t.Fatalf("expected the search to find a favorite, got %+v", found)
+	}
+
+	// Pinning a code is only for the identity that pinned it
+	expectIds(t, resultIds(app.favorites("carol")))
+	if codes := app.groupCodes("carol", work.GroupId); codes[codeD.CodeId].Favorite {
+		t.Fatalf("expected the code not to be pinned for another member, got %+v", codes)
+	}
+	app.expect(http.StatusNoContent, "carol", http.MethodPut, "/groups/"+work.GroupId+"/codes/"+codeD.CodeId+"/favorite", nil, nil)
+	expectIds(t, resultIds(app.favorites("carol")), codeD.CodeId)
+
+	app.expect(http.StatusNoContent, "alice", http.MethodDelete, "/groups/"+personal.GroupId+"/codes/"+codeA.CodeId+"/favorite", nil, nil)
+	expectIds(t, resultIds(app.favorites("alice")), codeB.CodeId, codeD.CodeId)
+
+	// Deleted codes and groups that the identity has left aren't listed
+	app.expect(http.StatusNoContent, "alice", http.MethodDelete, "/groups/"+personal.GroupId+"/codes/"+codeB.CodeId, nil, nil)
+	expectIds(t, resultIds(app.favorites("alice")), codeD.CodeId)
+	app.expect(http.StatusNotFound, "alice", http.MethodPut, "/groups/"+personal.GroupId+"/codes/"+codeB.CodeId+"/favorite", nil, nil)
+	app.expect(http.StatusNoContent, "alice", http.MethodDelete, "/groups/"+personal.GroupId+"/codes/"+codeB.CodeId+"/favorite", nil, nil)
+
+	app.expect(http.StatusNoContent, "carol", http.MethodDelete, "/groups/"+work.GroupId+"/members/carol", nil, nil)
+	expectIds(t, resultIds(app.favorites("carol")))
+}
@@ -0,0 +1,287 @@
+package coldmfa
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	defaultOtpAlgorithm = "SHA1"
+	defaultOtpDigits    = 6
+	defaultOtpPeriod    = 30
+)
+
+// errHotpUnsupported is returned for hotp keys, which are parsed so that codes added before they were rejected can still
+// be listed and backed up, but can't be created or used to generate passcodes.
+var errHotpUnsupported = errors.New("hotp codes are not supported")
+
+// OtpKey is a parsed and normalized otpauth URL, see https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+//
+// Optional parameters are filled in with their defaults, so two URLs for the same key have the same OtpKey however they
+// were formatted, and String serializes it back to a canonical URL.
+type OtpKey struct {
+	// Type is either totp or hotp
+	Type string
+	// Issuer is the issuer parameter or, if that's missing, the prefix of the label. It may be empty.
+	Issuer string
+	// Account is the label without the issuer prefix. It may be empty.
+	Account string
+	// Secret is base32 in upper case, without padding or spaces
+	Secret    string
+	Algorithm string
+	Digits    int
+	// Period is only set for totp
+	Period uint
+	// Counter is only set for hotp
+	Counter uint64
+}
+
+// ParseOtpKey is the only parser for otpauth URLs, so that a URL which is accepted when a code is created can always be
+// used to generate passcodes later.
+func ParseOtpKey(raw string) (*OtpKey, error) {
+	otpUrl, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse otp url: %s", err.Error())
+	}
+
+	if otpUrl.Scheme != "otpauth" {
+		return nil, errors.New("invalid otp url scheme")
+	}
+
+	key := OtpKey{
+		Type:      strings.ToLower(otpUrl.Host),
+		Algorithm: defaultOtpAlgorithm,
+		Digits:    defaultOtpDigits,
+	}
+	if key.Type != "totp" && key.Type != "hotp" {
+		return nil, errors.New("unsupported otp type")
+	}
+
+	// The label is either the account name, or the issuer and account name separated by a colon and optional spaces
+	label := strings.TrimPrefix(otpUrl.Path, "/")
+	if issuer, account, found := strings.Cut(label, ":"); found {
+		key.Issuer = strings.TrimSpace(issuer)
+		key.Account = strings.TrimSpace(account)
+	} else {
+		key.Account = strings.TrimSpace(label)
+	}
+
+	query := otpUrl.Query()
+	if issuer := strings.TrimSpace(query.Get("issuer")); issuer != "" {
+		key.Issuer = issuer
+	}
+	if strings.Contains(key.Issuer, ":") {
+		return nil, errors.New("invalid issuer")
+	}
+
+	key.Secret, err = normalizeSecret(query.Get("secret"))
+	if err != nil {
+		return nil, err
+	}
+
+	if algorithm := query.Get("algorithm"); algorithm != "" {
+		// Some issuers use lower case, which other authenticator apps accept
+		key.Algorithm = strings.ToUpper(algorithm)
+	}
+	if _, err := key.algorithm(); err != nil {
+		return nil, err
+	}
+
+	if digits := query.Get("digits"); digits != "" {
+		key.Digits, err = strconv.Atoi(digits)
+		if err != nil {
+			return nil, errors.New("invalid digits")
+		}
+	}
+	if _, err := key.digits(); err != nil {
+		return nil, err
+	}
+
+	switch key.Type {
+	case "totp":
+		key.Period = defaultOtpPeriod
+		if period := query.Get("period"); period != "" {
+			num, err := strconv.ParseUint(period, 10, 32)
+			if err != nil || num == 0 {
+				return nil, errors.New("invalid period")
+			}
+			key.Period = uint(num)
+		}
+	case "hotp":
+		counter := query.Get("counter")
+		if counter == "" {
+			return nil, errors.New("missing counter in hotp url")
+		}
+		key.Counter, err = strconv.ParseUint(counter, 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid counter")
+		}
+	}
+
+	return &key, nil
+}
+
+// normalizeSecret removes spaces and padding from a base32 secret and upper cases it, checking that it decodes.
+func normalizeSecret(secret string) (string, error) {
+	secret = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToUpper(r)
+	}, secret)
+	secret = strings.TrimRight(secret, "=")
+	if secret == "" {
+		return "", errors.New("missing secret in otp url")
+	}
+
+	_, err := decodeSecret(secret)
+	if err != nil {
+		return "", errors.New("invalid secret")
+	}
+
+	return secret, nil
+}
+
+// decodeSecret decodes a normalized secret, padded like the otp library pads it, which is stricter than decoding
+// without padding.
+func decodeSecret(secret string) ([]byte, error) {
+	if n := len(secret) % 8; n != 0 {
+		secret += strings.Repeat("=", 8-n)
+	}
+	return base32.StdEncoding.DecodeString(secret)
+}
+
+// Name is the name given to a new code for the key, which is the issuer if there is one.
+func (k *OtpKey) Name() string {
+	if k.Issuer != "" {
+		return k.Issuer
+	}
+	return k.Account
+}
+
+// String serializes the key to its canonical otpauth URL, with every parameter that its passcodes depend on.
+func (k *OtpKey) String() string {
+	label := k.Account
+	// Without an issuer, a colon in the account would be parsed as an issuer prefix
+	if k.Issuer != "" || strings.Contains(k.Account, ":") {
+		label = k.Issuer + ":" + k.Account
+	}
+
+	query := url.Values{}
+	query.Set("secret", k.Secret)
+	if k.Issuer != "" {
+		query.Set("issuer", k.Issuer)
+	}
+	query.Set("algorithm", k.Algorithm)
+	query.Set("digits", strconv.Itoa(k.Digits))
+	switch k.Type {
+	case "totp":
+		query.Set("period", strconv.FormatUint(uint64(k.Period), 10))
+	case "hotp":
+		query.Set("counter", strconv.FormatUint(k.Counter, 10))
+	}
+
+	otpUrl := url.URL{
+		Scheme:   "otpauth",
+		Host:     k.Type,
+		Path:     "/" + label,
+		RawQuery: query.Encode(),
+	}
+
+	return otpUrl.String()
+}
+
+// Key converts to the otp library's key, which is used to render QR codes.
+func (k *OtpKey) Key() (*otp.Key, error) {
+	return otp.NewKeyFromURL(k.String())
+}
+
+// toOpts returns the options to generate totp passcodes with. Passcodes are only generated as totp, so hotp keys are
+// rejected rather than given passcodes that the issuer wouldn't accept.
+func (k *OtpKey) toOpts() (*totp.ValidateOpts, error) {
+	if k.Type != "totp" {
+		return nil, errHotpUnsupported
+	}
+
+	algorithm, err := k.algorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	digits, err := k.digits()
+	if err != nil {
+		return nil, err
+	}
+
+	return &totp.ValidateOpts{Period: k.Period, Digits: digits, Algorithm: algorithm}, nil
+}
+
+func (k *OtpKey) algorithm() (otp.Algorithm, error) {
+	switch k.Algorithm {
+	case "SHA1":
+		return otp.AlgorithmSHA1, nil
+	case "SHA256":
+		return otp.AlgorithmSHA256, nil
+	case "SHA512":
+		return otp.AlgorithmSHA512, nil
+	case "MD5":
+		return otp.AlgorithmMD5, nil
+	default:
+		return 0, errors.New("invalid algorithm")
+	}
+}
+
+func (k *OtpKey) digits() (otp.Digits, error) {
+	switch k.Digits {
+	case 6:
+		return otp.DigitsSix, nil
+	case 8:
+		return otp.DigitsEight, nil
+	default:
+		return 0, errors.New("invalid digits")
+	}
+}
+
+// normalizeCodes stores the issuer, account and fingerprint of codes that were added before they were parsed. Their
+// originals are kept as they were enrolled, because the canonical form drops parameters that it doesn't know about.
+func (a *App) normalizeCodes(ctx context.Context) error {
+	codes, err := a.Store.ListUnparsedCodes(ctx)
+	if err != nil {
+		return err
+	}
+
+	normalized := 0
+	for _, code := range codes {
+		key, err := ParseOtpKey(code.Original)
+		if err != nil {
+			log.Warnf("code %s in group %s has an invalid otpauth URL: %s", code.CodeId, code.GroupId, err.Error())
+			continue
+		}
+
+		fingerprint, err := a.fingerprint(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		err = a.Store.SetCodeKey(ctx, code.GroupId, code.CodeId, key, fingerprint)
+		if err != nil {
+			return fmt.Errorf("failed to normalize code %s: %w", code.CodeId, err)
+		}
+		normalized++
+	}
+
+	if normalized > 0 {
+		log.Infof("Normalized %d codes", normalized)
+	}
+
+	return nil
+}
@@ -0,0 +1,268 @@
+package coldmfa
+
+import (
+	"context"
+	"errors"
+	"github.com/pquerna/otp/totp"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// otpAuthUrls are URLs in the forms that issuers really produce them
+var otpAuthUrls = []struct {
+	raw  string
+	want OtpKey
+}{
+	{
+		raw:  "otpauth://totp/Example:alice@example.com?secret=JBSWY3DPEHPK3PXP&issuer=Example",
+		want: OtpKey{Type: "totp", Issuer: "Example", Account: "alice@example.com", Secret: "JBSWY3DPEHPK3PXP", Algorithm: "SHA1", Digits: 6, Period: 30},
+	},
+	{
+		raw:  "otpauth://totp/EphyraSoftware:test-a?algorithm=SHA1&digits=6&issuer=EphyraSoftware&period=30&secret=NL6ZHWZXRNCNNIHQKDXK2Q4GGA3PKQD3",
+		want: OtpKey{Type: "totp", Issuer: "EphyraSoftware", Account: "test-a", Secret: "NL6ZHWZXRNCNNIHQKDXK2Q4GGA3PKQD3", Algorithm: "SHA1", Digits: 6, Period: 30},
+	},
+	{
+		raw:  "otpauth://totp/ACME%20Co:john.doe%40email.com?secret=HXDMVJECJJWSRB3HWIZR4IFUGFTMXBOZ&issuer=ACME%20Co&algorithm=SHA256&digits=8&period=60",
+		want: OtpKey{Type: "totp", Issuer: "ACME Co", Account: "john.doe@email.com", Secret: "HXDMVJECJJWSRB3HWIZR4IFUGFTMXBOZ", Algorithm: "SHA256", Digits: 8, Period: 60},
+	},
+	{
+		raw:  "otpauth://totp/GitHub%3A%20alice?secret=JBSWY3DPEHPK3PXP",
+		want: OtpKey{Type: "totp", Issuer: "GitHub", Account: "alice", Secret: "JBSWY3DPEHPK3PXP", Algorithm: "SHA1", Digits: 6, Period: 30},
+	},
+	{
+		raw:  "otpauth://totp/Old%20Name:alice?secret=JBSWY3DPEHPK3PXP&issuer=New%20Name",
+		want: OtpKey{Type: "totp", Issuer: "New Name", Account: "alice", Secret: "JBSWY3DPEHPK3PXP", Algorithm: "SHA1", Digits: 6, Period: 30},
+	},
+	{
+		raw:  "otpauth://totp/alice@example.com?secret=JBSWY3DPEHPK3PXP",
+		want: OtpKey{Type: "totp", Account: "alice@example.com", Secret: "JBSWY3DPEHPK3PXP", Algorithm: "SHA1", Digits: 6, Period: 30},
+	},
+	{
+		raw:  "otpauth://totp/?secret=JBSWY3DPEHPK3PXP&issuer=Example",
+		want: OtpKey{Type: "totp", Issuer: "Example", Secret: "JBSWY3DPEHPK3PXP", Algorithm: "SHA1", Digits: 6, Period: 30},
+	},
+	{
+		raw:  "otpauth://totp?secret=JBSWY3DPEHPK3PXP",
+		want: OtpKey{Type: "totp", Secret: "JBSWY3DPEHPK3PXP", Algorithm: "SHA1", Digits: 6, Period: 30},
+	},
+	{
+		raw:  "otpauth://totp/Big%20Corp%2FEU:alice?secret=jbswy3dpehpk3pxp&algorithm=sha512",
+		want: OtpKey{Type: "totp", Issuer: "Big Corp/EU", Account: "alice", Secret: "JBSWY3DPEHPK3PXP", Algorithm: "SHA512", Digits: 6, Period: 30},
+	},
+	{
+		raw:  "otpauth://totp/Example:alice?secret=jbsw%20y3dp%20ehpk%203pxp",
+		want: OtpKey{Type: "totp", Issuer: "Example", Account: "alice", Secret: "JBSWY3DPEHPK3PXP", Algorithm: "SHA1", Digits: 6, Period: 30},
+	},
+	{
+		raw:  "otpauth://totp/Example:alice?secret=MFRGGZDFMZTWQ2LKNM%3D%3D%3D%3D%3D%3D",
+		want: OtpKey{Type: "totp", Issuer: "Example", Account: "alice", Secret: "MFRGGZDFMZTWQ2LKNM", Algorithm: "SHA1", Digits: 6, Period: 30},
+	},
+	{
+		raw:  "otpauth://totp/Example:alice?secret=MFRGGZDFMZTWQ2LK&period=15&counter=3",
+		want: OtpKey{Type: "totp", Issuer: "Example", Account: "alice", Secret: "MFRGGZDFMZTWQ2LK", Algorithm: "SHA1", Digits: 6, Period: 15},
+	},
+	{
+		raw:  "otpauth://hotp/Example:alice?secret=JBSWY3DPEHPK3PXP&counter=0",
+		want: OtpKey{Type: "hotp", Issuer: "Example", Account: "alice", Secret: "JBSWY3DPEHPK3PXP", Algorithm: "SHA1", Digits: 6},
+	},
+	{
+		raw:  "otpauth://HOTP/Example:alice?secret=JBSWY3DPEHPK3PXP&counter=42&period=60",
+		want: OtpKey{Type: "hotp", Issuer: "Example", Account: "alice", Secret: "JBSWY3DPEHPK3PXP", Algorithm: "SHA1", Digits: 6, Counter: 42},
+	},
+}
+
+var invalidOtpAuthUrls = []string{
+	"",
+	"otpauth://",
+	"otpauth://totp/Example:alice",
+	"otpauth://totp/Example:alice?secret=",
+	"otpauth://totp/Example:alice?secret=====",
+	"otpauth://totp/Example:alice?secret=not-base32",
+	"otpauth://totp/Example:alice?secret=JBSWY3DPEHPK3PXP&issuer=Example:EU",
+	"otpauth://totp/Example:alice?secret=JBSWY3DPEHPK3PXP&digits=7",
+	"otpauth://totp/Example:alice?secret=JBSWY3DPEHPK3PXP&digits=six",
+	"otpauth://totp/Example:alice?secret=JBSWY3DPEHPK3PXP&algorithm=SHA3",
+	"otpauth://totp/Example:alice?secret=JBSWY3DPEHPK3PXP&period=0",
+	"otpauth://totp/Example:alice?secret=JBSWY3DPEHPK3PXP&period=-30",
+	"otpauth://hotp/Example:alice?secret=JBSWY3DPEHPK3PXP",
+	"otpauth://hotp/Example:alice?secret=JBSWY3DPEHPK3PXP&counter=-1",
+	"otpauth://motp/Example:alice?secret=JBSWY3DPEHPK3PXP",
+	"https://totp/Example:alice?secret=JBSWY3DPEHPK3PXP",
+	"otpauth://totp/%zz?secret=JBSWY3DPEHPK3PXP",
+}
+
+func mustParseOtpKey(t *testing.T, raw string) *OtpKey {
+	key, err := ParseOtpKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestParseOtpKey(t *testing.T) {
+	for _, tc := range otpAuthUrls {
+		key, err := ParseOtpKey(tc.raw)
+		if err != nil {
+			t.Errorf("failed to parse %q: %s", tc.raw, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(*key, tc.want) {
+			t.Errorf("parsing %q, expected %+v, got %+v", tc.raw, tc.want, *key)
+		}
+	}
+}
+
+func TestParseInvalidOtpKey(t *testing.T) {
+	for _, raw := range invalidOtpAuthUrls {
+		key, err := ParseOtpKey(raw)
+		if err == nil {
+			t.Errorf("expected %q to be rejected, got %+v", raw, *key)
+		}
+	}
+}
+
+func TestOtpKeyCanonicalUrl(t *testing.T) {
+	key, err := ParseOtpKey("otpauth://totp/ACME%20Co:%20john.doe%40email.com?period=30&secret=hxdm%20vjec%20jjws%20rb3h&issuer=ACME%20Co")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "otpauth://totp/ACME%20Co:john.doe@email.com?algorithm=SHA1&digits=6&issuer=ACME+Co&period=30&secret=HXDMVJECJJWSRB3H"
+	if key.String() != want {
+		t.Fatalf("expected %q, got %q", want, key.String())
+	}
+	if key.Name() != "ACME Co" {
+		t.Fatalf("expected the issuer to be the name, got %q", key.Name())
+	}
+
+	otpKey, err := key.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otpKey.Issuer() != "ACME Co" || otpKey.AccountName() != "john.doe@email.com" || otpKey.Secret() != "HXDMVJECJJWSRB3H" {
+		t.Fatalf("expected the otp library to read the same key, got %s", otpKey.String())
+	}
+}
+
+func TestOtpKeyRoundTrip(t *testing.T) {
+	for _, tc := range otpAuthUrls {
+		checkOtpKeyRoundTrip(t, tc.raw)
+	}
+}
+
+func FuzzParseOtpKey(f *testing.F) {
+	for _, tc := range otpAuthUrls {
+		f.Add(tc.raw)
+	}
+	for _, raw := range invalidOtpAuthUrls {
+		f.Add(raw)
+	}
+
+	f.Fuzz(func(t *testing.T, raw string) {
+		checkOtpKeyRoundTrip(t, raw)
+	})
+}
+
+// checkOtpKeyRoundTrip checks that a totp URL which parses can be used to generate passcodes, that serializing it parses back
+// to the same key, and that the canonical URL serializes to itself.
+func checkOtpKeyRoundTrip(t *testing.T, raw string) {
+	key, err := ParseOtpKey(raw)
+	if err != nil {
+		return
+	}
+
+	opts, err := key.toOpts()
+	if key.Type == "hotp" {
+		// Passcodes are only generated as totp, so hotp keys must not be given any
+		if !errors.Is(err, errHotpUnsupported) {
+			t.Fatalf("expected %q to be rejected for passcodes, got %v", raw, err)
+		}
+	} else {
+		if err != nil {
+			t.Fatalf("parsed %q but failed to convert it: %s", raw, err.Error())
+		}
+		_, err = totp.GenerateCodeCustom(key.Secret, time.Now(), *opts)
+		if err != nil {
+			t.Fatalf("parsed %q but failed to generate a passcode: %s", raw, err.Error())
+		}
+	}
+
+	canonical := key.String()
+	reparsed, err := ParseOtpKey(canonical)
+	if err != nil {
+		t.Fatalf("failed to parse %q, serialized from %q: %s", canonical, raw, err.Error())
+	}
+	if !reflect.DeepEqual(key, reparsed) {
+		t.Fatalf("expected %q to round trip through %q, got %+v and %+v", raw, canonical, *key, *reparsed)
+	}
+	if reparsed.String() != canonical {
+		t.Fatalf("expected %q to be canonical, got %q", canonical, reparsed.String())
+	}
+}
+
+func TestNormalizeCodes(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testNormalizeCodes(t, NewMemoryStore())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		testNormalizeCodes(t, newTestSQLiteStore(t))
+	})
+}
+
+func testNormalizeCodes(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	// Codes restored without a key are stored as they were given, like codes added before they were parsed
+	legacy := "otpauth://totp/Example%3Aalice%40example.com?secret=jbswy3dpehpk3pxp"
+	duplicate := "otpauth://totp/Example:alice@example.com?issuer=Example&secret=JBSWY3DPEHPK3PXP"
+	invalid := "otpauth://totp/Example:bob?secret=JBSWY3DPEHPK3PXP&digits=7"
+	items := make([]RestoreItem, 0)
+	for codeId, original := range []string{legacy, duplicate, invalid} {
+		name := "Example:alice@example.com"
+		createdAt := time.Now()
+		deleted := false
+		items = append(items, RestoreItem{
+			BackupItem: BackupItem{GroupName: "personal", Original: &original, CodeName: &name, CreatedAt: &createdAt, Deleted: &deleted},
+			GroupId:    "group-a",
+			CodeId:     "code-" + string(rune('a'+codeId)),
+		})
+	}
+	_, err := store.RestoreBackup(ctx, "alice", nil, items, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &App{Store: store}
+	err = app.normalizeCodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The originals are kept as they were enrolled
+	for codeId, wantOriginal := range map[string]string{"code-a": legacy, "code-b": duplicate} {
+		code, err := store.GetCode(ctx, "group-a", codeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code.Issuer == nil || *code.Issuer != "Example" || code.Account == nil || *code.Account != "alice@example.com" {
+			t.Fatalf("expected %s to be parsed, got %+v", codeId, code)
+		}
+
+		original, err := store.GetCodeOriginal(ctx, "group-a", codeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if original != wantOriginal {
+			t.Fatalf("expected %s to have the original %q, got %q", codeId, wantOriginal, original)
+		}
+	}
+
+	unparsed, err := store.ListUnparsedCodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unparsed) != 1 || unparsed[0].CodeId != "code-c" || unparsed[0].Original != invalid {
+		t.Fatalf("expected only the invalid code to be left unparsed, got %+v", unparsed)
+	}
+}
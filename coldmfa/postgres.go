@@ -0,0 +1,889 @@
+package coldmfa
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/lib/pq"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PostgresStore is the Store used in production, backed by the schema in the embedded migrations.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// notFound converts sql.ErrNoRows to ErrNotFound, so that callers don't depend on the store implementation.
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// pqAlreadyExists converts a violated uniqueness constraint to ErrAlreadyExists.
+func pqAlreadyExists(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+// requireAffected returns ErrNotFound if the statement didn't change any rows.
+func requireAffected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func rollback(tx *sql.Tx) {
+	err := tx.Rollback()
+	if err != nil && !errors.Is(err, sql.ErrTxDone) {
+		log.Errorf("failed to rollback transaction: %s", err.Error())
+	}
+}
+
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *PostgresStore) ListGroups(ctx context.Context, memberId string) ([]CodeGroup, error) {
+	rows, err := s.db.QueryContext(ctx, listGroupsQuery, memberId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]CodeGroup, 0)
+	for rows.Next() {
+		var group CodeGroup
+		err = rows.Scan(&group.GroupId, &group.Name, &group.Role)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, group)
+	}
+
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) GetGroup(ctx context.Context, memberId string, groupId string) (*CodeGroup, error) {
+	row := s.db.QueryRowContext(ctx, "select code_group.group_id, code_group.name, code_group_member.role from code_group join code_group_member on code_group_member.code_group_id = code_group.id where code_group_member.member_id = $1 and code_group.group_id = $2", memberId, groupId)
+
+	var group CodeGroup
+	err := row.Scan(&group.GroupId, &group.Name, &group.Role)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return &group, nil
+}
+
+func (s *PostgresStore) CreateGroup(ctx context.Context, creatorId string, creatorEmail *string, groupId string, name string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+
+	var groupDatabaseId int
+	err = tx.QueryRowContext(ctx, "insert into code_group (owner_id, group_id, name) values ($1, $2, $3) returning id", creatorId, groupId, name).Scan(&groupDatabaseId)
+	if err != nil {
+		return fmt.Errorf("failed to insert group: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "insert into code_group_member (code_group_id, member_id, email, role) values ($1, $2, $3, $4)", groupDatabaseId, creatorId, creatorEmail, RoleOwner)
+	if err != nil {
+		return fmt.Errorf("failed to insert group owner: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) GetMembership(ctx context.Context, memberId string, groupId string) (*Membership, error) {
+	row := s.db.QueryRowContext(ctx, "select code_group.group_id, code_group.owner_id, code_group_member.role from code_group join code_group_member on code_group_member.code_group_id = code_group.id where code_group_member.member_id = $1 and code_group.group_id = $2", memberId, groupId)
+
+	var member Membership
+	err := row.Scan(&member.GroupId, &member.CreatorId, &member.Role)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return &member, nil
+}
+
+func (s *PostgresStore) ReorderGroups(ctx context.Context, memberId string, groupIds []string) error {
+	return applyOrder(ctx, s.db, clearGroupOrderQuery, setGroupOrderQuery, groupIds, memberId)
+}
+
+func (s *PostgresStore) ListCodes(ctx context.Context, memberId string, groupId string) ([]CodeSummary, error) {
+	return queryCodes(ctx, s.db, memberId, groupId)
+}
+
+func (s *PostgresStore) GetCode(ctx context.Context, groupId string, codeId string) (*CodeSummary, error) {
+	row := s.db.QueryRowContext(ctx, "select "+codeSummaryColumns+" from code join code_group on code_group.id = code.code_group_id where code_group.group_id = $1 and code.code_id = $2", groupId, codeId)
+
+	var code CodeSummary
+	err := scanCodeSummary(row, &code)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return &code, nil
+}
+
+func (s *PostgresStore) SearchCodes(ctx context.Context, memberId string, search CodeSearch) (*CodeSearchResponse, error) {
+	return querySearchCodes(ctx, s.db, "ilike", memberId, search)
+}
+
+func (s *PostgresStore) GetCodeOriginal(ctx context.Context, groupId string, codeId string) (string, error) {
+	var original string
+	err := s.db.QueryRowContext(ctx, "select code.original from code join code_group on code_group.id = code.code_group_id where code_group.group_id = $1 and code.code_id = $2", groupId, codeId).Scan(&original)
+	return original, notFound(err)
+}
+
+func (s *PostgresStore) CreateCode(ctx context.Context, groupId string, codeId string, original string, key *OtpKey, fingerprint string, event *AuditEvent) error {
+	issuer, account := keyColumns(key)
+	return s.audited(ctx, event, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, "insert into code (code_group_id, code_id, original, name, issuer, account, fingerprint) select id, $2, $3, $4, $5, $6, $7 from code_group where group_id = $1", groupId, codeId, original, key.Name(), issuer, account, fingerprint)
+		return requireAffected(result, pqAlreadyExists(err))
+	})
+}
+
+func (s *PostgresStore) FindCodeByFingerprint(ctx context.Context, memberId string, fingerprint string) (*CodeLocation, error) {
+	var location CodeLocation
+	err := s.db.QueryRowContext(ctx, findCodeByFingerprintQuery+" and code.deleted = false order by code.id limit 1", memberId, fingerprint).Scan(&location.GroupId, &location.CodeId)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return &location, nil
+}
+
+func (s *PostgresStore) ListUnparsedCodes(ctx context.Context) ([]CodeOriginal, error) {
+	return queryCodeOriginals(ctx, s.db, listUnparsedCodesQuery)
+}
+
+func (s *PostgresStore) SetCodeKey(ctx context.Context, groupId string, codeId string, key *OtpKey, fingerprint string) error {
+	issuer, account := keyColumns(key)
+	return requireAffected(s.db.ExecContext(ctx, setCodeKeyQuery, groupId, codeId, issuer, account, fingerprint))
+}
+
+func (s *PostgresStore) UpdateCode(ctx context.Context, groupId string, codeId string, preferredName *string, metadata CodeMetadata) error {
+	result, err := s.db.ExecContext(ctx, updateCodeQuery, groupId, codeId, preferredName, metadata.AccountEmail, metadata.EnrolledBy, metadata.ServiceUrl, metadata.Notes, joinTags(metadata.Tags))
+	return requireAffected(result, pqAlreadyExists(err))
+}
+
+func (s *PostgresStore) MoveCode(ctx context.Context, groupId string, codeId string, toGroupId string, event *AuditEvent) error {
+	return s.audited(ctx, event, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, moveCodeQuery, groupId, codeId, toGroupId)
+		return requireAffected(result, pqAlreadyExists(err))
+	})
+}
+
+func (s *PostgresStore) ReorderCodes(ctx context.Context, memberId string, groupId string, codeIds []string) error {
+	return applyOrder(ctx, s.db, clearCodeOrderQuery, setCodeOrderQuery, codeIds, memberId, groupId)
+}
+
+func (s *PostgresStore) SetCodeFavorite(ctx context.Context, memberId string, groupId string, codeId string, favorite bool) error {
+	return requireAffected(s.db.ExecContext(ctx, setCodeFavoriteQuery, memberId, groupId, codeId, favorite))
+}
+
+func (s *PostgresStore) ListFavoriteCodes(ctx context.Context, memberId string) ([]CodeSearchResult, error) {
+	return queryFavoriteCodes(ctx, s.db, memberId)
+}
+
+func (s *PostgresStore) DeleteCode(ctx context.Context, groupId string, codeId string, event *AuditEvent) error {
+	return s.audited(ctx, event, func(tx *sql.Tx) error {
+		return requireAffected(tx.ExecContext(ctx, "update code set deleted = true, deleted_at = now() where deleted = false and code_group_id = (select id from code_group where group_id = $1) and code_id = $2", groupId, codeId))
+	})
+}
+
+func (s *PostgresStore) ApplyCodeOperations(ctx context.Context, memberId string, operations []CodeOperation, events []*AuditEvent, bestEffort bool) ([]error, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	// The chain is locked before any codes are, like the other changes that are audited, which lock it last after
+	// changing a single code
+	if err := lockAuditChain(ctx, tx, memberId); err != nil {
+		return nil, err
+	}
+
+	results, commit, err := applyCodeOperations(ctx, tx, operations, events, bestEffort, s.appendAuditEvent, func(operation CodeOperation) error {
+		var result sql.Result
+		var err error
+		switch operation.Op {
+		case CodeOpMove:
+			result, err = tx.ExecContext(ctx, moveCodeQuery, operation.GroupId, operation.CodeId, operation.ToGroupId)
+		case CodeOpRename:
+			result, err = tx.ExecContext(ctx, setCodePreferredNameQuery, operation.GroupId, operation.CodeId, operation.PreferredName)
+		case CodeOpDelete:
+			result, err = tx.ExecContext(ctx, "update code set deleted = true, deleted_at = now() where deleted = false and code_group_id = (select id from code_group where group_id = $1) and code_id = $2", operation.GroupId, operation.CodeId)
+		case CodeOpRestore:
+			if err := checkRestoreDuplicate(ctx, tx, memberId, operation); err != nil {
+				return err
+			}
+			result, err = tx.ExecContext(ctx, restoreCodeQuery, operation.GroupId, operation.CodeId)
+		default:
+			return fmt.Errorf("unknown code operation %q", operation.Op)
+		}
+		return requireAffected(result, pqAlreadyExists(err))
+	})
+	if err != nil || !commit {
+		return results, err
+	}
+
+	return results, tx.Commit()
+}
+
+func (s *PostgresStore) ListMembers(ctx context.Context, groupId string) ([]GroupMember, error) {
+	rows, err := s.db.QueryContext(ctx, "select code_group_member.member_id, code_group_member.email, code_group_member.role, code_group_member.created_at, code_group.owner_id from code_group_member join code_group on code_group.id = code_group_member.code_group_id where code_group.group_id = $1 order by code_group_member.created_at, code_group_member.id", groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]GroupMember, 0)
+	for rows.Next() {
+		groupMember, err := scanGroupMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *groupMember)
+	}
+
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) GetMember(ctx context.Context, groupId string, memberId string) (*GroupMember, error) {
+	row := s.db.QueryRowContext(ctx, "select code_group_member.member_id, code_group_member.email, code_group_member.role, code_group_member.created_at, code_group.owner_id from code_group_member join code_group on code_group.id = code_group_member.code_group_id where code_group.group_id = $1 and code_group_member.member_id = $2", groupId, memberId)
+
+	groupMember, err := scanGroupMember(row)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return groupMember, nil
+}
+
+func scanGroupMember(row interface{ Scan(...any) error }) (*GroupMember, error) {
+	var groupMember GroupMember
+	var creatorId string
+	err := row.Scan(&groupMember.MemberId, &groupMember.Email, &groupMember.Role, &groupMember.CreatedAt, &creatorId)
+	if err != nil {
+		return nil, err
+	}
+	groupMember.Creator = groupMember.MemberId == creatorId
+
+	return &groupMember, nil
+}
+
+func (s *PostgresStore) AddMember(ctx context.Context, groupId string, member GroupMember, event *AuditEvent) error {
+	return s.audited(ctx, event, func(tx *sql.Tx) error {
+		err := requireAffected(tx.ExecContext(ctx, "insert into code_group_member (code_group_id, member_id, email, role) select id, $2, $3, $4 from code_group where group_id = $1 on conflict on constraint code_group_id_member_id_unique do nothing", groupId, member.MemberId, member.Email, member.Role))
+		if errors.Is(err, ErrNotFound) {
+			// Either the group doesn't exist, which the caller has already checked, or the member is already in the group
+			return ErrAlreadyExists
+		}
+
+		return err
+	})
+}
+
+func (s *PostgresStore) UpdateMemberRole(ctx context.Context, groupId string, memberId string, role Role, event *AuditEvent) error {
+	return s.audited(ctx, event, func(tx *sql.Tx) error {
+		return requireAffected(tx.ExecContext(ctx, "update code_group_member set role = $3 where code_group_id = (select id from code_group where group_id = $1) and member_id = $2", groupId, memberId, role))
+	})
+}
+
+func (s *PostgresStore) RemoveMember(ctx context.Context, groupId string, memberId string, event *AuditEvent) error {
+	return s.audited(ctx, event, func(tx *sql.Tx) error {
+		return requireAffected(tx.ExecContext(ctx, "delete from code_group_member where code_group_id = (select id from code_group where group_id = $1) and member_id = $2", groupId, memberId))
+	})
+}
+
+func (s *PostgresStore) GetGrantedOriginal(ctx context.Context, granteeId string, groupId string, codeId string) (string, error) {
+	row := s.db.QueryRowContext(ctx, "select code.original from code_grant join code on code.id = code_grant.code_id join code_group on code_group.id = code.code_group_id where code_group.group_id = $1 and code.code_id = $2 and code.deleted = false and code_grant.grantee_id = $3 and code_grant.revoked_at is null and code_grant.expires_at > now()", groupId, codeId, granteeId)
+
+	var original string
+	err := row.Scan(&original)
+	return original, notFound(err)
+}
+
+func (s *PostgresStore) ListGrantedCodes(ctx context.Context, granteeId string) ([]GrantedCode, error) {
+	rows, err := s.db.QueryContext(ctx, "select code_grant.grant_id, code_group.group_id, code.code_id, code.name, code.preferred_name, code_grant.granted_by, code_grant.expires_at from code_grant join code on code.id = code_grant.code_id join code_group on code_group.id = code.code_group_id where code_grant.grantee_id = $1 and code.deleted = false and code_grant.revoked_at is null and code_grant.expires_at > now() order by code_grant.expires_at, code_grant.id", granteeId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]GrantedCode, 0)
+	for rows.Next() {
+		var grantedCode GrantedCode
+		err = rows.Scan(&grantedCode.GrantId, &grantedCode.GroupId, &grantedCode.CodeId, &grantedCode.Name, &grantedCode.PreferredName, &grantedCode.GrantedBy, &grantedCode.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, grantedCode)
+	}
+
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) ListCodeGrants(ctx context.Context, groupId string, codeId string) ([]CodeGrant, error) {
+	rows, err := s.db.QueryContext(ctx, "select code_grant.grant_id, code_grant.grantee_id, code_grant.grantee_email, code_grant.granted_by, code_grant.created_at, code_grant.expires_at from code_grant join code on code.id = code_grant.code_id join code_group on code_group.id = code.code_group_id where code_group.group_id = $1 and code.code_id = $2 and code_grant.revoked_at is null and code_grant.expires_at > now() order by code_grant.created_at, code_grant.id", groupId, codeId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]CodeGrant, 0)
+	for rows.Next() {
+		var grant CodeGrant
+		err = rows.Scan(&grant.GrantId, &grant.GranteeId, &grant.GranteeEmail, &grant.GrantedBy, &grant.CreatedAt, &grant.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, grant)
+	}
+
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) CreateGrant(ctx context.Context, groupId string, codeId string, grant CodeGrant, event *AuditEvent) (*CodeGrant, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	var codeDatabaseId int
+	err = tx.QueryRowContext(ctx, "select code.id from code join code_group on code_group.id = code.code_group_id where code_group.group_id = $1 and code.code_id = $2 and code.deleted = false", groupId, codeId).Scan(&codeDatabaseId)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	// A new grant replaces any existing grant for the same user, so that there is only one expiry to reason about
+	_, err = tx.ExecContext(ctx, "update code_grant set revoked_at = now(), revoked_by = $3 where code_id = $1 and grantee_id = $2 and revoked_at is null", codeDatabaseId, grant.GranteeId, grant.GrantedBy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to replace grant: %w", err)
+	}
+
+	var created CodeGrant
+	err = tx.QueryRowContext(ctx, "insert into code_grant (grant_id, code_id, grantee_id, grantee_email, granted_by, expires_at) values ($1, $2, $3, $4, $5, $6) returning grant_id, grantee_id, grantee_email, granted_by, created_at, expires_at", grant.GrantId, codeDatabaseId, grant.GranteeId, grant.GranteeEmail, grant.GrantedBy, grant.ExpiresAt.UTC()).Scan(&created.GrantId, &created.GranteeId, &created.GranteeEmail, &created.GrantedBy, &created.CreatedAt, &created.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert grant: %w", err)
+	}
+
+	if err := s.appendAuditEvent(ctx, tx, event); err != nil {
+		return nil, err
+	}
+
+	return &created, tx.Commit()
+}
+
+func (s *PostgresStore) RevokeGrant(ctx context.Context, groupId string, codeId string, grantId string, revokedBy string, event *AuditEvent) error {
+	return s.audited(ctx, event, func(tx *sql.Tx) error {
+		return requireAffected(tx.ExecContext(ctx, "update code_grant set revoked_at = now(), revoked_by = $4 where grant_id = $3 and revoked_at is null and code_id = (select code.id from code join code_group on code_group.id = code.code_group_id where code_group.group_id = $1 and code.code_id = $2)", groupId, codeId, grantId, revokedBy))
+	})
+}
+
+func (s *PostgresStore) ListBackupItems(ctx context.Context, ownerId string) ([]BackupItem, error) {
+	// Shared groups are included in the backups of all of their owners
+	rows, err := s.db.QueryContext(ctx, "select code_group.name, code.original, code.name as code_name, code.preferred_name, code.created_at, code.deleted, code.deleted_at, code.account_email, code.enrolled_by, code.service_url, code.notes, code.tags from code_group join code_group_member on code_group_member.code_group_id = code_group.id left join code on code.code_group_id = code_group.id where code_group_member.member_id = $1 and code_group_member.role = $2 order by code_group.id, code.id", ownerId, RoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]BackupItem, 0)
+	for rows.Next() {
+		var item BackupItem
+		var tags *string
+		err = rows.Scan(&item.GroupName, &item.Original, &item.CodeName, &item.PreferredName, &item.CreatedAt, &item.Deleted, &item.DeletedAt, &item.AccountEmail, &item.EnrolledBy, &item.ServiceUrl, &item.Notes, &tags)
+		if err != nil {
+			return nil, err
+		}
+		if tags != nil {
+			item.Tags = splitTags(tags)
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+func (s *PostgresStore) RestoreBackup(ctx context.Context, ownerId string, ownerEmail *string, items []RestoreItem, event *AuditEvent) ([]CodeLocation, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	existing := make([]CodeLocation, 0)
+	for _, item := range items {
+		// Codes are restored into a group with the same name that the identity owns, which is any group in its backups
+		var groupDatabaseId int
+		err = tx.QueryRowContext(ctx, findOwnedGroupQuery, ownerId, RoleOwner, item.GroupName).Scan(&groupDatabaseId)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = tx.QueryRowContext(ctx, "insert into code_group (owner_id, group_id, name) values ($1, $2, $3) returning id", ownerId, item.GroupId, item.GroupName).Scan(&groupDatabaseId)
+			if err != nil {
+				return nil, fmt.Errorf("failed to insert group: %w", err)
+			}
+
+			_, err = tx.ExecContext(ctx, "insert into code_group_member (code_group_id, member_id, email, role) values ($1, $2, $3, $4)", groupDatabaseId, ownerId, ownerEmail, RoleOwner)
+			if err != nil {
+				return nil, fmt.Errorf("failed to insert group owner: %w", err)
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read group: %w", err)
+		}
+
+		if item.CodeName == nil {
+			continue
+		}
+
+		if item.Fingerprint != nil {
+			var location CodeLocation
+			err = tx.QueryRowContext(ctx, findCodeByFingerprintQuery+" order by code.id limit 1", ownerId, *item.Fingerprint).Scan(&location.GroupId, &location.CodeId)
+			if err == nil {
+				existing = append(existing, location)
+				continue
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				return nil, fmt.Errorf("failed to find code: %w", err)
+			}
+		}
+
+		issuer, account := keyColumns(item.Key)
+		_, err = tx.ExecContext(ctx, "insert into code (code_group_id, code_id, original, name, preferred_name, issuer, account, fingerprint, created_at, deleted, deleted_at, account_email, enrolled_by, service_url, notes, tags) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) on conflict on constraint code_group_id_original_unique do nothing", groupDatabaseId, item.CodeId, item.Original, item.CodeName, item.PreferredName, issuer, account, item.Fingerprint, item.CreatedAt, item.Deleted, item.DeletedAt, item.AccountEmail, item.EnrolledBy, item.ServiceUrl, item.Notes, joinTags(item.Tags))
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert code: %w", err)
+		}
+	}
+
+	if err := s.appendAuditEvent(ctx, tx, event); err != nil {
+		return nil, err
+	}
+
+	return existing, tx.Commit()
+}
+
+func (s *PostgresStore) RecordBackup(ctx context.Context, ownerId string) error {
+	_, err := s.db.ExecContext(ctx, "insert into last_backup (owner_id, backup_at) values ($1, now()) on conflict on constraint owner_id_unique do update set backup_at = now()", ownerId)
+	return err
+}
+
+func (s *PostgresStore) GetBackupWarning(ctx context.Context, ownerId string) (*BackupWarning, error) {
+	var warning BackupWarning
+	err := s.db.QueryRowContext(ctx, "select last_backup.backup_at from last_backup where last_backup.owner_id = $1", ownerId).Scan(&warning.LastBackupAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	err = s.db.QueryRowContext(ctx, "select count(code.id) from last_backup left join code_group_member on code_group_member.member_id = last_backup.owner_id and code_group_member.role = $2 left join code on code.code_group_id = code_group_member.code_group_id where last_backup.owner_id = $1 and code.created_at > last_backup.backup_at group by last_backup.owner_id, last_backup.backup_at", ownerId, RoleOwner).Scan(&warning.NumberNotBackedUp)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return &warning, nil
+}
+
+func (s *PostgresStore) CountBackupOverdue(ctx context.Context) (int, error) {
+	var overdue int
+	err := s.db.QueryRowContext(ctx, "select count(distinct code_group_member.member_id) from code_group_member join code on code.code_group_id = code_group_member.code_group_id left join last_backup on last_backup.owner_id = code_group_member.member_id where code_group_member.role = $1 and code.deleted = false and (last_backup.backup_at is null or code.created_at > last_backup.backup_at)", RoleOwner).Scan(&overdue)
+	return overdue, err
+}
+
+func (s *PostgresStore) GetInstanceKey(ctx context.Context, name string, generated []byte) ([]byte, error) {
+	_, err := s.db.ExecContext(ctx, "insert into instance_key (name, value) values ($1, $2) on conflict (name) do nothing", name, generated)
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	err = s.db.QueryRowContext(ctx, "select value from instance_key where name = $1", name).Scan(&key)
+	return key, err
+}
+
+func (s *PostgresStore) AppendAuditEvent(ctx context.Context, event *AuditEvent) error {
+	return s.audited(ctx, event, func(tx *sql.Tx) error {
+		return nil
+	})
+}
+
+// audited runs fn in a transaction that appends the event once fn has made its change.
+func (s *PostgresStore) audited(ctx context.Context, event *AuditEvent, fn func(tx *sql.Tx) error) error {
+	return auditedTx(ctx, s.db, event, s.appendAuditEvent, fn)
+}
+
+// appendAuditEvent appends the event in the transaction, if there is one.
+func (s *PostgresStore) appendAuditEvent(ctx context.Context, tx *sql.Tx, event *AuditEvent) error {
+	if event == nil {
+		return nil
+	}
+
+	// The owner's chain is locked while the event is appended, so that concurrent requests can't fork the chain
+	if err := lockAuditChain(ctx, tx, event.OwnerId); err != nil {
+		return err
+	}
+
+	return appendAuditEvent(ctx, tx, event, time.Now())
+}
+
+// lockAuditChain locks an owner's audit chain until the end of the transaction. The lock can be taken more than once.
+func lockAuditChain(ctx context.Context, tx *sql.Tx, ownerId string) error {
+	_, err := tx.ExecContext(ctx, "select pg_advisory_xact_lock(hashtextextended($1, 0))", "audit_event:"+ownerId)
+	if err != nil {
+		return fmt.Errorf("failed to lock audit chain: %w", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) ListAuditEvents(ctx context.Context, ownerId string, before int64, limit int) ([]AuditEvent, error) {
+	return queryAuditEvents(ctx, s.db, "select "+auditEventColumns+" from audit_event where owner_id = $1 and id < $2 order by id desc limit $3", ownerId, before, limit)
+}
+
+func (s *PostgresStore) ListGroupAuditEvents(ctx context.Context, groupId string, before int64, limit int) ([]AuditEvent, error) {
+	return queryAuditEvents(ctx, s.db, "select "+auditEventColumns+" from audit_event where group_id = $1 and id < $2 order by id desc limit $3", groupId, before, limit)
+}
+
+func (s *PostgresStore) ListAuditEventsAfter(ctx context.Context, ownerId string, sequence int64, limit int) ([]AuditEvent, error) {
+	return queryAuditEvents(ctx, s.db, "select "+auditEventColumns+" from audit_event where (owner_id, sequence) > ($1, $2) order by owner_id, sequence limit $3", ownerId, sequence, limit)
+}
+
+// Queries that are shared by the database stores
+const (
+	// findCodeByFingerprintQuery selects the location of codes with a fingerprint, in the groups of a member
+	findCodeByFingerprintQuery = "select code_group.group_id, code.code_id from code join code_group on code_group.id = code.code_group_id join code_group_member on code_group_member.code_group_id = code_group.id where code_group_member.member_id = $1 and code.fingerprint = $2"
+	// findOwnedGroupQuery selects the first group with a name where a member has a role, like the groups in a backup
+	findOwnedGroupQuery       = "select code_group.id from code_group join code_group_member on code_group_member.code_group_id = code_group.id where code_group_member.member_id = $1 and code_group_member.role = $2 and code_group.name = $3 order by code_group.id limit 1"
+	listUnparsedCodesQuery    = "select code_group.group_id, code.code_id, code.original from code join code_group on code_group.id = code.code_group_id where code.account is null or code.fingerprint is null order by code.id"
+	codeSummaryColumns        = "code.code_id, code.name, code.preferred_name, code.issuer, code.account, code.created_at, code.deleted, code.deleted_at, code.account_email, code.enrolled_by, code.service_url, code.notes, code.tags"
+	updateCodeQuery           = "update code set preferred_name = $3, account_email = $4, enrolled_by = $5, service_url = $6, notes = $7, tags = $8 where deleted = false and code_group_id = (select id from code_group where group_id = $1) and code_id = $2"
+	setCodePreferredNameQuery = "update code set preferred_name = $3 where deleted = false and code_group_id = (select id from code_group where group_id = $1) and code_id = $2"
+	moveCodeQuery             = "update code set code_group_id = (select id from code_group where group_id = $3) where deleted = false and code_group_id = (select id from code_group where group_id = $1) and code_id = $2"
+	restoreCodeQuery          = "update code set deleted = false, deleted_at = null where deleted = true and code_group_id = (select id from code_group where group_id = $1) and code_id = $2"
+	setCodeKeyQuery           = "update code set issuer = $3, account = $4, fingerprint = $5 where code_group_id = (select id from code_group where group_id = $1) and code_id = $2"
+	// groupOrder and codeOrder put a member's own order first, then the rest oldest first. They need code_group_member
+	// and code_preference to be joined for the member.
+	groupOrder         = "code_group_member.sort_order is null, code_group_member.sort_order, code_group.id"
+	codeOrder          = "code_preference.sort_order is null, code_preference.sort_order, code.id"
+	codePreferenceJoin = "left join code_preference on code_preference.code_id = code.id and code_preference.member_id = $1"
+	listGroupsQuery    = "select code_group.group_id, code_group.name, code_group_member.role from code_group join code_group_member on code_group_member.code_group_id = code_group.id where code_group_member.member_id = $1 order by " + groupOrder
+	listCodesQuery     = "select coalesce(code_preference.favorite, false), " + codeSummaryColumns + " from code join code_group on code_group.id = code.code_group_id " + codePreferenceJoin + " where code_group.group_id = $2 order by " + codeOrder
+	// listFavoriteCodesQuery only lists codes in groups that the member still belongs to
+	listFavoriteCodesQuery = "select code_group.group_id, code_group.name, code_preference.favorite, " + codeSummaryColumns + " from code_preference join code on code.id = code_preference.code_id join code_group on code_group.id = code.code_group_id join code_group_member on code_group_member.code_group_id = code_group.id and code_group_member.member_id = code_preference.member_id where code_preference.member_id = $1 and code_preference.favorite = true and code.deleted = false order by " + groupOrder + ", " + codeOrder
+	clearGroupOrderQuery   = "update code_group_member set sort_order = null where member_id = $1"
+	setGroupOrderQuery     = "update code_group_member set sort_order = $3 where member_id = $1 and code_group_id = (select id from code_group where group_id = $2)"
+	clearCodeOrderQuery    = "update code_preference set sort_order = null where member_id = $1 and code_id in (select code.id from code join code_group on code_group.id = code.code_group_id where code_group.group_id = $2)"
+	// The casts let Postgres find the types of parameters that are only selected
+	setCodeOrderQuery    = "insert into code_preference (member_id, code_id, sort_order) select $1, code.id, cast($4 as integer) from code join code_group on code_group.id = code.code_group_id where code_group.group_id = $2 and code.code_id = $3 on conflict (member_id, code_id) do update set sort_order = excluded.sort_order"
+	setCodeFavoriteQuery = "insert into code_preference (member_id, code_id, favorite) select $1, code.id, cast($4 as boolean) from code join code_group on code_group.id = code.code_group_id where code_group.group_id = $2 and code.code_id = $3 on conflict (member_id, code_id) do update set favorite = excluded.favorite"
+)
+
+// auditedTx runs fn in a transaction for the database stores, appending the event in the same transaction once fn has
+// made its change. If fn fails then the event isn't appended, and if the event can't be appended then the change is
+// rolled back.
+func auditedTx(ctx context.Context, db *sql.DB, event *AuditEvent, appendEvent func(ctx context.Context, tx *sql.Tx, event *AuditEvent) error, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer rollback(tx)
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := appendEvent(ctx, tx, event); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// appendAuditEvent adds the event to the end of its owner's chain in the transaction for the database stores. The
+// caller must stop concurrent appends for the same owner until the transaction ends.
+func appendAuditEvent(ctx context.Context, tx *sql.Tx, event *AuditEvent, now time.Time) error {
+	lastSequence := int64(0)
+	lastHash := auditGenesisHash
+	err := tx.QueryRowContext(ctx, "select sequence, hash from audit_event where owner_id = $1 order by sequence desc limit 1", event.OwnerId).Scan(&lastSequence, &lastHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to read audit chain: %w", err)
+	}
+
+	err = chainAuditEvent(event, lastSequence, lastHash, now)
+	if err != nil {
+		return fmt.Errorf("failed to hash audit event: %w", err)
+	}
+
+	err = tx.QueryRowContext(ctx, "insert into audit_event (owner_id, sequence, event_type, ip, user_agent, group_id, code_id, detail, created_at, prev_hash, hash) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id", event.OwnerId, event.Sequence, event.EventType, event.Ip, event.UserAgent, event.GroupId, event.CodeId, event.Detail, event.CreatedAt, event.PrevHash, event.Hash).Scan(&event.Id)
+	if err != nil {
+		return fmt.Errorf("failed to insert audit event: %w", err)
+	}
+
+	return nil
+}
+
+// applyCodeOperations applies each operation in the transaction for the database stores, appending the operation's
+// event after it is applied. In a best effort batch each operation has a savepoint, because a failed statement aborts a
+// Postgres transaction. Returns the results of the operations, and whether the transaction should be committed.
+func applyCodeOperations(ctx context.Context, tx *sql.Tx, operations []CodeOperation, events []*AuditEvent, bestEffort bool, appendEvent func(ctx context.Context, tx *sql.Tx, event *AuditEvent) error, apply func(operation CodeOperation) error) ([]error, bool, error) {
+	results := make([]error, len(operations))
+	for i, operation := range operations {
+		if bestEffort {
+			if _, err := tx.ExecContext(ctx, "savepoint code_operation"); err != nil {
+				return nil, false, err
+			}
+		}
+
+		err := apply(operation)
+		if err == nil {
+			err = appendEvent(ctx, tx, events[i])
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrAlreadyExists) {
+			return nil, false, fmt.Errorf("failed to apply %s to code %s: %w", operation.Op, operation.CodeId, err)
+		}
+		results[i] = err
+
+		if !bestEffort {
+			if err != nil {
+				return results, false, nil
+			}
+			continue
+		}
+
+		if err != nil {
+			if _, err := tx.ExecContext(ctx, "rollback to savepoint code_operation"); err != nil {
+				return nil, false, err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "release savepoint code_operation"); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return results, true, nil
+}
+
+// checkRestoreDuplicate returns ErrAlreadyExists if restoring a deleted code would duplicate a code that isn't deleted,
+// in any group that the identity is a member of. Restoring a code that isn't deleted is ErrNotFound.
+func checkRestoreDuplicate(ctx context.Context, tx *sql.Tx, memberId string, operation CodeOperation) error {
+	var fingerprint *string
+	err := tx.QueryRowContext(ctx, "select fingerprint from code where deleted = true and code_group_id = (select id from code_group where group_id = $1) and code_id = $2", operation.GroupId, operation.CodeId).Scan(&fingerprint)
+	if err != nil {
+		return notFound(err)
+	}
+	if fingerprint == nil {
+		return nil
+	}
+
+	var location CodeLocation
+	err = tx.QueryRowContext(ctx, findCodeByFingerprintQuery+" and code.deleted = false limit 1", memberId, *fingerprint).Scan(&location.GroupId, &location.CodeId)
+	if err == nil {
+		return ErrAlreadyExists
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	return nil
+}
+
+// codeSearchText is the text of a code that searches match, which has a trigram index in Postgres
+const codeSearchText = "(coalesce(code.name, '') || ' ' || coalesce(code.preferred_name, '') || ' ' || coalesce(code.issuer, '') || ' ' || coalesce(code.account, '') || ' ' || coalesce(code.notes, ''))"
+
+// scanCodeSummary scans the codeSummaryColumns into the code, after any other columns that are selected first.
+func scanCodeSummary(row interface{ Scan(...any) error }, code *CodeSummary, other ...any) error {
+	var tags *string
+	err := row.Scan(append(other, &code.CodeId, &code.Name, &code.PreferredName, &code.Issuer, &code.Account, &code.CreatedAt, &code.Deleted, &code.DeletedAt, &code.AccountEmail, &code.EnrolledBy, &code.ServiceUrl, &code.Notes, &tags)...)
+	if err != nil {
+		return err
+	}
+	code.Tags = splitTags(tags)
+
+	return nil
+}
+
+// querySearchCodes runs a search for the database stores, where like is the database's case insensitive like operator.
+// One more code than the limit is read to find out whether there is another page.
+func querySearchCodes(ctx context.Context, db *sql.DB, like string, memberId string, search CodeSearch) (*CodeSearchResponse, error) {
+	args := []any{memberId}
+	arg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	query := strings.Builder{}
+	query.WriteString("select code.id, code_group.group_id, code_group.name, coalesce(code_preference.favorite, false), " + codeSummaryColumns + " from code join code_group on code_group.id = code.code_group_id join code_group_member on code_group_member.code_group_id = code_group.id " + codePreferenceJoin + " where code_group_member.member_id = $1")
+	for _, term := range search.Terms {
+		query.WriteString(" and " + codeSearchText + " " + like + " " + arg(likePattern(term)) + " escape '\\'")
+	}
+	for _, tag := range search.Tags {
+		query.WriteString(" and ' ' || code.tags || ' ' like " + arg("% "+escapeLike(tag)+" %") + " escape '\\'")
+	}
+	if search.GroupId != "" {
+		query.WriteString(" and code_group.group_id = " + arg(search.GroupId))
+	}
+	if search.Deleted != nil {
+		query.WriteString(" and code.deleted = " + arg(*search.Deleted))
+	}
+	if search.CreatedAfter != nil {
+		query.WriteString(" and code.created_at >= " + arg(search.CreatedAfter.UTC()))
+	}
+	if search.CreatedBefore != nil {
+		query.WriteString(" and code.created_at < " + arg(search.CreatedBefore.UTC()))
+	}
+	if search.Cursor > 0 {
+		query.WriteString(" and code.id < " + arg(search.Cursor))
+	}
+	query.WriteString(" order by code.id desc limit " + arg(search.Limit+1))
+
+	rows, err := db.QueryContext(ctx, query.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	response := &CodeSearchResponse{Codes: make([]CodeSearchResult, 0)}
+	var lastId int64
+	for rows.Next() {
+		if len(response.Codes) == search.Limit {
+			response.NextCursor = codeCursor(lastId)
+			break
+		}
+
+		var code CodeSearchResult
+		err = scanCodeSummary(rows, &code.CodeSummary, &lastId, &code.GroupId, &code.GroupName, &code.Favorite)
+		if err != nil {
+			return nil, err
+		}
+		response.Codes = append(response.Codes, code)
+	}
+
+	return response, rows.Err()
+}
+
+// applyOrder sets the order of ids for the database stores, in a transaction. The clear query resets the order of
+// everything that can be ordered, and the set query is run for each id with the args, the id and then its position.
+func applyOrder(ctx context.Context, db *sql.DB, clear string, set string, ids []string, args ...any) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+
+	_, err = tx.ExecContext(ctx, clear, args...)
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		if err := requireAffected(tx.ExecContext(ctx, set, slices.Concat(args, []any{id, i})...)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func queryCodes(ctx context.Context, db *sql.DB, memberId string, groupId string) ([]CodeSummary, error) {
+	rows, err := db.QueryContext(ctx, listCodesQuery, memberId, groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]CodeSummary, 0)
+	for rows.Next() {
+		var code CodeSummary
+		err = scanCodeSummary(rows, &code, &code.Favorite)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, code)
+	}
+
+	return out, rows.Err()
+}
+
+func queryFavoriteCodes(ctx context.Context, db *sql.DB, memberId string) ([]CodeSearchResult, error) {
+	rows, err := db.QueryContext(ctx, listFavoriteCodesQuery, memberId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]CodeSearchResult, 0)
+	for rows.Next() {
+		var code CodeSearchResult
+		err = scanCodeSummary(rows, &code.CodeSummary, &code.GroupId, &code.GroupName, &code.Favorite)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, code)
+	}
+
+	return out, rows.Err()
+}
+
+func queryCodeOriginals(ctx context.Context, db *sql.DB, query string, args ...any) ([]CodeOriginal, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]CodeOriginal, 0)
+	for rows.Next() {
+		var code CodeOriginal
+		err = rows.Scan(&code.GroupId, &code.CodeId, &code.Original)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, code)
+	}
+
+	return out, rows.Err()
+}
+
+func queryAuditEvents(ctx context.Context, db *sql.DB, query string, args ...any) ([]AuditEvent, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]AuditEvent, 0)
+	for rows.Next() {
+		var event AuditEvent
+		err := rows.Scan(&event.Id, &event.OwnerId, &event.Sequence, &event.EventType, &event.Ip, &event.UserAgent, &event.GroupId, &event.CodeId, &event.Detail, &event.CreatedAt, &event.PrevHash, &event.Hash)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, event)
+	}
+
+	return out, rows.Err()
+}
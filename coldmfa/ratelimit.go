@@ -0,0 +1,170 @@
+package coldmfa
+
+import (
+	"context"
+	"fmt"
+	"github.com/EphyraSoftware/locus/auth"
+	"github.com/EphyraSoftware/locus/metrics"
+	"github.com/EphyraSoftware/locus/ratelimit"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ipLimitFactor scales the per-identity limits for the per-IP limits, so that several users behind the same NAT don't
+// block each other, while a single address still can't get around the limits by cycling through identities.
+const ipLimitFactor = 5
+
+const (
+	rateLimitCleanupInterval = 10 * time.Minute
+	// Buckets that haven't been used for this long are removed. It must be longer than the slowest limit takes to
+	// refill, otherwise removing a bucket would reset a lockout early.
+	rateLimitMaxIdle = 24 * time.Hour
+)
+
+const (
+	rateLimitPasscode       = "passcode"
+	rateLimitBackup         = "backup"
+	rateLimitDecryptFailure = "decrypt_failure"
+)
+
+type RateLimits struct {
+	// Shared keeps the buckets in the database so that limits apply across replicas, otherwise they are per replica
+	Shared bool
+	// Passcode limits generating passcodes
+	Passcode ratelimit.Limit
+	// Backup limits creating and restoring backups, which are expensive because the password is stretched with scrypt
+	Backup ratelimit.Limit
+	// DecryptFailure limits failed attempts to decrypt a backup. Once the bucket is empty, restoring is locked out
+	// until it refills, so that the restore endpoint can't be used to guess backup passwords.
+	DecryptFailure ratelimit.Limit
+}
+
+func (l *RateLimits) byName(name string) ratelimit.Limit {
+	switch name {
+	case rateLimitPasscode:
+		return l.Passcode
+	case rateLimitBackup:
+		return l.Backup
+	case rateLimitDecryptFailure:
+		return l.DecryptFailure
+	default:
+		panic(fmt.Sprintf("unknown rate limit %q", name))
+	}
+}
+
+type rateLimitKey struct {
+	by  string
+	key string
+}
+
+// rateLimitKeys returns the keys for the per-identity and per-IP buckets of the named limit.
+func rateLimitKeys(c *fiber.Ctx, name string) []rateLimitKey {
+	return []rateLimitKey{
+		{by: "identity", key: fmt.Sprintf("%s:identity:%s", name, auth.SessionId(c))},
+		{by: "ip", key: fmt.Sprintf("%s:ip:%s", name, c.IP())},
+	}
+}
+
+func (k rateLimitKey) limit(limit ratelimit.Limit) ratelimit.Limit {
+	if k.by == "ip" {
+		return limit.Scale(ipLimitFactor)
+	}
+	return limit
+}
+
+func (a *App) prepareRateLimits(ctx context.Context) {
+	if a.RateLimits == nil {
+		return
+	}
+
+	if a.RateLimits.Shared && a.db != nil && !isSQLiteUrl(a.DatabaseUrl) {
+		a.rateLimitStore = ratelimit.NewPostgresStore(a.db)
+	} else {
+		if a.RateLimits.Shared {
+			log.Warn("Shared rate limits need the app to open its own Postgres database, keeping rate limits in memory")
+		}
+		a.rateLimitStore = ratelimit.NewMemoryStore()
+	}
+
+	a.background.Add(1)
+	go func() {
+		defer a.background.Done()
+		ratelimit.RunCleanup(ctx, a.rateLimitStore, rateLimitCleanupInterval, rateLimitMaxIdle, func(err error) {
+			log.Errorf("failed to clean up rate limits: %s", err.Error())
+		})
+	}()
+}
+
+// rateLimit creates a handler that takes a token from the per-identity and per-IP buckets of the named limit, and
+// rejects the request if either is empty. It must come after authentication so that the identity is known.
+func (a *App) rateLimit(name string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if a.rateLimitStore == nil || auth.SessionId(c) == "" {
+			return c.Next()
+		}
+
+		for _, key := range rateLimitKeys(c, name) {
+			res, err := a.rateLimitStore.Take(c.UserContext(), key.key, key.limit(a.RateLimits.byName(name)), time.Now())
+			if err != nil {
+				log.Errorf("failed to check rate limit: %s", err.Error())
+				return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+			}
+			if !res.Allowed {
+				metrics.RateLimited(name, key.by)
+				return tooManyRequests(c, res.RetryAfter)
+			}
+		}
+
+		return c.Next()
+	}
+}
+
+// checkDecryptLockout rejects the request if there have been too many failed attempts to decrypt a backup. Returns
+// false if a response has been sent.
+func (a *App) checkDecryptLockout(c *fiber.Ctx) (bool, error) {
+	if a.rateLimitStore == nil {
+		return true, nil
+	}
+
+	for _, key := range rateLimitKeys(c, rateLimitDecryptFailure) {
+		res, err := a.rateLimitStore.Peek(c.UserContext(), key.key, key.limit(a.RateLimits.DecryptFailure), time.Now())
+		if err != nil {
+			log.Errorf("failed to check decrypt lockout: %s", err.Error())
+			return false, c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "internal error"})
+		}
+		if !res.Allowed {
+			metrics.RateLimited(rateLimitDecryptFailure, key.by)
+			return false, tooManyRequests(c, res.RetryAfter)
+		}
+	}
+
+	return true, nil
+}
+
+// recordDecryptFailure counts a failed attempt to decrypt a backup towards the lockout.
+func (a *App) recordDecryptFailure(c *fiber.Ctx) {
+	if a.rateLimitStore == nil {
+		return
+	}
+
+	for _, key := range rateLimitKeys(c, rateLimitDecryptFailure) {
+		_, err := a.rateLimitStore.Take(c.UserContext(), key.key, key.limit(a.RateLimits.DecryptFailure), time.Now())
+		if err != nil {
+			log.Errorf("failed to record decrypt failure: %s", err.Error())
+		}
+	}
+}
+
+func tooManyRequests(c *fiber.Ctx, retryAfter time.Duration) error {
+	seconds := math.Ceil(retryAfter.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Set(fiber.HeaderRetryAfter, strconv.FormatInt(int64(seconds), 10))
+
+	return c.Status(http.StatusTooManyRequests).JSON(ApiError{Error: "too many requests"})
+}
@@ -0,0 +1,126 @@
+package coldmfa
+
+import (
+	"errors"
+	"github.com/EphyraSoftware/locus/auth"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSearchPageSize = 50
+	maxSearchPageSize     = 200
+	// maxSearchTerms limits how many conditions a search can add to the query
+	maxSearchTerms = 10
+)
+
+func (a *App) prepareSearch(api fiber.Router, store Store) {
+	api.Get("/codes", func(c *fiber.Ctx) error {
+		sessionId := auth.SessionId(c)
+		if sessionId == "" {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		search, err := codeSearch(c)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(ApiError{Error: err.Error()})
+		}
+
+		response, err := store.SearchCodes(c.UserContext(), sessionId, *search)
+		if err != nil {
+			log.Errorf("failed to search codes: %s", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(ApiError{Error: "database error"})
+		}
+
+		return c.Status(http.StatusOK).JSON(response)
+	})
+}
+
+// codeSearch reads a search from the query. The search text is split into terms on spaces, and codes that aren't
+// deleted are found unless deleted is true, or any to include both. Codes have to have every tag parameter.
+func codeSearch(c *fiber.Ctx) (*CodeSearch, error) {
+	search := CodeSearch{
+		Terms:   strings.Fields(c.Query("q")),
+		Tags:    queryTags(c),
+		GroupId: c.Query("groupId"),
+		Limit:   defaultSearchPageSize,
+	}
+	if len(search.Terms)+len(search.Tags) > maxSearchTerms {
+		return nil, errors.New("too many search terms")
+	}
+
+	switch c.Query("deleted") {
+	case "", "false":
+		search.Deleted = new(bool)
+	case "true":
+		deleted := true
+		search.Deleted = &deleted
+	case "any":
+	default:
+		return nil, errors.New("invalid deleted")
+	}
+
+	var err error
+	search.CreatedAfter, err = queryTime(c, "createdAfter")
+	if err != nil {
+		return nil, err
+	}
+	search.CreatedBefore, err = queryTime(c, "createdBefore")
+	if err != nil {
+		return nil, err
+	}
+
+	if raw := c.Query("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 || parsed > maxSearchPageSize {
+			return nil, errors.New("invalid limit")
+		}
+		search.Limit = parsed
+	}
+
+	if raw := c.Query("cursor"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || parsed < 1 {
+			return nil, errors.New("invalid cursor")
+		}
+		search.Cursor = parsed
+	}
+
+	return &search, nil
+}
+
+// queryTime reads an optional RFC 3339 time from the query.
+func queryTime(c *fiber.Ctx, name string) (*time.Time, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return nil, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return nil, errors.New("invalid " + name)
+	}
+
+	return &parsed, nil
+}
+
+// codeCursor is the cursor for the page after a code, which is the store's id for the code because codes are found
+// newest first.
+func codeCursor(id int64) *string {
+	cursor := strconv.FormatInt(id, 10)
+	return &cursor
+}
+
+// likePattern matches text containing the term.
+func likePattern(term string) string {
+	return "%" + escapeLike(term) + "%"
+}
+
+// escapeLike escapes the wildcards of like with a backslash.
+func escapeLike(text string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(text)
+}
@@ -0,0 +1,66 @@
+package coldmfa
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSearchCodes(t *testing.T) {
+	forEachStore(t, testSearchCodes)
+}
+
+func testSearchCodes(t *testing.T, app *testApp) {
+	start := time.Now().Add(-time.Minute)
+	personal := app.createGroup("alice", "personal")
+	work := app.createGroup("alice", "work")
+	aws := app.createCode("alice", work.GroupId, "otpauth://totp/AWS:root@example.com?secret=MFRGGZDFMZTWQ2LK&issuer=AWS")
+	example := app.createCode("alice", personal.GroupId, testOriginal)
+	other := app.createCode("alice", personal.GroupId, testOtherOriginal)
+	app.createCode("bob", app.createGroup("bob", "personal").GroupId, "otpauth://totp/AWS:bob@example.com?secret=KRSXG5CTMVRXEZLU&issuer=AWS")
+
+	for _, invalid := range []string{"limit=0", "limit=1000", "cursor=abc", "deleted=maybe", "createdAfter=yesterday"} {
+		app.expect(http.StatusBadRequest, "alice", http.MethodGet, "/codes?"+invalid, nil, nil)
+	}
+
+	// Newest first, and only in the identity's groups
+	all := app.search("alice", url.Values{})
+	expectCodes(t, all, other.CodeId, example.CodeId, aws.CodeId)
+	if all.NextCursor != nil || all.Codes[2].GroupId != work.GroupId || all.Codes[2].GroupName != "work" {
+		t.Fatalf("expected a single page with the group of each code, got %+v", all)
+	}
+
+	expectCodes(t, app.search("alice", url.Values{"q": {"aws"}}), aws.CodeId)
+	expectCodes(t, app.search("alice", url.Values{"q": {"ROOT@"}}), aws.CodeId)
+	expectCodes(t, app.search("alice", url.Values{"q": {"example alice"}}), other.CodeId, example.CodeId)
+	expectCodes(t, app.search("alice", url.Values{"q": {"example other"}}), other.CodeId)
+	expectCodes(t, app.search("alice", url.Values{"q": {"%"}}))
+	expectCodes(t, app.search("alice", url.Values{"groupId": {work.GroupId}}), aws.CodeId)
+	expectCodes(t, app.search("bob", url.Values{"groupId": {work.GroupId}}))
+
+	preferredName := "Team_Shared"
+	app.expect(http.StatusNoContent, "alice", http.MethodPut, "/groups/"+personal.GroupId+"/codes/"+example.CodeId, CodeSummary{PreferredName: &preferredName}, nil)
+	expectCodes(t, app.search("alice", url.Values{"q": {"m_s"}}), example.CodeId)
+	expectCodes(t, app.search("alice", url.Values{"q": {"shared team"}}), example.CodeId)
+
+	app.expect(http.StatusNoContent, "alice", http.MethodDelete, "/groups/"+personal.GroupId+"/codes/"+other.CodeId, nil, nil)
+	expectCodes(t, app.search("alice", url.Values{}), example.CodeId, aws.CodeId)
+	expectCodes(t, app.search("alice", url.Values{"deleted": {"true"}}), other.CodeId)
+	expectCodes(t, app.search("alice", url.Values{"deleted": {"any"}}), other.CodeId, example.CodeId, aws.CodeId)
+
+	expectCodes(t, app.search("alice", url.Values{"createdAfter": {start.Format(time.RFC3339)}}), example.CodeId, aws.CodeId)
+	expectCodes(t, app.search("alice", url.Values{"createdBefore": {start.Format(time.RFC3339)}}))
+
+	// Pages follow on from the cursor until there are no more codes
+	page := app.search("alice", url.Values{"deleted": {"any"}, "limit": {"2"}})
+	expectCodes(t, page, other.CodeId, example.CodeId)
+	if page.NextCursor == nil {
+		t.Fatal("expected a cursor for the next page")
+	}
+	page = app.search("alice", url.Values{"deleted": {"any"}, "limit": {"2"}, "cursor": {*page.NextCursor}})
+	expectCodes(t, page, aws.CodeId)
+	if page.NextCursor != nil {
+		t.Fatalf("expected the last page, got cursor %s", *page.NextCursor)
+	}
+}
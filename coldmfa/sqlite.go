@@ -0,0 +1,573 @@
+package coldmfa
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/golang-migrate/migrate/v4"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// sqliteScheme is the database URL scheme that selects SQLite rather than Postgres.
+const sqliteScheme = "sqlite"
+
+// sqliteConnectionOptions configure every connection to the database. Transactions take the write lock when they
+// begin, so that a transaction which reads before it writes waits for other writers instead of failing.
+var sqliteConnectionOptions = []string{
+	"_pragma=foreign_keys(1)",
+	"_pragma=busy_timeout(5000)",
+	"_pragma=journal_mode(WAL)",
+	"_time_format=sqlite",
+	"_txlock=immediate",
+}
+
+// SQLiteStore is a Store for single node deployments that don't want to run Postgres, backed by the schema in the
+// embedded SQLite migrations.
+//
+// SQLite has no clock of its own that matches the format used to write timestamps, so every time is set by the store in
+// UTC, which makes timestamps compare correctly as text.
+type SQLiteStore struct {
+	db *sql.DB
+	// now is the clock used for created, deleted, revoked and backup times
+	now func() time.Time
+}
+
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{db: db, now: time.Now}
+}
+
+// isSQLiteUrl checks whether a database URL selects the SQLite store.
+func isSQLiteUrl(databaseUrl string) bool {
+	return strings.HasPrefix(databaseUrl, sqliteScheme+"://")
+}
+
+// sqliteDataSource converts a database URL such as sqlite:///var/lib/locus/coldmfa.db to a data source for the SQLite
+// driver, the same way as the golang-migrate SQLite driver so that both open the same file.
+func sqliteDataSource(databaseUrl string) (string, error) {
+	parsed, err := url.Parse(databaseUrl)
+	if err != nil {
+		return "", errors.New("invalid SQLite database URL")
+	}
+
+	dataSource := strings.Replace(migrate.FilterCustomQuery(parsed).String(), sqliteScheme+"://", "", 1)
+	separator := "?"
+	if strings.Contains(dataSource, "?") {
+		separator = "&"
+	}
+
+	return dataSource + separator + strings.Join(sqliteConnectionOptions, "&"), nil
+}
+
+// alreadyExists converts a violated uniqueness constraint to ErrAlreadyExists.
+func alreadyExists(err error) error {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && (sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY) {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+func (s *SQLiteStore) utcNow() time.Time {
+	return s.now().UTC()
+}
+
+// utcTime converts a time from a backup to UTC before it is written.
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	utc := t.UTC()
+	return &utc
+}
+
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *SQLiteStore) ListGroups(ctx context.Context, memberId string) ([]CodeGroup, error) {
+	rows, err := s.db.QueryContext(ctx, listGroupsQuery, memberId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]CodeGroup, 0)
+	for rows.Next() {
+		var group CodeGroup
+		err = rows.Scan(&group.GroupId, &group.Name, &group.Role)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, group)
+	}
+
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) GetGroup(ctx context.Context, memberId string, groupId string) (*CodeGroup, error) {
+	row := s.db.QueryRowContext(ctx, "select code_group.group_id, code_group.name, code_group_member.role from code_group join code_group_member on code_group_member.code_group_id = code_group.id where code_group_member.member_id = $1 and code_group.group_id = $2", memberId, groupId)
+
+	var group CodeGroup
+	err := row.Scan(&group.GroupId, &group.Name, &group.Role)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return &group, nil
+}
+
+func (s *SQLiteStore) CreateGroup(ctx context.Context, creatorId string, creatorEmail *string, groupId string, name string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+
+	now := s.utcNow()
+	var groupDatabaseId int
+	err = tx.QueryRowContext(ctx, "insert into code_group (owner_id, group_id, name, created_at) values ($1, $2, $3, $4) returning id", creatorId, groupId, name, now).Scan(&groupDatabaseId)
+	if err != nil {
+		return fmt.Errorf("failed to insert group: %w", alreadyExists(err))
+	}
+
+	_, err = tx.ExecContext(ctx, "insert into code_group_member (code_group_id, member_id, email, role, created_at) values ($1, $2, $3, $4, $5)", groupDatabaseId, creatorId, creatorEmail, RoleOwner, now)
+	if err != nil {
+		return fmt.Errorf("failed to insert group owner: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) GetMembership(ctx context.Context, memberId string, groupId string) (*Membership, error) {
+	row := s.db.QueryRowContext(ctx, "select code_group.group_id, code_group.owner_id, code_group_member.role from code_group join code_group_member on code_group_member.code_group_id = code_group.id where code_group_member.member_id = $1 and code_group.group_id = $2", memberId, groupId)
+
+	var member Membership
+	err := row.Scan(&member.GroupId, &member.CreatorId, &member.Role)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return &member, nil
+}
+
+func (s *SQLiteStore) ReorderGroups(ctx context.Context, memberId string, groupIds []string) error {
+	return applyOrder(ctx, s.db, clearGroupOrderQuery, setGroupOrderQuery, groupIds, memberId)
+}
+
+func (s *SQLiteStore) ListCodes(ctx context.Context, memberId string, groupId string) ([]CodeSummary, error) {
+	return queryCodes(ctx, s.db, memberId, groupId)
+}
+
+func (s *SQLiteStore) GetCode(ctx context.Context, groupId string, codeId string) (*CodeSummary, error) {
+	row := s.db.QueryRowContext(ctx, "select "+codeSummaryColumns+" from code join code_group on code_group.id = code.code_group_id where code_group.group_id = $1 and code.code_id = $2", groupId, codeId)
+
+	var code CodeSummary
+	err := scanCodeSummary(row, &code)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return &code, nil
+}
+
+func (s *SQLiteStore) SearchCodes(ctx context.Context, memberId string, search CodeSearch) (*CodeSearchResponse, error) {
+	// Like ignores case in SQLite, though only for ASCII
+	return querySearchCodes(ctx, s.db, "like", memberId, search)
+}
+
+func (s *SQLiteStore) GetCodeOriginal(ctx context.Context, groupId string, codeId string) (string, error) {
+	var original string
+	err := s.db.QueryRowContext(ctx, "select code.original from code join code_group on code_group.id = code.code_group_id where code_group.group_id = $1 and code.code_id = $2", groupId, codeId).Scan(&original)
+	return original, notFound(err)
+}
+
+func (s *SQLiteStore) CreateCode(ctx context.Context, groupId string, codeId string, original string, key *OtpKey, fingerprint string, event *AuditEvent) error {
+	issuer, account := keyColumns(key)
+	return s.audited(ctx, event, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, "insert into code (code_group_id, code_id, original, name, issuer, account, fingerprint, created_at) select id, $2, $3, $4, $5, $6, $7, $8 from code_group where group_id = $1", groupId, codeId, original, key.Name(), issuer, account, fingerprint, s.utcNow())
+		return requireAffected(result, alreadyExists(err))
+	})
+}
+
+func (s *SQLiteStore) FindCodeByFingerprint(ctx context.Context, memberId string, fingerprint string) (*CodeLocation, error) {
+	var location CodeLocation
+	err := s.db.QueryRowContext(ctx, findCodeByFingerprintQuery+" and code.deleted = false order by code.id limit 1", memberId, fingerprint).Scan(&location.GroupId, &location.CodeId)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return &location, nil
+}
+
+func (s *SQLiteStore) ListUnparsedCodes(ctx context.Context) ([]CodeOriginal, error) {
+	return queryCodeOriginals(ctx, s.db, listUnparsedCodesQuery)
+}
+
+func (s *SQLiteStore) SetCodeKey(ctx context.Context, groupId string, codeId string, key *OtpKey, fingerprint string) error {
+	issuer, account := keyColumns(key)
+	return requireAffected(s.db.ExecContext(ctx, setCodeKeyQuery, groupId, codeId, issuer, account, fingerprint))
+}
+
+func (s *SQLiteStore) UpdateCode(ctx context.Context, groupId string, codeId string, preferredName *string, metadata CodeMetadata) error {
+	result, err := s.db.ExecContext(ctx, updateCodeQuery, groupId, codeId, preferredName, metadata.AccountEmail, metadata.EnrolledBy, metadata.ServiceUrl, metadata.Notes, joinTags(metadata.Tags))
+	return requireAffected(result, alreadyExists(err))
+}
+
+func (s *SQLiteStore) MoveCode(ctx context.Context, groupId string, codeId string, toGroupId string, event *AuditEvent) error {
+	return s.audited(ctx, event, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, moveCodeQuery, groupId, codeId, toGroupId)
+		return requireAffected(result, alreadyExists(err))
+	})
+}
+
+func (s *SQLiteStore) ReorderCodes(ctx context.Context, memberId string, groupId string, codeIds []string) error {
+	return applyOrder(ctx, s.db, clearCodeOrderQuery, setCodeOrderQuery, codeIds, memberId, groupId)
+}
+
+func (s *SQLiteStore) SetCodeFavorite(ctx context.Context, memberId string, groupId string, codeId string, favorite bool) error {
+	return requireAffected(s.db.ExecContext(ctx, setCodeFavoriteQuery, memberId, groupId, codeId, favorite))
+}
+
+func (s *SQLiteStore) ListFavoriteCodes(ctx context.Context, memberId string) ([]CodeSearchResult, error) {
+	return queryFavoriteCodes(ctx, s.db, memberId)
+}
+
+func (s *SQLiteStore) DeleteCode(ctx context.Context, groupId string, codeId string, event *AuditEvent) error {
+	return s.audited(ctx, event, func(tx *sql.Tx) error {
+		return requireAffected(tx.ExecContext(ctx, "update code set deleted = true, deleted_at = $3 where deleted = false and code_group_id = (select id from code_group where group_id = $1) and code_id = $2", groupId, codeId, s.utcNow()))
+	})
+}
+
+func (s *SQLiteStore) ApplyCodeOperations(ctx context.Context, memberId string, operations []CodeOperation, events []*AuditEvent, bestEffort bool) ([]error, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	results, commit, err := applyCodeOperations(ctx, tx, operations, events, bestEffort, s.appendAuditEvent, func(operation CodeOperation) error {
+		var result sql.Result
+		var err error
+		switch operation.Op {
+		case CodeOpMove:
+			result, err = tx.ExecContext(ctx, moveCodeQuery, operation.GroupId, operation.CodeId, operation.ToGroupId)
+		case CodeOpRename:
+			result, err = tx.ExecContext(ctx, setCodePreferredNameQuery, operation.GroupId, operation.CodeId, operation.PreferredName)
+		case CodeOpDelete:
+			result, err = tx.ExecContext(ctx, "update code set deleted = true, deleted_at = $3 where deleted = false and code_group_id = (select id from code_group where group_id = $1) and code_id = $2", operation.GroupId, operation.CodeId, s.utcNow())
+		case CodeOpRestore:
+			if err := checkRestoreDuplicate(ctx, tx, memberId, operation); err != nil {
+				return err
+			}
+			result, err = tx.ExecContext(ctx, restoreCodeQuery, operation.GroupId, operation.CodeId)
+		default:
+			return fmt.Errorf("unknown code operation %q", operation.Op)
+		}
+		return requireAffected(result, alreadyExists(err))
+	})
+	if err != nil || !commit {
+		return results, err
+	}
+
+	return results, tx.Commit()
+}
+
+func (s *SQLiteStore) ListMembers(ctx context.Context, groupId string) ([]GroupMember, error) {
+	rows, err := s.db.QueryContext(ctx, "select code_group_member.member_id, code_group_member.email, code_group_member.role, code_group_member.created_at, code_group.owner_id from code_group_member join code_group on code_group.id = code_group_member.code_group_id where code_group.group_id = $1 order by code_group_member.created_at, code_group_member.id", groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]GroupMember, 0)
+	for rows.Next() {
+		groupMember, err := scanGroupMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *groupMember)
+	}
+
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) GetMember(ctx context.Context, groupId string, memberId string) (*GroupMember, error) {
+	row := s.db.QueryRowContext(ctx, "select code_group_member.member_id, code_group_member.email, code_group_member.role, code_group_member.created_at, code_group.owner_id from code_group_member join code_group on code_group.id = code_group_member.code_group_id where code_group.group_id = $1 and code_group_member.member_id = $2", groupId, memberId)
+
+	groupMember, err := scanGroupMember(row)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return groupMember, nil
+}
+
+func (s *SQLiteStore) AddMember(ctx context.Context, groupId string, member GroupMember, event *AuditEvent) error {
+	return s.audited(ctx, event, func(tx *sql.Tx) error {
+		err := requireAffected(tx.ExecContext(ctx, "insert into code_group_member (code_group_id, member_id, email, role, created_at) select id, $2, $3, $4, $5 from code_group where group_id = $1 on conflict (code_group_id, member_id) do nothing", groupId, member.MemberId, member.Email, member.Role, s.utcNow()))
+		if errors.Is(err, ErrNotFound) {
+			// Either the group doesn't exist, which the caller has already checked, or the member is already in the group
+			return ErrAlreadyExists
+		}
+
+		return err
+	})
+}
+
+func (s *SQLiteStore) UpdateMemberRole(ctx context.Context, groupId string, memberId string, role Role, event *AuditEvent) error {
+	return s.audited(ctx, event, func(tx *sql.Tx) error {
+		return requireAffected(tx.ExecContext(ctx, "update code_group_member set role = $3 where code_group_id = (select id from code_group where group_id = $1) and member_id = $2", groupId, memberId, role))
+	})
+}
+
+func (s *SQLiteStore) RemoveMember(ctx context.Context, groupId string, memberId string, event *AuditEvent) error {
+	return s.audited(ctx, event, func(tx *sql.Tx) error {
+		return requireAffected(tx.ExecContext(ctx, "delete from code_group_member where code_group_id = (select id from code_group where group_id = $1) and member_id = $2", groupId, memberId))
+	})
+}
+
+func (s *SQLiteStore) GetGrantedOriginal(ctx context.Context, granteeId string, groupId string, codeId string) (string, error) {
+	row := s.db.QueryRowContext(ctx, "select code.original from code_grant join code on code.id = code_grant.code_id join code_group on code_group.id = code.code_group_id where code_group.group_id = $1 and code.code_id = $2 and code.deleted = false and code_grant.grantee_id = $3 and code_grant.revoked_at is null and code_grant.expires_at > $4", groupId, codeId, granteeId, s.utcNow())
+
+	var original string
+	err := row.Scan(&original)
+	return original, notFound(err)
+}
+
+func (s *SQLiteStore) ListGrantedCodes(ctx context.Context, granteeId string) ([]GrantedCode, error) {
+	rows, err := s.db.QueryContext(ctx, "select code_grant.grant_id, code_group.group_id, code.code_id, code.name, code.preferred_name, code_grant.granted_by, code_grant.expires_at from code_grant join code on code.id = code_grant.code_id join code_group on code_group.id = code.code_group_id where code_grant.grantee_id = $1 and code.deleted = false and code_grant.revoked_at is null and code_grant.expires_at > $2 order by code_grant.expires_at, code_grant.id", granteeId, s.utcNow())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]GrantedCode, 0)
+	for rows.Next() {
+		var grantedCode GrantedCode
+		err = rows.Scan(&grantedCode.GrantId, &grantedCode.GroupId, &grantedCode.CodeId, &grantedCode.Name, &grantedCode.PreferredName, &grantedCode.GrantedBy, &grantedCode.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, grantedCode)
+	}
+
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) ListCodeGrants(ctx context.Context, groupId string, codeId string) ([]CodeGrant, error) {
+	rows, err := s.db.QueryContext(ctx, "select code_grant.grant_id, code_grant.grantee_id, code_grant.grantee_email, code_grant.granted_by, code_grant.created_at, code_grant.expires_at from code_grant join code on code.id = code_grant.code_id join code_group on code_group.id = code.code_group_id where code_group.group_id = $1 and code.code_id = $2 and code_grant.revoked_at is null and code_grant.expires_at > $3 order by code_grant.created_at, code_grant.id", groupId, codeId, s.utcNow())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]CodeGrant, 0)
+	for rows.Next() {
+		var grant CodeGrant
+		err = rows.Scan(&grant.GrantId, &grant.GranteeId, &grant.GranteeEmail, &grant.GrantedBy, &grant.CreatedAt, &grant.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, grant)
+	}
+
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) CreateGrant(ctx context.Context, groupId string, codeId string, grant CodeGrant, event *AuditEvent) (*CodeGrant, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	var codeDatabaseId int
+	err = tx.QueryRowContext(ctx, "select code.id from code join code_group on code_group.id = code.code_group_id where code_group.group_id = $1 and code.code_id = $2 and code.deleted = false", groupId, codeId).Scan(&codeDatabaseId)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	now := s.utcNow()
+
+	// A new grant replaces any existing grant for the same user, so that there is only one expiry to reason about
+	_, err = tx.ExecContext(ctx, "update code_grant set revoked_at = $4, revoked_by = $3 where code_id = $1 and grantee_id = $2 and revoked_at is null", codeDatabaseId, grant.GranteeId, grant.GrantedBy, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to replace grant: %w", err)
+	}
+
+	var created CodeGrant
+	err = tx.QueryRowContext(ctx, "insert into code_grant (grant_id, code_id, grantee_id, grantee_email, granted_by, created_at, expires_at) values ($1, $2, $3, $4, $5, $6, $7) returning grant_id, grantee_id, grantee_email, granted_by, created_at, expires_at", grant.GrantId, codeDatabaseId, grant.GranteeId, grant.GranteeEmail, grant.GrantedBy, now, grant.ExpiresAt.UTC()).Scan(&created.GrantId, &created.GranteeId, &created.GranteeEmail, &created.GrantedBy, &created.CreatedAt, &created.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert grant: %w", err)
+	}
+
+	if err := s.appendAuditEvent(ctx, tx, event); err != nil {
+		return nil, err
+	}
+
+	return &created, tx.Commit()
+}
+
+func (s *SQLiteStore) RevokeGrant(ctx context.Context, groupId string, codeId string, grantId string, revokedBy string, event *AuditEvent) error {
+	return s.audited(ctx, event, func(tx *sql.Tx) error {
+		return requireAffected(tx.ExecContext(ctx, "update code_grant set revoked_at = $5, revoked_by = $4 where grant_id = $3 and revoked_at is null and code_id = (select code.id from code join code_group on code_group.id = code.code_group_id where code_group.group_id = $1 and code.code_id = $2)", groupId, codeId, grantId, revokedBy, s.utcNow()))
+	})
+}
+
+func (s *SQLiteStore) ListBackupItems(ctx context.Context, ownerId string) ([]BackupItem, error) {
+	// Shared groups are included in the backups of all of their owners
+	rows, err := s.db.QueryContext(ctx, "select code_group.name, code.original, code.name as code_name, code.preferred_name, code.created_at, code.deleted, code.deleted_at, code.account_email, code.enrolled_by, code.service_url, code.notes, code.tags from code_group join code_group_member on code_group_member.code_group_id = code_group.id left join code on code.code_group_id = code_group.id where code_group_member.member_id = $1 and code_group_member.role = $2 order by code_group.id, code.id", ownerId, RoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]BackupItem, 0)
+	for rows.Next() {
+		var item BackupItem
+		var tags *string
+		err = rows.Scan(&item.GroupName, &item.Original, &item.CodeName, &item.PreferredName, &item.CreatedAt, &item.Deleted, &item.DeletedAt, &item.AccountEmail, &item.EnrolledBy, &item.ServiceUrl, &item.Notes, &tags)
+		if err != nil {
+			return nil, err
+		}
+		if tags != nil {
+			item.Tags = splitTags(tags)
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+func (s *SQLiteStore) RestoreBackup(ctx context.Context, ownerId string, ownerEmail *string, items []RestoreItem, event *AuditEvent) ([]CodeLocation, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	existing := make([]CodeLocation, 0)
+
+	now := s.utcNow()
+	for _, item := range items {
+		// Codes are restored into a group with the same name that the identity owns, which is any group in its backups
+		var groupDatabaseId int
+		err = tx.QueryRowContext(ctx, findOwnedGroupQuery, ownerId, RoleOwner, item.GroupName).Scan(&groupDatabaseId)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = tx.QueryRowContext(ctx, "insert into code_group (owner_id, group_id, name, created_at) values ($1, $2, $3, $4) returning id", ownerId, item.GroupId, item.GroupName, now).Scan(&groupDatabaseId)
+			if err != nil {
+				return nil, fmt.Errorf("failed to insert group: %w", err)
+			}
+
+			_, err = tx.ExecContext(ctx, "insert into code_group_member (code_group_id, member_id, email, role, created_at) values ($1, $2, $3, $4, $5)", groupDatabaseId, ownerId, ownerEmail, RoleOwner, now)
+			if err != nil {
+				return nil, fmt.Errorf("failed to insert group owner: %w", err)
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read group: %w", err)
+		}
+
+		if item.CodeName == nil {
+			continue
+		}
+
+		if item.Fingerprint != nil {
+			var location CodeLocation
+			err = tx.QueryRowContext(ctx, findCodeByFingerprintQuery+" order by code.id limit 1", ownerId, *item.Fingerprint).Scan(&location.GroupId, &location.CodeId)
+			if err == nil {
+				existing = append(existing, location)
+				continue
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				return nil, fmt.Errorf("failed to find code: %w", err)
+			}
+		}
+
+		issuer, account := keyColumns(item.Key)
+		_, err = tx.ExecContext(ctx, "insert into code (code_group_id, code_id, original, name, preferred_name, issuer, account, fingerprint, created_at, deleted, deleted_at, account_email, enrolled_by, service_url, notes, tags) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) on conflict (code_group_id, original) do nothing", groupDatabaseId, item.CodeId, item.Original, item.CodeName, item.PreferredName, issuer, account, item.Fingerprint, utcTime(item.CreatedAt), item.Deleted, utcTime(item.DeletedAt), item.AccountEmail, item.EnrolledBy, item.ServiceUrl, item.Notes, joinTags(item.Tags))
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert code: %w", alreadyExists(err))
+		}
+	}
+
+	if err := s.appendAuditEvent(ctx, tx, event); err != nil {
+		return nil, err
+	}
+
+	return existing, tx.Commit()
+}
+
+func (s *SQLiteStore) RecordBackup(ctx context.Context, ownerId string) error {
+	_, err := s.db.ExecContext(ctx, "insert into last_backup (owner_id, backup_at) values ($1, $2) on conflict (owner_id) do update set backup_at = excluded.backup_at", ownerId, s.utcNow())
+	return err
+}
+
+func (s *SQLiteStore) GetBackupWarning(ctx context.Context, ownerId string) (*BackupWarning, error) {
+	var warning BackupWarning
+	err := s.db.QueryRowContext(ctx, "select last_backup.backup_at from last_backup where last_backup.owner_id = $1", ownerId).Scan(&warning.LastBackupAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	err = s.db.QueryRowContext(ctx, "select count(code.id) from last_backup left join code_group_member on code_group_member.member_id = last_backup.owner_id and code_group_member.role = $2 left join code on code.code_group_id = code_group_member.code_group_id where last_backup.owner_id = $1 and code.created_at > last_backup.backup_at group by last_backup.owner_id, last_backup.backup_at", ownerId, RoleOwner).Scan(&warning.NumberNotBackedUp)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return &warning, nil
+}
+
+func (s *SQLiteStore) CountBackupOverdue(ctx context.Context) (int, error) {
+	var overdue int
+	err := s.db.QueryRowContext(ctx, "select count(distinct code_group_member.member_id) from code_group_member join code on code.code_group_id = code_group_member.code_group_id left join last_backup on last_backup.owner_id = code_group_member.member_id where code_group_member.role = $1 and code.deleted = false and (last_backup.backup_at is null or code.created_at > last_backup.backup_at)", RoleOwner).Scan(&overdue)
+	return overdue, err
+}
+
+func (s *SQLiteStore) GetInstanceKey(ctx context.Context, name string, generated []byte) ([]byte, error) {
+	_, err := s.db.ExecContext(ctx, "insert into instance_key (name, value) values ($1, $2) on conflict (name) do nothing", name, generated)
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	err = s.db.QueryRowContext(ctx, "select value from instance_key where name = $1", name).Scan(&key)
+	return key, err
+}
+
+func (s *SQLiteStore) AppendAuditEvent(ctx context.Context, event *AuditEvent) error {
+	return s.audited(ctx, event, func(tx *sql.Tx) error {
+		return nil
+	})
+}
+
+// audited runs fn in a transaction that appends the event once fn has made its change.
+func (s *SQLiteStore) audited(ctx context.Context, event *AuditEvent, fn func(tx *sql.Tx) error) error {
+	return auditedTx(ctx, s.db, event, s.appendAuditEvent, fn)
+}
+
+// appendAuditEvent appends the event in the transaction, if there is one. Transactions take the write lock when they
+// begin, so concurrent requests can't fork the owner's chain.
+func (s *SQLiteStore) appendAuditEvent(ctx context.Context, tx *sql.Tx, event *AuditEvent) error {
+	if event == nil {
+		return nil
+	}
+
+	return appendAuditEvent(ctx, tx, event, s.now())
+}
+
+func (s *SQLiteStore) ListAuditEvents(ctx context.Context, ownerId string, before int64, limit int) ([]AuditEvent, error) {
+	return queryAuditEvents(ctx, s.db, "select "+auditEventColumns+" from audit_event where owner_id = $1 and id < $2 order by id desc limit $3", ownerId, before, limit)
+}
+
+func (s *SQLiteStore) ListGroupAuditEvents(ctx context.Context, groupId string, before int64, limit int) ([]AuditEvent, error) {
+	return queryAuditEvents(ctx, s.db, "select "+auditEventColumns+" from audit_event where group_id = $1 and id < $2 order by id desc limit $3", groupId, before, limit)
+}
+
+func (s *SQLiteStore) ListAuditEventsAfter(ctx context.Context, ownerId string, sequence int64, limit int) ([]AuditEvent, error) {
+	return queryAuditEvents(ctx, s.db, "select "+auditEventColumns+" from audit_event where (owner_id, sequence) > ($1, $2) order by owner_id, sequence limit $3", ownerId, sequence, limit)
+}
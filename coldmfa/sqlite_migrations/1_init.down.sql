@@ -0,0 +1,6 @@
+drop table audit_event;
+drop table code_grant;
+drop table code_group_member;
+drop table last_backup;
+drop table code;
+drop table code_group;
@@ -0,0 +1,130 @@
+-- SQLite databases start from the same schema as Postgres after 4_audit_log, rather than replaying the Postgres
+-- migrations. Timestamps are written by the app in UTC, so that they compare correctly as text.
+
+create table code_group
+(
+    id         integer primary key autoincrement,
+    owner_id   text      not null,
+    group_id   text      not null,
+    name       text      not null,
+    created_at timestamp not null default current_timestamp,
+    constraint owner_id_group_id_unique
+        unique (owner_id, group_id),
+    constraint owner_id_name_unique
+        unique (owner_id, name)
+);
+
+create table code
+(
+    id             integer primary key autoincrement,
+    code_group_id  integer   not null,
+    code_id        text      not null,
+
+    original       text      not null,   -- The original information provided to seed the code
+
+    name           text      not null,
+    preferred_name text,                 -- The name chosen by the user
+
+    created_at     timestamp not null default current_timestamp,
+
+    deleted        boolean   not null default false,
+    deleted_at     timestamp,
+
+    constraint code_group_id_code_id_unique
+        unique (code_group_id, code_id), -- Note only unique within the group, so querying by code_id must only be done in the context of a group
+    constraint code_group_id_original_unique
+        unique (code_group_id, original),
+    constraint code_group_id_preferred_name_unique
+        unique (code_group_id, preferred_name)
+);
+
+create table last_backup
+(
+    id         integer primary key autoincrement,
+    owner_id   text      not null,
+
+    backup_at timestamp not null default current_timestamp,
+
+    constraint owner_id_unique
+        unique (owner_id)
+);
+
+create table code_group_member
+(
+    id            integer primary key autoincrement,
+    code_group_id integer   not null references code_group (id) on delete cascade,
+    member_id     text      not null,   -- The Kratos identity id of the member
+
+    email         text,                 -- The email of the member when they were added, for display only
+    role          text      not null,
+
+    created_at    timestamp not null default current_timestamp,
+
+    constraint code_group_id_member_id_unique
+        unique (code_group_id, member_id),
+    constraint role_valid
+        check (role in ('owner', 'editor', 'viewer'))
+);
+
+create index code_group_member_member_id_idx on code_group_member (member_id);
+
+create table code_grant
+(
+    id            integer primary key autoincrement,
+    grant_id      text      not null,
+    code_id       integer   not null references code (id) on delete cascade,
+
+    grantee_id    text      not null,   -- The Kratos identity id that may generate passcodes for the code
+    grantee_email text,                 -- The email of the grantee when the grant was made, for display only
+    granted_by    text      not null,
+
+    created_at    timestamp not null default current_timestamp,
+    expires_at    timestamp not null,
+
+    revoked_at    timestamp,
+    revoked_by    text,
+
+    constraint grant_id_unique
+        unique (grant_id)
+);
+
+create index code_grant_grantee_id_idx on code_grant (grantee_id);
+create index code_grant_code_id_idx on code_grant (code_id);
+
+create table audit_event
+(
+    id         integer primary key autoincrement,
+    owner_id   text      not null,   -- The identity whose history this event is part of, which is the actor
+    sequence   bigint    not null,   -- The position of the event in the owner's chain, starting from 1
+
+    event_type text      not null,
+    ip         text,
+    user_agent text,
+    group_id   text,
+    code_id    text,
+    detail     text,                 -- Extra information about the event as JSON, hashed exactly as stored
+
+    created_at timestamp not null,
+
+    prev_hash  text      not null,   -- The hash of the previous event in the owner's chain
+    hash       text      not null,   -- The hash of this event, including prev_hash
+
+    constraint owner_id_sequence_unique
+        unique (owner_id, sequence)
+);
+
+create index audit_event_group_id_idx on audit_event (group_id);
+
+create trigger audit_event_no_update
+    before update
+    on audit_event
+begin
+    select raise(abort, 'audit_event is append-only');
+end;
+
+create trigger audit_event_no_delete
+    before delete
+    on audit_event
+begin
+    select raise(abort, 'audit_event is append-only');
+end;
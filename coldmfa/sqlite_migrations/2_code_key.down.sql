@@ -0,0 +1,2 @@
+alter table code drop column account;
+alter table code drop column issuer;
@@ -0,0 +1,4 @@
+-- The issuer and account parsed from the original. A null account means the code hasn't been parsed yet, which is done
+-- on startup for codes that were added before these columns.
+alter table code add column issuer text;
+alter table code add column account text;
@@ -0,0 +1,5 @@
+drop table instance_key;
+
+drop index code_fingerprint_idx;
+
+alter table code drop column fingerprint;
@@ -0,0 +1,12 @@
+-- A keyed hash of the secret and the parameters that determine passcodes, to find the same code however its URL was
+-- formatted. It's null until the code has been parsed, like the account.
+alter table code add column fingerprint text;
+
+create index code_fingerprint_idx on code (fingerprint);
+
+-- Keys that are generated on first use, such as the key for code fingerprints
+create table instance_key
+(
+    name  text primary key,
+    value blob not null
+);
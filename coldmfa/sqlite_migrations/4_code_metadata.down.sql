@@ -0,0 +1,5 @@
+alter table code drop column tags;
+alter table code drop column notes;
+alter table code drop column service_url;
+alter table code drop column enrolled_by;
+alter table code drop column account_email;
@@ -0,0 +1,6 @@
+-- What users record about a code. Tags are lower case, sorted and separated by spaces.
+alter table code add column account_email text;
+alter table code add column enrolled_by text;
+alter table code add column service_url text;
+alter table code add column notes text;
+alter table code add column tags text;
@@ -0,0 +1,16 @@
+-- Each member's own order of their groups, where groups without one come after the ordered groups, oldest first
+alter table code_group_member add column sort_order integer;
+
+-- What each member has chosen for a code, which only they see
+create table code_preference
+(
+    id         integer primary key autoincrement,
+    code_id    integer not null references code (id) on delete cascade,
+    member_id  text    not null, -- The Kratos identity id of the member
+
+    sort_order integer,          -- The position of the code in its group, where codes without one come after, oldest first
+    favorite   boolean not null default false,
+
+    constraint member_id_code_id_unique
+        unique (member_id, code_id)
+);
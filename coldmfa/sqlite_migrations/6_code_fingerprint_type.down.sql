@@ -0,0 +1,3 @@
+-- Cleared so that they are computed again without the type and counter
+update code
+set fingerprint = null;
@@ -0,0 +1,296 @@
+package coldmfa
+
+import (
+	"context"
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	_ "github.com/golang-migrate/migrate/v4/database/sqlite"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSQLiteUrl(t *testing.T) string {
+	databaseUrl := "sqlite://" + filepath.Join(t.TempDir(), "coldmfa.db")
+
+	migrator, err := NewMigrator(databaseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrator.Close()
+
+	err = migrator.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return databaseUrl
+}
+
+func newTestSQLiteStore(t *testing.T) *SQLiteStore {
+	store, db, err := OpenStore(newTestSQLiteUrl(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	return store.(*SQLiteStore)
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	databaseUrl := newTestSQLiteUrl(t)
+
+	migrator, err := NewMigrator(databaseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrator.Close()
+
+	status, err := migrator.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Dirty || status.Version == 0 || status.Version != status.Latest {
+		t.Fatalf("expected the database to be at the latest version, got %+v", status)
+	}
+
+	err = migrator.Down(int(status.Version))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = migrator.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLiteStoreConstraints(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	err := store.CreateGroup(ctx, "alice", nil, "group-a", "personal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.CreateGroup(ctx, "alice", nil, "group-b", "personal")
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("expected group names to be unique for each owner, got %v", err)
+	}
+
+	err = store.CreateCode(ctx, "group-a", "code-a", testOriginal, mustParseOtpKey(t, testOriginal), "fingerprint-code-a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.CreateCode(ctx, "group-a", "code-b", testOriginal, mustParseOtpKey(t, testOriginal), "fingerprint-code-b", nil)
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("expected codes to be unique within a group, got %v", err)
+	}
+	err = store.CreateCode(ctx, "missing", "code-b", testOtherOriginal, mustParseOtpKey(t, testOtherOriginal), "fingerprint-code-b", nil)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected adding a code to a missing group to fail, got %v", err)
+	}
+
+	err = store.AddMember(ctx, "group-a", GroupMember{MemberId: "alice", Role: RoleViewer}, nil)
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("expected members to be unique within a group, got %v", err)
+	}
+
+	err = store.DeleteCode(ctx, "group-a", "code-a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.DeleteCode(ctx, "group-a", "code-a", nil)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected deleting a deleted code to fail, got %v", err)
+	}
+	code, err := store.GetCode(ctx, "group-a", "code-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !code.Deleted || code.DeletedAt == nil || code.DeletedAt.Before(code.CreatedAt) {
+		t.Fatalf("expected the code to be soft deleted, got %+v", code)
+	}
+
+	// Codes that were added before a backup aren't counted as not backed up, including after it is taken again
+	err = store.CreateCode(ctx, "group-a", "code-b", testOtherOriginal, mustParseOtpKey(t, testOtherOriginal), "fingerprint-code-b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err = store.RecordBackup(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.now = func() time.Time { return time.Now().Add(time.Minute) }
+	thirdOriginal := "otpauth://totp/Third:alice@example.com?secret=MFRGGZDFMZTWQ2LK"
+	err = store.CreateCode(ctx, "group-a", "code-c", thirdOriginal, mustParseOtpKey(t, thirdOriginal), "fingerprint-code-c", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warning, err := store.GetBackupWarning(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warning.LastBackupAt == nil || warning.NumberNotBackedUp != 1 {
+		t.Fatalf("expected one code not backed up, got %+v", warning)
+	}
+	overdue, err := store.CountBackupOverdue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overdue != 1 {
+		t.Fatalf("expected one owner to be overdue a backup, got %d", overdue)
+	}
+}
+
+// The API is unavailable until the database can be prepared, which is retried until it succeeds.
+func TestSQLiteApiUnavailableUntilStarted(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	databaseUrl := "sqlite://" + filepath.Join(dir, "coldmfa.db")
+	app, coldMfaApp := prepareDevTestApp(t, nil, databaseUrl)
+
+	resp := app.send("alice", http.MethodGet, "/groups", nil)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get(fiber.HeaderRetryAfter) == "" {
+		t.Fatalf("expected the API to be unavailable, got %d", resp.StatusCode)
+	}
+	if err := coldMfaApp.checkStarted(context.Background()); err == nil {
+		t.Fatal("expected the app not to be ready")
+	}
+
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	migrator, err := NewMigrator(databaseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrator.Close()
+	if err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-coldMfaApp.Started():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the app to start")
+	}
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/groups", nil, nil)
+}
+
+func TestSQLiteAuditLogAppendOnly(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	for i := 0; i < 3; i++ {
+		err := store.AppendAuditEvent(ctx, &AuditEvent{OwnerId: "alice", EventType: AuditPasscodeGenerated, GroupId: nullableString("group-a")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	breaks, err := VerifyAuditLog(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(breaks) != 0 {
+		t.Fatalf("expected no breaks, got %v", breaks)
+	}
+
+	_, err = store.db.ExecContext(ctx, "update audit_event set event_type = $1", AuditQrRevealed)
+	if err == nil {
+		t.Fatal("expected audit events not to be modifiable")
+	}
+	_, err = store.db.ExecContext(ctx, "delete from audit_event")
+	if err == nil {
+		t.Fatal("expected audit events not to be deletable")
+	}
+}
+
+// Changes are made in the same transaction as their audit event, so nothing changes if the event can't be appended.
+func TestSQLiteAuditFailsClosed(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	app := newTestAppWithStore(t, store, nil)
+	group := app.createGroup("alice", "personal")
+	code := app.createCode("alice", group.GroupId, testOriginal)
+	codePath := "/groups/" + group.GroupId + "/codes/" + code.CodeId
+
+	_, err := store.db.ExecContext(context.Background(), "create trigger audit_event_unavailable before insert on audit_event begin select raise(abort, 'audit log unavailable'); end")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app.expect(http.StatusInternalServerError, "alice", http.MethodPost, "/groups/"+group.GroupId+"/codes", CreateCode{Original: testOtherOriginal}, nil)
+	app.expect(http.StatusInternalServerError, "alice", http.MethodDelete, codePath, nil, nil)
+	app.expect(http.StatusInternalServerError, "alice", http.MethodPost, "/codes/batch", CodeBatchRequest{Operations: []CodeOperation{{Op: CodeOpDelete, GroupId: group.GroupId, CodeId: code.CodeId}}, BestEffort: true}, nil)
+	app.expect(http.StatusInternalServerError, "alice", http.MethodPost, codePath+"/grants", CreateGrantRequest{Email: "bob@example.com"}, nil)
+	app.expect(http.StatusInternalServerError, "alice", http.MethodPost, "/groups/"+group.GroupId+"/members", InviteMemberRequest{Email: "bob@example.com", Role: RoleViewer}, nil)
+	app.expect(http.StatusInternalServerError, "alice", http.MethodPut, "/backups", RestoreBackupRequest{BackupContent: []byte("not a backup"), Password: "password"}, nil)
+
+	if codes := app.listCodes("alice", group.GroupId); len(codes) != 1 || codes[0].Deleted {
+		t.Fatalf("expected the code to be unchanged, got %+v", codes)
+	}
+	var granted []GrantedCode
+	app.expect(http.StatusOK, "bob", http.MethodGet, "/grants", nil, &granted)
+	if len(granted) != 0 {
+		t.Fatalf("expected the code not to be shared, got %+v", granted)
+	}
+	app.expect(http.StatusNotFound, "bob", http.MethodGet, "/groups/"+group.GroupId, nil, nil)
+}
+
+func TestSQLiteRoutes(t *testing.T) {
+	app := newTestAppWithStore(t, newTestSQLiteStore(t), nil)
+	group := app.createGroup("alice", "personal")
+	code := app.createCode("alice", group.GroupId, testOriginal)
+	codePath := "/groups/" + group.GroupId + "/codes/" + code.CodeId
+
+	var passcode PasscodeResponse
+	app.expect(http.StatusOK, "alice", http.MethodGet, codePath, nil, &passcode)
+
+	var grant CodeGrant
+	app.expect(http.StatusCreated, "alice", http.MethodPost, codePath+"/grants", CreateGrantRequest{Email: "bob@example.com"}, &grant)
+	var granted []GrantedCode
+	app.expect(http.StatusOK, "bob", http.MethodGet, "/grants", nil, &granted)
+	if len(granted) != 1 || granted[0].GrantId != grant.GrantId {
+		t.Fatalf("expected the code to be shared, got %+v", granted)
+	}
+	app.expect(http.StatusOK, "bob", http.MethodGet, codePath, nil, &passcode)
+
+	resp := app.send("alice", http.MethodPost, "/backups", BackupRequest{Password: "password"})
+	backup, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a backup, got %d", resp.StatusCode)
+	}
+
+	app.expect(http.StatusNoContent, "alice", http.MethodDelete, codePath, nil, nil)
+	app.expect(http.StatusNotFound, "bob", http.MethodGet, codePath, nil, nil)
+
+	// Restoring twice doesn't create duplicates, and keeps the code soft deleted
+	for i := 0; i < 2; i++ {
+		app.expect(http.StatusOK, "alice", http.MethodPut, "/backups", RestoreBackupRequest{BackupContent: backup, Password: "password"}, nil)
+	}
+	var read CodeGroup
+	app.expect(http.StatusOK, "alice", http.MethodGet, "/groups/"+group.GroupId, nil, &read)
+	if len(read.Codes) != 1 || !read.Codes[0].Deleted {
+		t.Fatalf("expected only the deleted code, got %+v", read.Codes)
+	}
+
+	breaks, err := VerifyAuditLog(context.Background(), app.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(breaks) != 0 {
+		t.Fatalf("expected no breaks, got %v", breaks)
+	}
+}
@@ -0,0 +1,217 @@
+package coldmfa
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/EphyraSoftware/locus/tracing"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned by a Store when the requested record doesn't exist, or when an update or delete didn't
+	// match anything.
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists is returned by a Store when a record would violate a uniqueness constraint.
+	ErrAlreadyExists = errors.New("already exists")
+)
+
+// Membership is the access that an identity has to a group.
+type Membership struct {
+	GroupId   string
+	CreatorId string
+	Role      Role
+}
+
+// RestoreItem is a backup item to restore, with the ids to use if the group or code has to be created. Key is the
+// parsed original and Fingerprint its fingerprint, which are nil if the item has no code or its original couldn't be
+// parsed.
+type RestoreItem struct {
+	BackupItem
+	Key         *OtpKey
+	Fingerprint *string
+	GroupId     string
+	CodeId      string
+}
+
+// CodeSearch filters the codes in an identity's groups. Every term has to match the name, preferred name, issuer,
+// account or notes of a code, ignoring case, and the code has to have every tag. Deleted is nil to include both deleted
+// codes and codes that aren't deleted. Codes are found newest first, starting after the code that the cursor was read
+// from.
+type CodeSearch struct {
+	Terms         []string
+	Tags          []string
+	GroupId       string
+	Deleted       *bool
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	Cursor        int64
+	Limit         int
+}
+
+// CodeOriginal is the otpauth URL of a code, with the ids that address it.
+type CodeOriginal struct {
+	GroupId  string
+	CodeId   string
+	Original string
+}
+
+// Store holds everything that ColdMFA persists. Groups and codes are addressed by their public ids, implementations are
+// responsible for mapping those to their own keys. Deleting a code is a soft delete, so deleted codes are still
+// returned by reads unless a method says otherwise.
+//
+// Methods that change something sensitive take an audit event, which is appended to its owner's chain like
+// AppendAuditEvent in the same transaction as the change, so that a change is never made without a record of it. The
+// event may be nil when there is no identity to account for the change.
+type Store interface {
+	// Ping checks that the store is available.
+	Ping(ctx context.Context) error
+
+	// ListGroups lists the groups that the identity is a member of, with the identity's role in each, in the identity's
+	// order.
+	ListGroups(ctx context.Context, memberId string) ([]CodeGroup, error)
+	// GetGroup reads a group that the identity is a member of, with the identity's role and without its codes.
+	GetGroup(ctx context.Context, memberId string, groupId string) (*CodeGroup, error)
+	// CreateGroup creates a group and makes its creator an owner.
+	CreateGroup(ctx context.Context, creatorId string, creatorEmail *string, groupId string, name string) error
+	GetMembership(ctx context.Context, memberId string, groupId string) (*Membership, error)
+	// ReorderGroups sets the identity's order of its groups, returning ErrNotFound if it isn't a member of one of them.
+	// Groups that aren't listed go back to the default order after the listed groups.
+	ReorderGroups(ctx context.Context, memberId string, groupIds []string) error
+
+	// ListCodes lists the codes in a group in the identity's order, marking the codes that it has pinned. Access to the
+	// group must already have been checked.
+	ListCodes(ctx context.Context, memberId string, groupId string) ([]CodeSummary, error)
+	GetCode(ctx context.Context, groupId string, codeId string) (*CodeSummary, error)
+	// SearchCodes finds codes in the groups that the identity is a member of.
+	SearchCodes(ctx context.Context, memberId string, search CodeSearch) (*CodeSearchResponse, error)
+	// GetCodeOriginal reads the otpauth URL of a code. It must only be used after checking access to the group.
+	GetCodeOriginal(ctx context.Context, groupId string, codeId string) (string, error)
+	// CreateCode creates a code, storing the original as it was given and the columns that are parsed from its key.
+	CreateCode(ctx context.Context, groupId string, codeId string, original string, key *OtpKey, fingerprint string, event *AuditEvent) error
+	// FindCodeByFingerprint finds a code that isn't deleted, in any group that the identity is a member of, with the
+	// fingerprint.
+	FindCodeByFingerprint(ctx context.Context, memberId string, fingerprint string) (*CodeLocation, error)
+	// ListUnparsedCodes lists the codes in every group that don't have an issuer, account and fingerprint stored,
+	// because they were added before those were parsed or their original couldn't be parsed.
+	ListUnparsedCodes(ctx context.Context) ([]CodeOriginal, error)
+	// SetCodeKey stores the issuer, account and fingerprint of a code, leaving its original as it is.
+	SetCodeKey(ctx context.Context, groupId string, codeId string, key *OtpKey, fingerprint string) error
+	// UpdateCode replaces the preferred name and metadata of a code that isn't deleted. The metadata must be normalized.
+	// Returns ErrAlreadyExists if the preferred name is in use by another code in the group.
+	UpdateCode(ctx context.Context, groupId string, codeId string, preferredName *string, metadata CodeMetadata) error
+	// MoveCode moves a code to another group. Returns ErrAlreadyExists if the group already has the same code.
+	MoveCode(ctx context.Context, groupId string, codeId string, toGroupId string, event *AuditEvent) error
+	// ReorderCodes sets the identity's order of the codes in a group, returning ErrNotFound if one of them isn't in the
+	// group. Codes that aren't listed go back to the default order after the listed codes.
+	ReorderCodes(ctx context.Context, memberId string, groupId string, codeIds []string) error
+	// SetCodeFavorite pins or unpins a code for the identity, returning ErrNotFound if the code isn't in the group.
+	SetCodeFavorite(ctx context.Context, memberId string, groupId string, codeId string, favorite bool) error
+	// ListFavoriteCodes lists the codes that aren't deleted that the identity has pinned, in groups that it is still a
+	// member of, in the identity's order of the groups and then of the codes.
+	ListFavoriteCodes(ctx context.Context, memberId string) ([]CodeSearchResult, error)
+	DeleteCode(ctx context.Context, groupId string, codeId string, event *AuditEvent) error
+	// ApplyCodeOperations applies the operations in order, in a single transaction. The identity's access to the groups
+	// must already have been checked, and it's only used to stop a code being restored when a code with the same
+	// fingerprint is in one of its groups. Each operation has an event in events, which is appended if the operation is
+	// applied and all of the events must have the identity as their owner. The result for each operation is nil if it
+	// was applied, or ErrNotFound or ErrAlreadyExists. If bestEffort is false then the first failed operation rolls back
+	// the whole batch and the operations after it aren't tried, otherwise only the failed operation is rolled back. Any
+	// other error fails the whole batch.
+	ApplyCodeOperations(ctx context.Context, memberId string, operations []CodeOperation, events []*AuditEvent, bestEffort bool) ([]error, error)
+
+	ListMembers(ctx context.Context, groupId string) ([]GroupMember, error)
+	GetMember(ctx context.Context, groupId string, memberId string) (*GroupMember, error)
+	// AddMember adds a member to a group, returning ErrAlreadyExists if they are already a member.
+	AddMember(ctx context.Context, groupId string, member GroupMember, event *AuditEvent) error
+	UpdateMemberRole(ctx context.Context, groupId string, memberId string, role Role, event *AuditEvent) error
+	RemoveMember(ctx context.Context, groupId string, memberId string, event *AuditEvent) error
+
+	// GetGrantedOriginal reads the otpauth URL of a code that has been shared with the grantee through an active grant.
+	// Grants only permit generating passcodes, so this must not be used to reveal the secret in any other way.
+	GetGrantedOriginal(ctx context.Context, granteeId string, groupId string, codeId string) (string, error)
+	// ListGrantedCodes lists the codes shared with the grantee through active grants, soonest to expire first.
+	ListGrantedCodes(ctx context.Context, granteeId string) ([]GrantedCode, error)
+	// ListCodeGrants lists the active grants for a code, oldest first.
+	ListCodeGrants(ctx context.Context, groupId string, codeId string) ([]CodeGrant, error)
+	// CreateGrant grants access to a code, replacing any active grant to the same grantee. The created time is set by
+	// the store.
+	CreateGrant(ctx context.Context, groupId string, codeId string, grant CodeGrant, event *AuditEvent) (*CodeGrant, error)
+	RevokeGrant(ctx context.Context, groupId string, codeId string, grantId string, revokedBy string, event *AuditEvent) error
+
+	// ListBackupItems lists every code, including deleted codes, in the groups that the identity owns. Groups without
+	// codes are included as an item with only the group name.
+	ListBackupItems(ctx context.Context, ownerId string) ([]BackupItem, error)
+	// RestoreBackup adds the items to the owner's groups in a single transaction. Groups are matched by name. Codes
+	// aren't added if a code with the same fingerprint, including a deleted code, is in any group that the owner is a
+	// member of, or if the group has a code with the same original. Restoring the same backup twice doesn't create
+	// duplicates. The codes that were already present are returned.
+	RestoreBackup(ctx context.Context, ownerId string, ownerEmail *string, items []RestoreItem, event *AuditEvent) ([]CodeLocation, error)
+	// RecordBackup sets the owner's last backup to now.
+	RecordBackup(ctx context.Context, ownerId string) error
+	GetBackupWarning(ctx context.Context, ownerId string) (*BackupWarning, error)
+	// CountBackupOverdue counts the identities that own codes that were added since their last backup, or that have
+	// never taken a backup.
+	CountBackupOverdue(ctx context.Context) (int, error)
+
+	// GetInstanceKey reads the key with the name, storing generated as the key if there isn't one yet.
+	GetInstanceKey(ctx context.Context, name string, generated []byte) ([]byte, error)
+
+	// AppendAuditEvent adds the event to the end of its owner's chain, filling in the sequence, previous hash, created
+	// time and hash. Concurrent appends for the same owner must not fork the chain.
+	AppendAuditEvent(ctx context.Context, event *AuditEvent) error
+	// ListAuditEvents lists the owner's events with an id less than before, newest first.
+	ListAuditEvents(ctx context.Context, ownerId string, before int64, limit int) ([]AuditEvent, error)
+	// ListGroupAuditEvents lists events about the group, from every owner's chain, with an id less than before, newest
+	// first.
+	ListGroupAuditEvents(ctx context.Context, groupId string, before int64, limit int) ([]AuditEvent, error)
+	// ListAuditEventsAfter lists events in owner and sequence order, starting after the given owner and sequence.
+	ListAuditEventsAfter(ctx context.Context, ownerId string, sequence int64, limit int) ([]AuditEvent, error)
+}
+
+// OpenStore opens the store for a database URL, which is an SQLiteStore for sqlite:// URLs and a PostgresStore
+// otherwise. The database is returned so that the caller can close it, and it isn't migrated.
+func OpenStore(databaseUrl string) (Store, *sql.DB, error) {
+	if isSQLiteUrl(databaseUrl) {
+		dataSource, err := sqliteDataSource(databaseUrl)
+		if err != nil {
+			return nil, nil, err
+		}
+		db, err := tracing.OpenSQLiteDB(dataSource)
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewSQLiteStore(db), db, nil
+	}
+
+	db, err := tracing.OpenDB(databaseUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewPostgresStore(db), db, nil
+}
+
+// chainAuditEvent links the event to the end of a chain, given the last sequence and hash of the chain, which are 0 and
+// auditGenesisHash for a new chain.
+func chainAuditEvent(event *AuditEvent, lastSequence int64, lastHash string, now time.Time) error {
+	event.Sequence = lastSequence + 1
+	event.PrevHash = lastHash
+	// The database stores timestamps with microsecond precision, so truncate before hashing to match what is read back.
+	event.CreatedAt = now.UTC().Truncate(time.Microsecond)
+
+	hash, err := event.computeHash()
+	if err != nil {
+		return err
+	}
+	event.Hash = hash
+
+	return nil
+}
+
+// keyColumns are the issuer and account stored for a key, where a null account marks a code that hasn't been parsed.
+func keyColumns(key *OtpKey) (issuer *string, account *string) {
+	if key == nil {
+		return nil, nil
+	}
+	return nullableString(key.Issuer), &key.Account
+}
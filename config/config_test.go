@@ -0,0 +1,100 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, "locus.yaml", "port: 4000\nmetricsPort: 4001\nlog:\n  level: debug\n  format: text\n")
+	t.Setenv("PORT", "5000")
+	t.Setenv("LOG_FORMAT", "json")
+
+	cfg, err := Load("locus", []string{"--config", path, "--port", "6000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Port != 6000 {
+		t.Errorf("expected flag to override env and file, got port %d", cfg.Port)
+	}
+	if cfg.Log.Format != "json" {
+		t.Errorf("expected env to override file, got format %s", cfg.Log.Format)
+	}
+	if cfg.Log.Level != "debug" {
+		t.Errorf("expected file to override default, got level %s", cfg.Log.Level)
+	}
+	if cfg.MetricsPort != 4001 {
+		t.Errorf("expected metrics port from file, got %d", cfg.MetricsPort)
+	}
+	if cfg.Ory.PublicBrowserUrl != cfg.Ory.PublicUrl {
+		t.Errorf("expected browser URL to default to public URL, got %s", cfg.Ory.PublicBrowserUrl)
+	}
+}
+
+func TestLoadSecretFile(t *testing.T) {
+	path := writeFile(t, "database-url", "postgres://locus:hunter2@db:5432/locus\n")
+	t.Setenv("DATABASE_URL_FILE", path)
+
+	cfg, err := Load("locus", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Database.Url != "postgres://locus:hunter2@db:5432/locus" {
+		t.Fatalf("expected database URL from file, got %s", cfg.Database.Url)
+	}
+
+	var out strings.Builder
+	if err := cfg.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "hunter2") {
+		t.Fatalf("expected secret to be masked:\n%s", out.String())
+	}
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	t.Setenv("PORT", "not-a-port")
+
+	_, err := Load("locus", []string{"--log-level", "loud", "--tracing-exporter", "jaeger", "--database-url", "mysql://db", "--metrics-host", "example.com"})
+	if err == nil {
+		t.Fatal("expected configuration to be invalid")
+	}
+
+	for _, expected := range []string{"PORT", "log.level", "tracing.exporter", "database.url", "metricsHost"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected a problem with %s, got:\n%s", expected, err)
+		}
+	}
+}
+
+func TestLoadSQLiteDatabase(t *testing.T) {
+	cfg, err := Load("locus", []string{"--database-url", "sqlite:///var/lib/locus/coldmfa.db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Database.Url != "sqlite:///var/lib/locus/coldmfa.db" {
+		t.Fatalf("expected SQLite database URL, got %s", cfg.Database.Url)
+	}
+
+	_, err = Load("locus", []string{"--database-url", "sqlite://", "--rate-limit-store", "postgres"})
+	if err == nil {
+		t.Fatal("expected configuration to be invalid")
+	}
+	for _, expected := range []string{"database.url", "rateLimit.store"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected a problem with %s, got:\n%s", expected, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package health
+
+import (
+	"context"
+	"github.com/gofiber/fiber/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// checkTimeout bounds each dependency check, so that a hung dependency can't stall the readiness probe.
+const checkTimeout = 3 * time.Second
+
+// Check reports whether a dependency is usable. A nil error means the dependency is ready.
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Response struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// App serves the liveness and readiness endpoints. It must be prepared before any authentication middleware so that
+// probes don't need a session.
+type App struct {
+	Checks []Check
+}
+
+func (a *App) Prepare(app *fiber.App) {
+	app.Get("/healthz", func(c *fiber.Ctx) error {
+		return c.Status(http.StatusOK).JSON(Response{Status: "ok"})
+	})
+
+	app.Get("/readyz", func(c *fiber.Ctx) error {
+		response := a.runChecks(c.UserContext())
+
+		status := http.StatusOK
+		if response.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+
+		return c.Status(status).JSON(response)
+	})
+}
+
+func (a *App) runChecks(ctx context.Context) Response {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	results := make([]CheckResult, len(a.Checks))
+	var wg sync.WaitGroup
+	for i, check := range a.Checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+
+			err := check.Check(ctx)
+			if err != nil {
+				results[i] = CheckResult{Status: "unavailable", Error: err.Error()}
+			} else {
+				results[i] = CheckResult{Status: "ok"}
+			}
+		}(i, check)
+	}
+	wg.Wait()
+
+	response := Response{Status: "ok", Checks: make(map[string]CheckResult)}
+	for i, check := range a.Checks {
+		response.Checks[check.Name] = results[i]
+		if results[i].Status != "ok" {
+			response.Status = "unavailable"
+		}
+	}
+
+	return response
+}
@@ -0,0 +1,238 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	fiberlog "github.com/gofiber/fiber/v2/log"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// LevelTrace is below slog's debug level, for fiber's trace logs.
+const LevelTrace = slog.LevelDebug - 4
+
+type contextKey string
+
+const requestIdKey contextKey = "requestId"
+
+// level is shared between the slog handler and the fiber logger, so that changing either's level affects both.
+var level = new(slog.LevelVar)
+
+// Setup configures slog as the default logger and routes fiber's logger through it, so that all logs are structured
+// and redacted. The level is one of trace, debug, info, warn or error, and the format is either json or text.
+func Setup(logLevel string, format string) error {
+	parsedLevel, err := parseLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	level.Set(parsedLevel)
+
+	handler, err := newHandler(format, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	logger := slog.New(NewRedactingHandler(&contextHandler{next: handler}))
+	slog.SetDefault(logger)
+	fiberlog.SetLogger(&fiberLogger{logger: logger})
+
+	return nil
+}
+
+func parseLevel(value string) (slog.Level, error) {
+	switch strings.ToLower(value) {
+	case "trace":
+		return LevelTrace, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unsupported log level %q", value)
+	}
+}
+
+func newHandler(format string, w io.Writer) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case "", "json":
+		return slog.NewJSONHandler(w, opts), nil
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("unsupported log format %q", format)
+	}
+}
+
+// WithRequestId returns a context that adds the request id to any logs written with it.
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey, requestId)
+}
+
+// contextHandler adds the request and trace ids from the context to each record.
+type contextHandler struct {
+	next slog.Handler
+}
+
+func (h *contextHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if ctx != nil {
+		if requestId, ok := ctx.Value(requestIdKey).(string); ok {
+			record.AddAttrs(slog.String("request_id", requestId))
+		}
+		if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+			record.AddAttrs(slog.String("trace_id", spanContext.TraceID().String()))
+		}
+	}
+
+	return h.next.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{next: h.next.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{next: h.next.WithGroup(name)}
+}
+
+// fiberLogger implements fiber's logger on top of slog, so that the existing calls to fiber's log package produce
+// structured output.
+type fiberLogger struct {
+	logger *slog.Logger
+	ctx    context.Context
+}
+
+func (l *fiberLogger) log(lvl slog.Level, msg string, args ...interface{}) {
+	ctx := l.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// Many existing messages end with a newline for the default logger, which isn't wanted in structured output
+	l.logger.Log(ctx, lvl, strings.TrimRight(msg, "\n"), args...)
+}
+
+func (l *fiberLogger) Trace(v ...interface{}) {
+	l.log(LevelTrace, fmt.Sprint(v...))
+}
+
+func (l *fiberLogger) Debug(v ...interface{}) {
+	l.log(slog.LevelDebug, fmt.Sprint(v...))
+}
+
+func (l *fiberLogger) Info(v ...interface{}) {
+	l.log(slog.LevelInfo, fmt.Sprint(v...))
+}
+
+func (l *fiberLogger) Warn(v ...interface{}) {
+	l.log(slog.LevelWarn, fmt.Sprint(v...))
+}
+
+func (l *fiberLogger) Error(v ...interface{}) {
+	l.log(slog.LevelError, fmt.Sprint(v...))
+}
+
+func (l *fiberLogger) Fatal(v ...interface{}) {
+	l.log(slog.LevelError, fmt.Sprint(v...))
+	os.Exit(1)
+}
+
+func (l *fiberLogger) Panic(v ...interface{}) {
+	msg := fmt.Sprint(v...)
+	l.log(slog.LevelError, msg)
+	panic(Redact(msg))
+}
+
+func (l *fiberLogger) Tracef(format string, v ...interface{}) {
+	l.log(LevelTrace, fmt.Sprintf(format, v...))
+}
+
+func (l *fiberLogger) Debugf(format string, v ...interface{}) {
+	l.log(slog.LevelDebug, fmt.Sprintf(format, v...))
+}
+
+func (l *fiberLogger) Infof(format string, v ...interface{}) {
+	l.log(slog.LevelInfo, fmt.Sprintf(format, v...))
+}
+
+func (l *fiberLogger) Warnf(format string, v ...interface{}) {
+	l.log(slog.LevelWarn, fmt.Sprintf(format, v...))
+}
+
+func (l *fiberLogger) Errorf(format string, v ...interface{}) {
+	l.log(slog.LevelError, fmt.Sprintf(format, v...))
+}
+
+func (l *fiberLogger) Fatalf(format string, v ...interface{}) {
+	l.log(slog.LevelError, fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+func (l *fiberLogger) Panicf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	l.log(slog.LevelError, msg)
+	panic(Redact(msg))
+}
+
+func (l *fiberLogger) Tracew(msg string, keysAndValues ...interface{}) {
+	l.log(LevelTrace, msg, keysAndValues...)
+}
+
+func (l *fiberLogger) Debugw(msg string, keysAndValues ...interface{}) {
+	l.log(slog.LevelDebug, msg, keysAndValues...)
+}
+
+func (l *fiberLogger) Infow(msg string, keysAndValues ...interface{}) {
+	l.log(slog.LevelInfo, msg, keysAndValues...)
+}
+
+func (l *fiberLogger) Warnw(msg string, keysAndValues ...interface{}) {
+	l.log(slog.LevelWarn, msg, keysAndValues...)
+}
+
+func (l *fiberLogger) Errorw(msg string, keysAndValues ...interface{}) {
+	l.log(slog.LevelError, msg, keysAndValues...)
+}
+
+func (l *fiberLogger) Fatalw(msg string, keysAndValues ...interface{}) {
+	l.log(slog.LevelError, msg, keysAndValues...)
+	os.Exit(1)
+}
+
+func (l *fiberLogger) Panicw(msg string, keysAndValues ...interface{}) {
+	l.log(slog.LevelError, msg, keysAndValues...)
+	panic(Redact(msg))
+}
+
+func (l *fiberLogger) SetLevel(lvl fiberlog.Level) {
+	switch lvl {
+	case fiberlog.LevelTrace:
+		level.Set(LevelTrace)
+	case fiberlog.LevelDebug:
+		level.Set(slog.LevelDebug)
+	case fiberlog.LevelInfo:
+		level.Set(slog.LevelInfo)
+	case fiberlog.LevelWarn:
+		level.Set(slog.LevelWarn)
+	default:
+		level.Set(slog.LevelError)
+	}
+}
+
+// SetOutput is not supported, output is always configured through Setup.
+func (l *fiberLogger) SetOutput(io.Writer) {}
+
+func (l *fiberLogger) WithContext(ctx context.Context) fiberlog.CommonLogger {
+	return &fiberLogger{logger: l.logger, ctx: ctx}
+}
@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// RequestIdHeader carries the request id. A valid id sent by a proxy is reused so that logs can be correlated.
+const RequestIdHeader = "X-Request-ID"
+
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Middleware assigns a request id to each request and writes a log line for it once it has been handled. The user id
+// is read after the request has been handled, so that it is available once the auth middleware has run.
+func Middleware(userId func(c *fiber.Ctx) string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
+		requestId := c.Get(RequestIdHeader)
+		if !validRequestId.MatchString(requestId) {
+			var err error
+			requestId, err = gonanoid.New()
+			if err != nil {
+				return err
+			}
+		}
+		c.Set(RequestIdHeader, requestId)
+		c.Locals("requestId", requestId)
+		c.SetUserContext(WithRequestId(c.UserContext(), requestId))
+
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			var fiberErr *fiber.Error
+			if errors.As(err, &fiberErr) {
+				status = fiberErr.Code
+			}
+		}
+
+		lvl := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			lvl = slog.LevelError
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", c.Method()),
+			slog.String("route", c.Route().Path),
+			slog.String("path", c.Path()),
+			slog.Int("status", status),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+		}
+		if user := userId(c); user != "" {
+			attrs = append(attrs, slog.String("user_id", user))
+		}
+		if err != nil {
+			attrs = append(attrs, slog.String("error", err.Error()))
+		}
+
+		slog.LogAttrs(c.UserContext(), lvl, "request", attrs...)
+
+		return err
+	}
+}
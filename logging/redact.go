@@ -0,0 +1,120 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+type redaction struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// redactions are applied to every message and string value before it is written. They are deliberately broad, a log
+// line that is redacted more than it needed to be is much better than a secret in the logs.
+var redactions = []redaction{
+	// Whole otpauth URLs, since the label and issuer are sensitive as well as the secret
+	{regexp.MustCompile(`(?i)otpauth(-migration)?://[^\s"'<>]*`), "otpauth://" + redacted},
+	{regexp.MustCompile(`(?i)\bsecret=[^&\s"'<>]*`), "secret=" + redacted},
+	{regexp.MustCompile(`(?i)("[a-z_]*password"\s*:\s*)"(?:[^"\\]|\\.)*"`), `$1"` + redacted + `"`},
+	{regexp.MustCompile(`(?i)\b([a-z_]*password)=[^&\s"'<>]*`), "$1=" + redacted},
+	// Kratos session and CSRF cookies, and the dev mode identity cookie
+	{regexp.MustCompile(`(?i)\b(ory_[a-z0-9_]*|csrf_token[a-z0-9_]*|locus_dev_user)=[^;\s"'<>]*`), "$1=" + redacted},
+	// Credentials in database connection URLs, which show up in driver and migration errors
+	{regexp.MustCompile(`(?i)\b(postgres(?:ql)?://[^:/@\s]*):[^@\s]*@`), "$1:" + redacted + "@"},
+}
+
+// sensitiveKeys are attribute keys whose values are always redacted, whatever they contain.
+var sensitiveKeys = []string{"password", "secret", "cookie", "authorization", "session_token", "original"}
+
+// Redact removes secrets from a string.
+func Redact(value string) string {
+	for _, r := range redactions {
+		value = r.pattern.ReplaceAllString(value, r.replacement)
+	}
+	return value
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactingHandler wraps another handler and redacts secrets from every record that passes through it, including
+// values that were added with WithAttrs.
+type RedactingHandler struct {
+	next slog.Handler
+}
+
+func NewRedactingHandler(next slog.Handler) *RedactingHandler {
+	return &RedactingHandler{next: next}
+}
+
+func (h *RedactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *RedactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	out := slog.NewRecord(record.Time, record.Level, Redact(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		out.AddAttrs(redactAttr(attr))
+		return true
+	})
+
+	return h.next.Handle(ctx, out)
+}
+
+func (h *RedactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redactedAttrs[i] = redactAttr(attr)
+	}
+
+	return &RedactingHandler{next: h.next.WithAttrs(redactedAttrs)}
+}
+
+func (h *RedactingHandler) WithGroup(name string) slog.Handler {
+	return &RedactingHandler{next: h.next.WithGroup(name)}
+}
+
+func redactAttr(attr slog.Attr) slog.Attr {
+	if isSensitiveKey(attr.Key) {
+		return slog.String(attr.Key, redacted)
+	}
+
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, Redact(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		redactedGroup := make([]slog.Attr, len(group))
+		for i, groupAttr := range group {
+			redactedGroup[i] = redactAttr(groupAttr)
+		}
+		return slog.Attr{Key: attr.Key, Value: slog.GroupValue(redactedGroup...)}
+	case slog.KindAny:
+		// Errors and other values are formatted by the underlying handler, so check what they would format to. Only
+		// replace the value if it needs redacting, so that structured values are kept where possible.
+		formatted := fmt.Sprintf("%+v", value.Any())
+		if err, ok := value.Any().(error); ok {
+			formatted = err.Error()
+		}
+		if cleaned := Redact(formatted); cleaned != formatted {
+			return slog.String(attr.Key, cleaned)
+		}
+		return slog.Attr{Key: attr.Key, Value: value}
+	default:
+		return slog.Attr{Key: attr.Key, Value: value}
+	}
+}
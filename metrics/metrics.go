@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Registry holds all Locus metrics. A dedicated registry is used rather than the global default so that only metrics
+// that Locus has chosen to expose are served.
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "locus_http_requests_total",
+		Help: "Number of HTTP requests handled, by route and response status.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "locus_http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	kratosSessionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "locus_kratos_session_check_duration_seconds",
+		Help:    "Time taken to check a session with Kratos.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	kratosSessionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "locus_kratos_session_check_errors_total",
+		Help: "Number of failed session checks with Kratos, by response status. Status is 0 if Kratos could not be reached.",
+	}, []string{"status"})
+
+	passcodesGenerated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "locus_passcodes_generated_total",
+		Help: "Number of passcodes generated, by whether access was through group membership or a grant.",
+	}, []string{"via"})
+
+	backups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "locus_backups_total",
+		Help: "Number of backup operations, by operation (create or restore) and result (success or failure).",
+	}, []string{"operation", "result"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "locus_rate_limited_total",
+		Help: "Number of requests rejected by a rate limit, by limit name and whether the limit was per identity or per IP.",
+	}, []string{"limit", "by"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpRequestDuration,
+		kratosSessionDuration,
+		kratosSessionErrors,
+		passcodesGenerated,
+		backups,
+		rateLimited,
+	)
+}
+
+// Middleware records request counts and latency for every route. It should be mounted before any other middleware
+// so that requests which are rejected or redirected by authentication are also counted.
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			// The error handler hasn't run yet, so work out the status it is going to respond with
+			status = fiber.StatusInternalServerError
+			var fiberErr *fiber.Error
+			if errors.As(err, &fiberErr) {
+				status = fiberErr.Code
+			}
+		}
+
+		// Use the route pattern rather than the path, so that ids in the path don't create a series per request
+		route := c.Route().Path
+		httpRequests.WithLabelValues(c.Method(), route, strconv.Itoa(status)).Inc()
+		httpRequestDuration.WithLabelValues(c.Method(), route).Observe(time.Since(start).Seconds())
+
+		return err
+	}
+}
+
+// ObserveKratosSession records the outcome of a Kratos ToSession call. The response may be nil if Kratos could not be
+// reached.
+func ObserveKratosSession(duration time.Duration, resp *http.Response, err error) {
+	kratosSessionDuration.Observe(duration.Seconds())
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		kratosSessionErrors.WithLabelValues(strconv.Itoa(status)).Inc()
+	}
+}
+
+// PasscodeGenerated records a passcode being generated. The via label should be either "member" or "grant".
+func PasscodeGenerated(via string) {
+	passcodesGenerated.WithLabelValues(via).Inc()
+}
+
+// BackupOperation records the result of creating or restoring a backup.
+func BackupOperation(operation string, success bool) {
+	result := "success"
+	if !success {
+		result = "failure"
+	}
+	backups.WithLabelValues(operation, result).Inc()
+}
+
+// RateLimited records a request being rejected by a rate limit. The by label should be either "identity" or "ip".
+func RateLimited(limit string, by string) {
+	rateLimited.WithLabelValues(limit, by).Inc()
+}
+
+// NewServer creates a server for the metrics endpoint on its own listener, so that it can be scraped without going
+// through the Kratos middleware and without being exposed alongside the app.
+func NewServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	// Carry on if a collector fails, so that losing the database doesn't also lose the metrics that would show it
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry, ErrorHandling: promhttp.ContinueOnError}))
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
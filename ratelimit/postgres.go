@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// PostgresStore keeps buckets in the rate_limit_bucket table, so that limits are shared between replicas.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Result{}, err
+	}
+
+	defer func(tx *sql.Tx) {
+		// The error is returned from the commit if it matters
+		_ = tx.Rollback()
+	}(tx)
+
+	// Make sure the row exists so that it can be locked, a new bucket starts full
+	_, err = tx.ExecContext(ctx, "insert into rate_limit_bucket (key, tokens, updated_at) values ($1, $2, $3) on conflict (key) do nothing", key, float64(limit.Burst), now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var tokens float64
+	var updated time.Time
+	err = tx.QueryRowContext(ctx, "select tokens, updated_at from rate_limit_bucket where key = $1 for update", key).Scan(&tokens, &updated)
+	if err != nil {
+		return Result{}, err
+	}
+
+	tokens, res := take(tokens, updated, limit, now)
+
+	_, err = tx.ExecContext(ctx, "update rate_limit_bucket set tokens = $2, updated_at = $3 where key = $1", key, tokens, now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return res, tx.Commit()
+}
+
+func (s *PostgresStore) Peek(ctx context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	var tokens float64
+	var updated time.Time
+	err := s.db.QueryRowContext(ctx, "select tokens, updated_at from rate_limit_bucket where key = $1", key).Scan(&tokens, &updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Result{Allowed: limit.Burst >= 1}, nil
+	}
+	if err != nil {
+		return Result{}, err
+	}
+
+	return result(refill(tokens, updated, limit, now), limit), nil
+}
+
+func (s *PostgresStore) Cleanup(ctx context.Context, before time.Time) error {
+	_, err := s.db.ExecContext(ctx, "delete from rate_limit_bucket where updated_at < $1", before)
+	return err
+}
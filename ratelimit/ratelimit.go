@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Limit is a token bucket. A bucket starts with Burst tokens and refills at Rate tokens per second, up to Burst.
+type Limit struct {
+	Burst int
+	Rate  float64
+}
+
+// PerMinute creates a limit that allows a burst of requests, and then refills at the given number of requests per
+// minute.
+func PerMinute(perMinute float64, burst int) Limit {
+	return Limit{Burst: burst, Rate: perMinute / 60}
+}
+
+// Every creates a limit that allows a burst of requests, and then refills one request per interval.
+func Every(interval time.Duration, burst int) Limit {
+	return Limit{Burst: burst, Rate: 1 / interval.Seconds()}
+}
+
+// Scale multiplies both the burst and the rate of a limit, for a limit that is shared by several users.
+func (l Limit) Scale(factor int) Limit {
+	return Limit{Burst: l.Burst * factor, Rate: l.Rate * float64(factor)}
+}
+
+type Result struct {
+	Allowed bool
+	// RetryAfter is how long until a token is available, if the request was not allowed
+	RetryAfter time.Duration
+}
+
+// Store holds token buckets by key.
+type Store interface {
+	// Take removes a token from the bucket if one is available.
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+	// Peek checks whether a token is available without removing it.
+	Peek(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+	// Cleanup removes buckets that haven't been used since the given time. Those buckets have since refilled, or will
+	// have once they are next used, so removing them doesn't change any limits as long as the time is far enough in the
+	// past for the slowest limit to have refilled.
+	Cleanup(ctx context.Context, before time.Time) error
+}
+
+// refill calculates the tokens in a bucket that last had the given number of tokens at the given time.
+func refill(tokens float64, updated time.Time, limit Limit, now time.Time) float64 {
+	elapsed := now.Sub(updated).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	return math.Min(float64(limit.Burst), tokens+elapsed*limit.Rate)
+}
+
+func result(tokens float64, limit Limit) Result {
+	if tokens >= 1 {
+		return Result{Allowed: true}
+	}
+
+	if limit.Rate <= 0 {
+		return Result{Allowed: false, RetryAfter: time.Duration(math.MaxInt64)}
+	}
+	return Result{
+		Allowed:    false,
+		RetryAfter: time.Duration((1 - tokens) / limit.Rate * float64(time.Second)),
+	}
+}
+
+// take removes a token if one is available, returning the new number of tokens and the result.
+func take(tokens float64, updated time.Time, limit Limit, now time.Time) (float64, Result) {
+	tokens = refill(tokens, updated, limit, now)
+	res := result(tokens, limit)
+	if res.Allowed {
+		tokens--
+	}
+	return tokens, res
+}
+
+// RunCleanup periodically removes buckets that haven't been used for maxAge until the context is cancelled.
+func RunCleanup(ctx context.Context, store Store, interval time.Duration, maxAge time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := store.Cleanup(ctx, now.Add(-maxAge)); err != nil {
+				onError(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreTake(t *testing.T) {
+	store := NewMemoryStore()
+	limit := PerMinute(60, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		res, err := store.Take(context.Background(), "key", limit, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Allowed {
+			t.Fatalf("expected request %d of the burst to be allowed", i+1)
+		}
+	}
+
+	res, _ := store.Take(context.Background(), "key", limit, now)
+	if res.Allowed {
+		t.Fatal("expected request after the burst to be rejected")
+	}
+	if res.RetryAfter != time.Second {
+		t.Fatalf("expected to retry after 1s, got %s", res.RetryAfter)
+	}
+
+	other, _ := store.Take(context.Background(), "other", limit, now)
+	if !other.Allowed {
+		t.Fatal("expected buckets to be independent")
+	}
+
+	res, _ = store.Take(context.Background(), "key", limit, now.Add(time.Second))
+	if !res.Allowed {
+		t.Fatal("expected a token to have refilled")
+	}
+
+	res, _ = store.Take(context.Background(), "key", limit, now.Add(time.Minute))
+	if !res.Allowed {
+		t.Fatal("expected the bucket to have refilled")
+	}
+}
+
+func TestMemoryStorePeek(t *testing.T) {
+	store := NewMemoryStore()
+	limit := Every(15*time.Minute, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		res, _ := store.Peek(context.Background(), "key", limit, now)
+		if !res.Allowed {
+			t.Fatalf("expected peek %d to be allowed", i+1)
+		}
+		_, _ = store.Take(context.Background(), "key", limit, now)
+	}
+
+	res, _ := store.Peek(context.Background(), "key", limit, now.Add(time.Minute))
+	if res.Allowed {
+		t.Fatal("expected to be locked out")
+	}
+	if res.RetryAfter != 14*time.Minute {
+		t.Fatalf("expected to retry after 14m, got %s", res.RetryAfter)
+	}
+
+	res, _ = store.Peek(context.Background(), "key", limit, now.Add(15*time.Minute))
+	if !res.Allowed {
+		t.Fatal("expected the lockout to have ended")
+	}
+}
+
+func TestMemoryStoreCleanup(t *testing.T) {
+	store := NewMemoryStore()
+	limit := PerMinute(1, 1)
+	now := time.Now()
+
+	_, _ = store.Take(context.Background(), "old", limit, now.Add(-time.Hour))
+	_, _ = store.Take(context.Background(), "new", limit, now)
+
+	if err := store.Cleanup(context.Background(), now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := store.buckets["old"]; ok {
+		t.Fatal("expected the idle bucket to be removed")
+	}
+	if _, ok := store.buckets["new"]; !ok {
+		t.Fatal("expected the recent bucket to be kept")
+	}
+}
@@ -5,5 +5,5 @@ pushd coldmfa/app || exit 1
 npm run build
 popd || exit 1
 
-# In dev, run `go run . dev`
+# In dev, run `go run . dev`, optionally with `--dev-users-file dev-users.json` to test with multiple users
 go run .
@@ -0,0 +1,155 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2/log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader serves a certificate, and optionally a client CA bundle, from files that are reloaded when they change. This
+// allows certificates to be renewed without restarting Locus.
+type Reloader struct {
+	certFile     string
+	keyFile      string
+	clientCaFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCas *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+// NewReloader loads the certificate, key and client CA bundle. The client CA file is optional, if it is set then client
+// certificates are verified against it when they are presented.
+func NewReloader(certFile string, keyFile string, clientCaFile string) (*Reloader, error) {
+	r := &Reloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCaFile: clientCaFile,
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCaFile != "" {
+		files = append(files, r.clientCaFile)
+	}
+	return files
+}
+
+func (r *Reloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	var clientCas *x509.CertPool
+	if r.clientCaFile != "" {
+		pem, err := os.ReadFile(r.clientCaFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %w", err)
+		}
+
+		clientCas = x509.NewCertPool()
+		if !clientCas.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in client CA file")
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCas = clientCas
+	r.modTimes = modTimes
+
+	return nil
+}
+
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// Likely to be part way through being replaced, check again next time
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Watch checks the files for changes at the given interval until the context is cancelled. If a changed file can't be
+// loaded then the previous certificate is kept, so that a bad renewal doesn't take the server down.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+
+			if err := r.load(); err != nil {
+				log.Errorf("failed to reload TLS certificate, keeping the previous certificate: %s", err.Error())
+				continue
+			}
+			log.Info("Reloaded TLS certificate")
+		}
+	}
+}
+
+// Config returns a TLS config that always uses the most recently loaded certificate and client CAs. Client
+// certificates are requested but not required at the TLS layer, so that browsers without a certificate can still
+// connect. Whether a certificate is required is decided per route.
+func (r *Reloader) Config() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		config := base.Clone()
+		config.GetConfigForClient = nil
+		config.Certificates = []tls.Certificate{*r.cert}
+		if r.clientCas != nil {
+			config.ClientCAs = r.clientCas
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+
+		return config, nil
+	}
+
+	return base
+}
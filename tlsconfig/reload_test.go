@@ -0,0 +1,117 @@
+package tlsconfig
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"github.com/EphyraSoftware/locus/internal/testcert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeFile writes a file with the given modification time, so that a change is seen even on filesystems with coarse
+// timestamps.
+func writeFile(t *testing.T, path string, content []byte, modTime time.Time) {
+	t.Helper()
+
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// served is the leaf certificate that the config serves to a new client.
+func served(t *testing.T, config *tls.Config) []byte {
+	t.Helper()
+
+	clientConfig, err := config.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clientConfig.Certificates) != 1 {
+		t.Fatalf("expected one certificate, got %d", len(clientConfig.Certificates))
+	}
+	return clientConfig.Certificates[0].Certificate[0]
+}
+
+func TestReloaderPicksUpRotatedCertificate(t *testing.T) {
+	ca := testcert.NewCA(t, "Test CA")
+	dir := t.TempDir()
+	certFile, keyFile, clientCaFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+
+	start := time.Now().Add(-time.Hour)
+	first := ca.Server()
+	writeFile(t, certFile, first.CertPEM, start)
+	writeFile(t, keyFile, first.KeyPEM, start)
+	writeFile(t, clientCaFile, ca.PEM, start)
+
+	reloader, err := NewReloader(certFile, keyFile, clientCaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := reloader.Config()
+
+	clientConfig, err := config.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientConfig.ClientAuth != tls.VerifyClientCertIfGiven || clientConfig.ClientCAs == nil {
+		t.Fatalf("expected client certificates to be verified if given, got %v", clientConfig.ClientAuth)
+	}
+	if !bytes.Equal(served(t, config), first.Cert.Certificate[0]) {
+		t.Fatal("expected the first certificate to be served")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Watch(ctx, 10*time.Millisecond)
+
+	// A renewal that can't be loaded keeps the previous certificate
+	writeFile(t, certFile, []byte("not a certificate"), start.Add(time.Minute))
+	time.Sleep(100 * time.Millisecond)
+	if !bytes.Equal(served(t, config), first.Cert.Certificate[0]) {
+		t.Fatal("expected the previous certificate to be kept")
+	}
+
+	second := ca.Server()
+	writeFile(t, keyFile, second.KeyPEM, start.Add(2*time.Minute))
+	writeFile(t, certFile, second.CertPEM, start.Add(2*time.Minute))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !bytes.Equal(served(t, config), second.Cert.Certificate[0]) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the rotated certificate to be served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloaderWithoutClientCa(t *testing.T) {
+	ca := testcert.NewCA(t, "Test CA")
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	leaf := ca.Server()
+	writeFile(t, certFile, leaf.CertPEM, time.Now())
+	writeFile(t, keyFile, leaf.KeyPEM, time.Now())
+
+	reloader, err := NewReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := reloader.Config().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientConfig.ClientAuth != tls.NoClientCert || clientConfig.ClientCAs != nil {
+		t.Fatalf("expected client certificates not to be requested, got %v", clientConfig.ClientAuth)
+	}
+
+	_, err = NewReloader(certFile, keyFile, certFile+".missing")
+	if err == nil {
+		t.Fatal("expected a missing client CA file to fail")
+	}
+}